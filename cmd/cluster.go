@@ -16,40 +16,99 @@ var clusterCmd = &cobra.Command{
 // Create the 'create-lb' subcommand to create the load balancer VM
 var createLBCmd = &cobra.Command{
 	Use:   "create-lb",
-	Short: "Create the load balancer VM for the OpenShift cluster",
+	Short: "Create the load balancer of the OpenShift cluster, a VM or a unit on the host (--lb-mode)",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		logging.Info("Creating Load Balancer VM")
+		logging.Info("Creating Load Balancer")
+
+		if err := cluster.ValidateLBMode(lbMode); err != nil {
+			return err
+		}
+		sources, err := libvirt.ParseIPSources(ipSources)
+		if err != nil {
+			return err
+		}
+		disks, err := parseDiskSpecs()
+		if err != nil {
+			return err
+		}
+		tuning, err := parseTuningSpecs()
+		if err != nil {
+			return err
+		}
+		boot := cluster.BootOptions{Firmware: firmware, TPM: tpmRoles}
+		if err = boot.Validate(arch); err != nil {
+			return err
+		}
+		network, err := libvirt.EnsureLibvirtNetwork(clusterNetworkParams(), connectURI)
+		if err != nil {
+			return err
+		}
+		if err = cluster.RecordNetwork(clusterName, network); err != nil {
+			return err
+		}
+
+		// Without a VM, the load balancer runs on this host
+		if lbMode != cluster.LBModeVM {
+			return cluster.CreateHostLB(cluster.HostLBParams{
+				Mode:        lbMode,
+				ClusterName: clusterName,
+				BaseDomain:  baseDom,
+				VirNet:      network.Name,
+				DNSMode:     dnsMode,
+				NMaster:     nMasters,
+				NWorker:     nWorkers,
+				InfraNodes:  infraNodes,
+				URI:         connectURI,
+			}, dnsDir, dnsSvc, network.GatewayIP)
+		}
 
 		// Generate HAProxy config
-		err := cluster.GenerateHAProxyConfig(clusterName, baseDom, nMasters)
+		err = cluster.GenerateHAProxyConfig(clusterName, baseDom, nMasters, nWorkers, infraNodes, network.MachineNetworkV6 != nil)
 		if err != nil {
 			logging.Fatal("Failed to generate HAProxy config", err)
 		}
 
 		// Create the Load Balancer VM
-		vmDiskPath, err := cluster.ConfigureLBVM(clusterName, sshPubKeyFile)
+		vmDiskPath, err := cluster.ConfigureLBVM(clusterName, sshPubKeyFile, connectURI)
 		if err != nil {
 			return err
 		}
 		logging.Info("Load Balancer VM successfully configured (virt-customize)")
-		_, gatewayIP, err := libvirt.EnsureLibvirtNetwork(virNetOct, defLibvirtNet, LibguestfsBackendDirect)
-		err = cluster.CreateLBVM(cluster.LBVMParams{
+		return cluster.CreateLBVM(cmd.Context(), cluster.LBVMParams{
 			ClusterName: clusterName,
 			CPU:         lbCPU,
 			MEM:         lbMem,
-			VirNet:      defLibvirtNet,
+			VirNet:      network.Name,
 			VMDiskPath:  vmDiskPath,
 			SSHPubKey:   sshPubKeyFile,
 			BaseDomain:  baseDom,
-		}, dnsDir, dnsSvc, gatewayIP)
+			DNSMode:     dnsMode,
+			Timeouts:    timeouts,
+			IPSources:   sources,
+			Boot:        boot,
+			Arch:        arch,
+			Machine:     machine,
+			LogDir:      consoleLogDir(),
+			Disks:       disks,
+			Tuning:      tuning,
+			URI:         connectURI,
+		}, dnsDir, dnsSvc, network.GatewayIP)
+	},
+}
 
-		return nil
+// Create the 'destroy' subcommand to remove the cluster VMs and their disks
+var destroyCmd = &cobra.Command{
+	Use:   "destroy",
+	Short: "Remove the cluster VMs, their disks and addresses, and the setup directory",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.DestroyCluster(destroyParams())
 	},
 }
 
 func init() {
 	// Add 'create-lb' as a subcommand under 'cluster'
 	clusterCmd.AddCommand(createLBCmd)
+	clusterCmd.AddCommand(destroyCmd)
 
 	// Add the main cluster command to the root command
 	rootCmd.AddCommand(clusterCmd)
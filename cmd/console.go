@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+)
+
+// Create the 'console' subcommand to attach to the serial console of a node
+var consoleCmd = &cobra.Command{
+	Use:   "console <node>",
+	Short: "Attach to the serial console of a cluster VM (detach with Ctrl+])",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.AttachConsole(clusterName, args[0], connectURI)
+	},
+}
+
+// Create the 'exec' subcommand to run a command on a node
+var execCmd = &cobra.Command{
+	Use:   "exec <node> -- <command>...",
+	Short: "Run a command on a cluster VM over SSH, or through the guest agent when SSH is unavailable",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := cluster.RunOnNode(cmd.Context(), clusterName, args[0], strings.Join(args[1:], " "), connectURI)
+		fmt.Print(out)
+		return err
+	},
+}
+
+func init() {
+	clusterCmd.AddCommand(consoleCmd, execCmd)
+}
@@ -2,9 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 
+	"openshift-qemu/pkg/cluster"
+	"openshift-qemu/pkg/dns"
+	"openshift-qemu/pkg/libvirt"
 	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
 	"openshift-qemu/pkg/utils"
 
 	"github.com/spf13/cobra"
@@ -21,13 +27,20 @@ var downloadCmd = &cobra.Command{
 		clusterName, _ := cmd.Flags().GetString("cluster-name")
 		dnsDir, _ := cmd.Flags().GetString("dns-dir")
 		sshPubKeyFile, _ := cmd.Flags().GetString("ssh-pub-key-file")
-		// pullSecFile, _ := cmd.Flags().GetString("pull-secret")
+		pullSecFile, _ := cmd.Flags().GetString("pull-secret")
 		logging.Title("DOWNLOAD AND PREPARE OPENSHIFT 4 INSTALLATION")
 		logging.Info("Starting the download and preparation process...")
 
+		if err := libvirt.ValidateArch(arch, ""); err != nil {
+			return err
+		}
+
 		// Version checks (OpenShift and RHCOS)
 		logging.Step("Step 3: Running OpenShift and RHCOS Version Checks...")
-		cfg := utils.Check(ocpVersion, rhcosVersion, lbImageURL, yesFlag)
+		cfg := utils.Check(ocpVersion, rhcosVersion, lbImage(), arch, yesFlag)
+		if err := recordOCPVersion(clusterName, cfg.OCPVersion); err != nil {
+			return err
+		}
 
 		// Step 1: Create and navigate to setup directory
 		logging.Info(fmt.Sprintf("Creating and using directory %s", setupDir))
@@ -37,13 +50,15 @@ var downloadCmd = &cobra.Command{
 			return err
 		}
 
-		// Step 2: Create hosts file for the cluster
-		hostsFile := filepath.Join("/etc", "hosts."+clusterName)
-		logging.Info(fmt.Sprintf("Creating a hosts file for this cluster: %s", hostsFile))
-		err = utils.CreateHostsAndDNSConfig(clusterName, dnsDir)
-		if err != nil {
-			logging.Error(fmt.Sprintf("Failed to configure host DNS %s", hostsFile), err)
-			return err
+		// Step 2: Create hosts file for the cluster (libvirt DNS mode keeps records in the network)
+		if dnsMode == dns.ModeHost {
+			hostsFile := filepath.Join("/etc", "hosts."+clusterName)
+			logging.Info(fmt.Sprintf("Creating a hosts file for this cluster: %s", hostsFile))
+			err = utils.CreateHostsAndDNSConfig(clusterName, dnsDir)
+			if err != nil {
+				logging.Error(fmt.Sprintf("Failed to configure host DNS %s", hostsFile), err)
+				return err
+			}
 		}
 
 		// Step 3: Check and use SSH public key
@@ -67,9 +82,35 @@ var downloadCmd = &cobra.Command{
 		if err := utils.DownloadRHCOSFiles(cfg.Image, cfg.ImageURL, cfg.Kernel, cfg.RHCOSKernelURL, cfg.Initramfs, cfg.InitramfsURL, cacheDir); err != nil {
 			return err
 		}
-		if err := utils.PrepareRHCOSInstall(cfg.Kernel, cfg.Initramfs, cfg.OCPVersion); err != nil {
+		if err := utils.PrepareRHCOSInstall(cfg.Kernel, cfg.Initramfs, cfg.OCPVersion, arch); err != nil {
+			return err
+		}
+
+		// Step 6: Generate install-config.yaml on the machine network of the cluster's libvirt network
+		logging.Info("Resolving the cluster machine network...")
+		network, err := libvirt.EnsureLibvirtNetwork(clusterNetworkParams(), connectURI)
+		if err != nil {
+			logging.Error("Failed to set up libvirt network", err)
+			return err
+		}
+		if err = cluster.RecordNetwork(clusterName, network); err != nil {
+			logging.Error("Failed to record libvirt network", err)
+			return err
+		}
+		pullSec, err := os.ReadFile(pullSecFile)
+		if err != nil {
+			logging.Error(fmt.Sprintf("Failed to read pull secret %s", pullSecFile), err)
 			return err
 		}
+		sshKey := sshPubKeyFile
+		if sshKey == "" {
+			sshKey = "sshkey.pub"
+		}
+		machineNetworkV6 := ""
+		if network.MachineNetworkV6 != nil {
+			machineNetworkV6 = network.MachineNetworkV6.String()
+		}
+		utils.CreateInstallConfig(setupDir, clusterName, nMasters, strings.TrimSpace(string(pullSec)), sshKey, network.MachineNetwork.String(), machineNetworkV6, arch)
 
 		// Further steps for preparation...
 		logging.Ok("Download and preparation process completed.")
@@ -80,3 +121,13 @@ var downloadCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(downloadCmd)
 }
+
+// recordOCPVersion remembers the resolved OpenShift version in the cluster state
+func recordOCPVersion(clusterName, version string) error {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return err
+	}
+	st.OCPVersion = version
+	return st.Save()
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+)
+
+var (
+	forwardHostIP string
+	forwardPorts  []int
+	snippetFormat string
+)
+
+// Create the 'forward' subcommand
+var forwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Manages access to the cluster through an address of the host",
+}
+
+// Create the 'enable' subcommand to forward host ports to the load balancer
+var enableForwardCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Forward the API and ingress ports of a host address to the load balancer",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if forwardHostIP == "" {
+			return fmt.Errorf("--host-ip is required")
+		}
+		err := cluster.EnableForwarding(cluster.ForwardParams{
+			ClusterName: clusterName,
+			HostIP:      forwardHostIP,
+			Ports:       forwardPorts,
+			URI:         connectURI,
+		})
+		if err != nil {
+			return err
+		}
+		snippet, err := cluster.ForwardSnippet(clusterName, baseDom, cluster.SnippetHosts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Add this to /etc/hosts on machines reaching the cluster:\n%s", snippet)
+		return nil
+	},
+}
+
+// Create the 'disable' subcommand to remove the forwarding rules
+var disableForwardCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Remove the forwarding rules of the cluster",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.DisableForwarding(clusterName, connectURI)
+	},
+}
+
+// Create the 'snippet' subcommand to print name resolution for remote users
+var snippetForwardCmd = &cobra.Command{
+	Use:   "snippet",
+	Short: "Print /etc/hosts lines or dnsmasq options resolving the cluster to the forwarded address",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snippet, err := cluster.ForwardSnippet(clusterName, baseDom, snippetFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Print(snippet)
+		return nil
+	},
+}
+
+func init() {
+	enableForwardCmd.Flags().StringVar(&forwardHostIP, "host-ip", "", "Host address users connect to")
+	enableForwardCmd.Flags().IntSliceVar(&forwardPorts, "ports", cluster.DefaultForwardPorts, "Load balancer ports to forward")
+	snippetForwardCmd.Flags().StringVar(&snippetFormat, "format", cluster.SnippetHosts, "Snippet format, hosts or dnsmasq")
+
+	forwardCmd.AddCommand(enableForwardCmd, disableForwardCmd, snippetForwardCmd)
+	clusterCmd.AddCommand(forwardCmd)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+	"openshift-qemu/pkg/logging"
+)
+
+// Create the 'gc' command to find resources left behind by failed runs
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "List resources of clusters without a state file, and remove them with --yes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		orphans, err := cluster.CollectGarbage(cluster.GCParams{
+			VMDir:  vmDir,
+			DNSDir: dnsDir,
+			DNSSvc: dnsSvc,
+			URI:    connectURI,
+			Remove: yesFlag,
+		})
+		if len(orphans) == 0 && err == nil {
+			logging.Ok("No orphaned resources found")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tNAME\tCLUSTER\tDETAIL\tREMOVED")
+		for _, o := range orphans {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", o.Kind, o.Name, o.Cluster, o.Detail, o.Removed)
+		}
+		if flushErr := w.Flush(); flushErr != nil {
+			return flushErr
+		}
+		if err == nil && !yesFlag {
+			logging.Info("Run again with --yes to remove them")
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+}
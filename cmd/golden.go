@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+	"openshift-qemu/pkg/dns"
+	"openshift-qemu/pkg/libvirt"
+)
+
+var (
+	goldenDir             string
+	goldenShutdownTimeout time.Duration
+)
+
+// Create the 'golden' subcommand
+var goldenCmd = &cobra.Command{
+	Use:   "golden",
+	Short: "Bakes installed clusters into base images and creates clusters from them",
+}
+
+// Create the 'bake' subcommand to save the cluster disks as base images
+var bakeGoldenCmd = &cobra.Command{
+	Use:   "bake <name>",
+	Short: "Save every VM disk of an installed cluster as a read-only base image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.BakeCluster(cmd.Context(), cluster.GoldenParams{
+			Name:            args[0],
+			GoldenDir:       goldenDir,
+			ClusterName:     clusterName,
+			BaseDomain:      baseDom,
+			SetupDir:        setupDir,
+			ShutdownTimeout: goldenShutdownTimeout,
+			URI:             connectURI,
+		})
+	},
+}
+
+// Create the 'create' subcommand to create a cluster from overlays on a golden image
+var createGoldenCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create the cluster as qcow2 overlays on a golden image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sources, err := libvirt.ParseIPSources(ipSources)
+		if err != nil {
+			return err
+		}
+		network, err := libvirt.EnsureLibvirtNetwork(clusterNetworkParams(), connectURI)
+		if err != nil {
+			return err
+		}
+		if err = cluster.RecordNetwork(clusterName, network); err != nil {
+			return err
+		}
+
+		return cluster.CreateFromGolden(cmd.Context(), cluster.GoldenParams{
+			Name:        args[0],
+			GoldenDir:   goldenDir,
+			ClusterName: clusterName,
+			BaseDomain:  baseDom,
+			SetupDir:    setupDir,
+			VMDir:       vmDir,
+			VirNet:      network.Name,
+			DNSMode:     dnsMode,
+			DNSConfig: dns.DNSConfig{
+				ClusterName: clusterName,
+				BaseDomain:  baseDom,
+				DNSDir:      dnsDir,
+				DNSSvc:      dnsSvc,
+				LibvirtGwIP: network.GatewayIP,
+			},
+			Timeouts:  timeouts,
+			IPSources: sources,
+			URI:       connectURI,
+		})
+	},
+}
+
+func init() {
+	goldenCmd.PersistentFlags().StringVar(&goldenDir, "golden-dir", "/var/lib/libvirt/images/golden", "Directory holding golden images")
+	bakeGoldenCmd.Flags().DurationVar(&goldenShutdownTimeout, "shutdown-timeout", 5*time.Minute, "How long to wait for each VM to shut down")
+
+	goldenCmd.AddCommand(bakeGoldenCmd, createGoldenCmd)
+	clusterCmd.AddCommand(goldenCmd)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+)
+
+var lbPersist bool
+
+// Create the 'lb' command to manage and run the load balancer of a cluster
+var lbCmd = &cobra.Command{
+	Use:   "lb",
+	Short: "Manages the load balancer of a cluster, or runs the built-in one",
+}
+
+// Create the 'status' subcommand to show backend and server health
+var lbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the health of the load balancer backends and servers",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		servers, err := cluster.LBStatus(cmd.Context(), lbParams())
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BACKEND\tSERVER\tSTATUS\tCHECK\tWEIGHT")
+		for _, s := range servers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Backend, s.Server, s.Status, s.Check, s.Weight)
+		}
+		return w.Flush()
+	},
+}
+
+// Create the 'disable-server' subcommand to put a node into maintenance
+var lbDisableServerCmd = &cobra.Command{
+	Use:   "disable-server <node>",
+	Short: "Stop sending new connections to a node in every backend",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.DisableLBServer(cmd.Context(), lbParams(), args[0])
+	},
+}
+
+// Create the 'enable-server' subcommand to take a node out of maintenance
+var lbEnableServerCmd = &cobra.Command{
+	Use:   "enable-server <node>",
+	Short: "Send connections to a disabled node again",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.EnableLBServer(cmd.Context(), lbParams(), args[0])
+	},
+}
+
+// Create the 'remove-bootstrap' subcommand to retire the bootstrap node
+var lbRemoveBootstrapCmd = &cobra.Command{
+	Use:   "remove-bootstrap",
+	Short: "Take the bootstrap node out of the load balancer and remove its VM unless --keep-bootstrap is set",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.RemoveBootstrap(cmd.Context(), lbParams())
+	},
+}
+
+// Create the 'sync' subcommand to route the load balancer to the current nodes
+var lbSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Regenerate haproxy.cfg from the recorded nodes, push it to the load balancer and reload HAProxy",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		params := cluster.LBSyncParams{ClusterName: clusterName, BaseDomain: baseDom, URI: connectURI}
+		if cmd.Flags().Changed("infra-nodes") {
+			params.InfraNodes = infraNodes
+		}
+		return cluster.SyncLBConfig(cmd.Context(), params)
+	},
+}
+
+// Create the 'serve' subcommand, which the unit of --lb-mode=builtin runs
+var lbServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Proxy the API, machine config and ingress ports to the healthy nodes recorded in the cluster state",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return cluster.ServeLB(ctx, clusterName)
+	},
+}
+
+// lbParams returns the load balancer parameters for the current cluster
+func lbParams() cluster.LBParams {
+	return cluster.LBParams{
+		ClusterName:   clusterName,
+		BaseDomain:    baseDom,
+		Persist:       lbPersist,
+		KeepBootstrap: keepBootstrap,
+		URI:           connectURI,
+	}
+}
+
+func init() {
+	lbDisableServerCmd.Flags().BoolVar(&lbPersist, "persist", false, "Also keep the node disabled in haproxy.cfg across reloads")
+
+	lbCmd.AddCommand(lbStatusCmd, lbDisableServerCmd, lbEnableServerCmd, lbRemoveBootstrapCmd, lbSyncCmd, lbServeCmd)
+	rootCmd.AddCommand(lbCmd)
+}
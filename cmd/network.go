@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/libvirt"
+)
+
+var (
+	resMAC  string
+	resIP   string
+	resName string
+)
+
+// Create the 'network' subcommand
+var networkCmd = &cobra.Command{
+	Use:   "network",
+	Short: "Manages the libvirt network used by the cluster",
+}
+
+// Create the 'reservations' subcommand to manage DHCP host entries
+var reservationsCmd = &cobra.Command{
+	Use:   "reservations",
+	Short: "Manages DHCP host reservations of the cluster network",
+}
+
+// Create the 'list' subcommand to show the DHCP host entries
+var listReservationsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List DHCP reservations of the cluster network",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := libvirt.NewLibvirtConnection(connectURI)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		reservations, err := libvirt.ListDHCPReservations(conn, clusterNetworkName())
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MAC\tIP\tNAME")
+		for _, r := range reservations {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.MAC, r.IP, r.Name)
+		}
+		return w.Flush()
+	},
+}
+
+// Create the 'add' subcommand to add or replace a DHCP host entry
+var addReservationCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a DHCP reservation, replacing entries with the same MAC, IP or name",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		res := libvirt.DHCPReservation{MAC: resMAC, IP: resIP, Name: resName}
+		// libvirt matches DHCPv6 clients by host name, not MAC
+		switch {
+		case resIP == "":
+			return fmt.Errorf("--ip is required")
+		case res.IsIPv6() && resName == "":
+			return fmt.Errorf("--name is required for an IPv6 reservation")
+		case res.IsIPv6() && resMAC != "":
+			return fmt.Errorf("--mac cannot be used for an IPv6 reservation, which libvirt matches by --name")
+		case !res.IsIPv6() && resMAC == "":
+			return fmt.Errorf("--mac is required for an IPv4 reservation")
+		}
+		conn, err := libvirt.NewLibvirtConnection(connectURI)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return libvirt.AddDHCPReservation(conn, clusterNetworkName(), res)
+	},
+}
+
+// Create the 'modify' subcommand to change an existing DHCP host entry
+var modifyReservationCmd = &cobra.Command{
+	Use:   "modify <mac|ip|name>",
+	Short: "Change the MAC, IP or name of the DHCP reservation matching a MAC, IP or host name",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if resMAC == "" && resIP == "" && resName == "" {
+			return fmt.Errorf("at least one of --mac, --ip or --name is required")
+		}
+		conn, err := libvirt.NewLibvirtConnection(connectURI)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return libvirt.ModifyDHCPReservation(conn, clusterNetworkName(), args[0], libvirt.DHCPReservation{MAC: resMAC, IP: resIP, Name: resName})
+	},
+}
+
+// Create the 'remove' subcommand to delete DHCP host entries
+var removeReservationCmd = &cobra.Command{
+	Use:   "remove <mac|ip|name>",
+	Short: "Remove the DHCP reservations matching a MAC, IP or host name",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := libvirt.NewLibvirtConnection(connectURI)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		removed, err := libvirt.RemoveDHCPReservations(conn, clusterNetworkName(), args[0])
+		if err != nil {
+			return err
+		}
+		if len(removed) == 0 {
+			return fmt.Errorf("no DHCP reservation matches %s", args[0])
+		}
+		return nil
+	},
+}
+
+// clusterNetworkParams returns the network selection given by --libvirt-network, --libvirt-oct or --libvirt-cidr
+func clusterNetworkParams() libvirt.NetworkParams {
+	return libvirt.NetworkParams{
+		Name:        defLibvirtNet,
+		Octet:       virNetOct,
+		CIDR:        virNetCIDR,
+		CIDR6:       virNetCIDR6,
+		Pool:        subnetPool,
+		Prefix:      subnetPrefix,
+		ClusterName: clusterName,
+	}
+}
+
+// clusterNetworkName returns the name of the libvirt network used by the cluster
+func clusterNetworkName() string {
+	return clusterNetworkParams().NetworkName()
+}
+
+func init() {
+	for _, c := range []*cobra.Command{addReservationCmd, modifyReservationCmd} {
+		c.Flags().StringVar(&resMAC, "mac", "", "MAC address of the host")
+		c.Flags().StringVar(&resIP, "ip", "", "IP address to reserve")
+		c.Flags().StringVar(&resName, "name", "", "Host name of the reservation")
+	}
+
+	reservationsCmd.AddCommand(listReservationsCmd, addReservationCmd, modifyReservationCmd, removeReservationCmd)
+	networkCmd.AddCommand(reservationsCmd)
+
+	// Add the main network command to the root command
+	rootCmd.AddCommand(networkCmd)
+}
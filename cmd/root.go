@@ -7,6 +7,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"openshift-qemu/pkg/cluster"
 	"openshift-qemu/pkg/dns"
 	"openshift-qemu/pkg/libvirt"
 )
@@ -35,12 +37,18 @@ var (
 	lbImageURL    string
 	lbCPU         int
 	lbMem         int
+	lbMode        string
 	wsPort        int
 	defLibvirtNet string
 	virNetOct     string
+	virNetCIDR    string
+	virNetCIDR6   string
+	subnetPool    []string
+	subnetPrefix  int
 	clusterName   string
 	baseDom       string
 	dnsDir        string
+	dnsMode       string
 	vmDir         string
 	setupDir      string
 	cacheDir      string
@@ -53,6 +61,18 @@ var (
 	yesFlag       bool
 
 	startTS    time.Time
+	timeouts   libvirt.WaitTimeouts
+	ipSources  []string
+	firmware   map[string]string
+	tpmRoles   []string
+	arch       string
+	machine    cluster.MachineOptions
+	diskSpecs  []string
+	tuneSpecs  []string
+	rootDiskGB uint
+	overcommit bool
+	infraNodes []string
+	connectURI string
 	invocation string
 	exeDir     string
 )
@@ -61,13 +81,14 @@ const (
 	LibguestfsBackend       = "LIBGUESTFS_BACKEND"
 	LibguestfsBackendDirect = "direct" // "libvirt:qemu:///system"
 	dnsSvc                  = "NetworkManager"
+	defaultLBImageURL       = "https://cloud.centos.org/centos/9-stream/x86_64/images/CentOS-Stream-GenericCloud-9.qcow2"
 )
 
 // Initialize the default values and Cobra flags
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&ocpVersion, "ocp-version", "O", "4.17", "OpenShift version")
 	rootCmd.PersistentFlags().StringVarP(&rhcosVersion, "rhcos-version", "R", "", "RHCOS version")
-	rootCmd.PersistentFlags().StringVarP(&lbImageURL, "lb-image", "l", "https://cloud.centos.org/centos/9-stream/x86_64/images/CentOS-Stream-GenericCloud-9.qcow2", "CentOS cloud image URL")
+	rootCmd.PersistentFlags().StringVarP(&lbImageURL, "lb-image", "l", defaultLBImageURL, "CentOS cloud image URL (the default follows --arch)")
 	rootCmd.PersistentFlags().IntVarP(&nMasters, "masters", "m", 3, "Number of master nodes")
 	rootCmd.PersistentFlags().IntVarP(&nWorkers, "workers", "w", 2, "Number of worker nodes")
 	rootCmd.PersistentFlags().IntVar(&masCPU, "master-cpu", 4, "Number of vCPUs for master nodes")
@@ -78,12 +99,18 @@ func init() {
 	rootCmd.PersistentFlags().IntVar(&btsMem, "bootstrap-mem", 16000, "Memory size for bootstrap node in MB")
 	rootCmd.PersistentFlags().IntVar(&lbCPU, "lb-cpu", 4, "Number of vCPUs for load balancer VM")
 	rootCmd.PersistentFlags().IntVar(&lbMem, "lb-mem", 1536, "Memory size for load balancer VM in MB")
+	rootCmd.PersistentFlags().StringVar(&lbMode, "lb-mode", cluster.LBModeVM, "Where the load balancer runs: vm (HAProxy in a CentOS VM), host (HAProxy on the hypervisor, on the libvirt gateway address) or builtin (openshift-qemu lb serve on the hypervisor, likewise)")
 	rootCmd.PersistentFlags().IntVar(&wsPort, "ws-port", 1234, "Web server port for load balancer VM")
 	rootCmd.PersistentFlags().StringVarP(&defLibvirtNet, "libvirt-network", "n", "default", "Libvirt network")
 	rootCmd.PersistentFlags().StringVarP(&virNetOct, "libvirt-oct", "N", "", "Libvirt network octet")
+	rootCmd.PersistentFlags().StringVar(&virNetCIDR, "libvirt-cidr", "", "Create a libvirt network on this subnet, or 'auto' to pick a free one")
+	rootCmd.PersistentFlags().StringVar(&virNetCIDR6, "libvirt-cidr6", "", "Add an IPv6 /64 to a new libvirt network for a dual-stack cluster, or 'auto' for a generated ULA prefix")
+	rootCmd.PersistentFlags().StringSliceVar(&subnetPool, "subnet-pool", libvirt.DefaultSubnetPool, "Ranges searched by --libvirt-cidr=auto")
+	rootCmd.PersistentFlags().IntVar(&subnetPrefix, "subnet-prefix", 24, "Prefix length of subnets picked by --libvirt-cidr=auto")
 	rootCmd.PersistentFlags().StringVarP(&clusterName, "cluster-name", "c", "ocp4", "Cluster name")
 	rootCmd.PersistentFlags().StringVarP(&baseDom, "cluster-domain", "d", "local", "Cluster domain")
 	rootCmd.PersistentFlags().StringVarP(&dnsDir, "dns-dir", "z", "/etc/NetworkManager/dnsmasq.d", "DNS configuration directory")
+	rootCmd.PersistentFlags().StringVar(&dnsMode, "dns-mode", dns.ModeHost, "Where to publish cluster DNS records (host or libvirt)")
 	rootCmd.PersistentFlags().StringVarP(&vmDir, "vm-dir", "v", "/var/lib/libvirt/images", "VM directory")
 	rootCmd.PersistentFlags().StringVarP(&setupDir, "setup-dir", "s", "", "Setup directory")
 	rootCmd.PersistentFlags().StringVarP(&cacheDir, "cache-dir", "x", "/root/ocp4_downloads", "Cache directory")
@@ -92,10 +119,100 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&autostartVMs, "autostart-vms", false, "Autostart VMs after creation")
 	rootCmd.PersistentFlags().BoolVar(&keepBootstrap, "keep-bootstrap", false, "Keep the bootstrap VM after installation")
 	rootCmd.PersistentFlags().BoolVar(&freshDownload, "fresh-download", false, "Force fresh download of OCP and RHCOS images")
+	rootCmd.PersistentFlags().DurationVar(&timeouts.Start, "start-timeout", libvirt.DefaultWaitTimeouts.Start, "How long to wait for a VM to start")
+	rootCmd.PersistentFlags().DurationVar(&timeouts.IP, "ip-timeout", libvirt.DefaultWaitTimeouts.IP, "How long to wait for a VM to obtain an IP address")
+	rootCmd.PersistentFlags().DurationVar(&timeouts.SSH, "ssh-timeout", libvirt.DefaultWaitTimeouts.SSH, "How long to wait for SSH access to a VM")
+	rootCmd.PersistentFlags().StringSliceVar(&ipSources, "ip-sources", []string{"lease", "arp", "agent"}, "Order in which VM IP addresses are looked up (lease, arp, agent); add static to fall back to the recorded address once --ip-timeout expires")
+	rootCmd.PersistentFlags().StringToStringVar(&firmware, "firmware", nil, "Firmware per role, e.g. master=uefi-secure,worker=uefi (bios, uefi or uefi-secure; default bios)")
+	rootCmd.PersistentFlags().StringSliceVar(&tpmRoles, "tpm", nil, "Roles that get an emulated TPM 2.0, e.g. master,worker")
+	rootCmd.PersistentFlags().StringVar(&arch, "arch", libvirt.HostArch(), "Guest architecture (x86_64 or aarch64)")
+	rootCmd.PersistentFlags().StringVar(&machine.MachineType, "machine-type", "", "Machine type of the VMs (default: newest q35 or virt type of the host QEMU)")
+	rootCmd.PersistentFlags().StringVar(&machine.CPUMode, "cpu-mode", "", "CPU mode of the VMs, host-passthrough or host-model (default: host-passthrough when the host allows it)")
+	rootCmd.PersistentFlags().StringArrayVar(&diskSpecs, "disk", nil, "Extra disks per role, repeatable, e.g. role=worker,size=100,count=2,bus=virtio,serial=odf,shared=false,pool=default")
+	rootCmd.PersistentFlags().StringArrayVar(&tuneSpecs, "tuning", nil, "CPU pinning, NUMA placement, huge pages and disk modes per role, repeatable, e.g. role=master,cpuset=2-13,emulatorset=0-1,numa=0,hugepages=1G,cache=none,io=native,discard=unmap")
+	rootCmd.PersistentFlags().UintVar(&rootDiskGB, "root-disk-size", 50, "Root disk size of bootstrap, master and worker nodes in GB")
+	rootCmd.PersistentFlags().BoolVar(&overcommit, "allow-overcommit", false, "Continue when the host has fewer CPUs, less memory or less disk than the cluster asks for")
+	rootCmd.PersistentFlags().StringSliceVar(&infraNodes, "infra-nodes", nil, "Workers labelled to run the ingress routers, e.g. worker-1,worker-2 (default: all workers, or the masters without workers)")
+	rootCmd.PersistentFlags().StringVar(&connectURI, "connect", libvirt.DefaultURI, "libvirt connection URI, e.g. qemu:///system, qemu+ssh://host/system or test:///default")
 	rootCmd.PersistentFlags().BoolVar(&destroy, "destroy", false, "Destroy the cluster")
 	rootCmd.PersistentFlags().BoolVarP(&yesFlag, "yes", "y", false, "Automatically approve all prompts")
 }
 
+// lbImage returns the load balancer cloud image, switching the default image to the guest architecture.
+func lbImage() string {
+	if lbImageURL == defaultLBImageURL && arch != libvirt.ArchX86_64 {
+		return strings.Replace(lbImageURL, "/x86_64/", "/"+arch+"/", 1)
+	}
+	return lbImageURL
+}
+
+// parseDiskSpecs parses the --disk declarations.
+func parseDiskSpecs() ([]cluster.DiskSpec, error) {
+	var specs []cluster.DiskSpec
+	for _, spec := range diskSpecs {
+		d, err := cluster.ParseDiskSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, d)
+	}
+	return specs, nil
+}
+
+// parseTuningSpecs parses the --tuning declarations.
+func parseTuningSpecs() ([]cluster.TuningSpec, error) {
+	var specs []cluster.TuningSpec
+	for _, spec := range tuneSpecs {
+		t, err := cluster.ParseTuningSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, t)
+	}
+	return specs, nil
+}
+
+// capacityParams returns the cluster size to check against the host.
+func capacityParams(absVMDir string, disks []cluster.DiskSpec) cluster.CapacityParams {
+	return cluster.CapacityParams{
+		VMDir:           absVMDir,
+		URI:             connectURI,
+		NMaster:         nMasters,
+		NWorker:         nWorkers,
+		BtsMem:          btsMem,
+		BtsCPU:          btsCPU,
+		MasMem:          masMem,
+		MasCPU:          masCPU,
+		WorMem:          worMem,
+		WorCPU:          worCPU,
+		LBMem:           lbMem,
+		LBCPU:           lbCPU,
+		LBMode:          lbMode,
+		RootDiskGB:      rootDiskGB,
+		Disks:           disks,
+		AllowOvercommit: overcommit,
+	}
+}
+
+// destroyParams returns the parameters for removing the cluster.
+func destroyParams() cluster.DestroyParams {
+	return cluster.DestroyParams{
+		ClusterName: clusterName,
+		SetupDir:    setupDir,
+		URI:         connectURI,
+	}
+}
+
+// consoleLogDir returns where the serial consoles of the cluster VMs are logged. libvirt
+// only accepts absolute log paths.
+func consoleLogDir() string {
+	dir, err := filepath.Abs(filepath.Join(setupDir, "logs"))
+	if err != nil {
+		logging.Fatal("failed to resolve console log directory", err)
+	}
+	return dir
+}
+
 // checkIfRoot checks if the current user is root
 func checkIfRoot() {
 	currentUser, err := user.Current()
@@ -155,12 +272,39 @@ var rootCmd = &cobra.Command{
 		if lbCPU < 0 {
 			logging.Fatal("Invalid value for --lb-cpu: %d", fmt.Errorf("%d", lbCPU))
 		}
-		netOct, err := strconv.Atoi(virNetOct)
-		if err != nil {
-			logging.Fatal("Failed to convert --lib-virt-oct to string for validation", fmt.Errorf("value=%s | err=%v", virNetOct, err))
+		if virNetOct != "" {
+			netOct, err := strconv.Atoi(virNetOct)
+			if err != nil {
+				logging.Fatal("Failed to convert --lib-virt-oct to string for validation", fmt.Errorf("value=%s | err=%v", virNetOct, err))
+			}
+			if netOct < 0 || netOct > 255 {
+				logging.Fatal("Invalid value for --lib-virt-oct", fmt.Errorf("value=%s", virNetOct))
+			}
+		}
+		if rootDiskGB == 0 {
+			logging.Fatal("Invalid value for --root-disk-size", fmt.Errorf("value=%d", rootDiskGB))
+		}
+		if maxPrefix := cluster.MaxSubnetPrefix(nWorkers); subnetPrefix < 8 || subnetPrefix > maxPrefix {
+			logging.Fatal("Invalid value for --subnet-prefix", fmt.Errorf("value=%d, expected 8 to %d to fit the node addresses of %d workers", subnetPrefix, maxPrefix, nWorkers))
+		}
+		if dnsMode != dns.ModeHost && dnsMode != dns.ModeLibvirt {
+			logging.Fatal("Invalid value for --dns-mode", fmt.Errorf("value=%s", dnsMode))
 		}
-		if netOct < 0 || netOct > 255 {
-			logging.Fatal("Invalid value for --lib-virt-oct", fmt.Errorf("value=%s", virNetOct))
+		if err = cluster.ValidateLBMode(lbMode); err != nil {
+			logging.Fatal("Invalid value for --lb-mode", err)
+		}
+		if lbMode != cluster.LBModeVM {
+			if err = libvirt.RequireLocal(connectURI, "--lb-mode="+lbMode); err != nil {
+				logging.Fatal("Invalid value for --lb-mode", err)
+			}
+		}
+		if err = libvirt.ValidateArch(arch, ""); err != nil {
+			logging.Fatal("Invalid value for --arch", err)
+		}
+		if dnsMode == dns.ModeHost {
+			if err = libvirt.RequireLocal(connectURI, "--dns-mode=host"); err != nil {
+				logging.Fatal("Invalid value for --dns-mode", err)
+			}
 		}
 		if _, err = os.Stat(pullSecFile); err != nil {
 			logging.Fatal(fmt.Sprintf("Pull secret file not found: %s", pullSecFile), err)
@@ -184,14 +328,28 @@ var rootCmd = &cobra.Command{
 		logging.Info(fmt.Sprintf("%s VM Directory: %s", clusterName, absVMDir))
 
 		// Conditional logic based on flags
-		if defLibvirtNet != "" && virNetOct != "" {
-			logging.Fatal("invalid parameter (mutually-exclusive)", fmt.Errorf("specify either --libvirt-network (-n) (%s) or --libvirt-oct (-N) (%s), not both", defLibvirtNet, virNetOct))
+		if cmd.Flags().Changed("libvirt-network") && (virNetOct != "" || virNetCIDR != "") || virNetOct != "" && virNetCIDR != "" {
+			logging.Fatal("invalid parameter (mutually-exclusive)", fmt.Errorf("specify only one of --libvirt-network (-n) (%s), --libvirt-oct (-N) (%s) or --libvirt-cidr (%s)", defLibvirtNet, virNetOct, virNetCIDR))
 		}
-		if defLibvirtNet == "" && virNetOct == "" {
+		if defLibvirtNet == "" && virNetOct == "" && virNetCIDR == "" {
 			defLibvirtNet = "default"
 		}
+		if destroy {
+			if err = cluster.DestroyCluster(destroyParams()); err != nil {
+				logging.Fatal("Failed to destroy cluster", err)
+			}
+			return
+		}
+
 		// Pre-flight Checks
-		utils.CheckDependencies(setupDir, pullSecFile, dnsDir, clusterName, baseDom, LibguestfsBackendDirect)
+		utils.CheckDependencies(setupDir, pullSecFile, dnsDir, clusterName, baseDom, connectURI)
+		disks, err := parseDiskSpecs()
+		if err != nil {
+			logging.Fatal("Invalid value for --disk", err)
+		}
+		if err = cluster.CheckCapacity(capacityParams(absVMDir, disks)); err != nil {
+			logging.Fatal("Capacity check failed", err)
+		}
 
 		logging.Title("OPENSHIFT SETUP INITIALIZATION")
 		// Print some values to ensure everything is processed
@@ -204,24 +362,32 @@ var rootCmd = &cobra.Command{
 
 		// Step 1: Ensure libvirt network setup
 		logging.Step("Setting up Libvirt Network...")
-		bridgeName, gatewayIP, err := libvirt.EnsureLibvirtNetwork(virNetOct, defLibvirtNet, LibguestfsBackendDirect)
+		network, err := libvirt.EnsureLibvirtNetwork(clusterNetworkParams(), connectURI)
 		if err != nil {
 			log.Fatalf("Failed to set up libvirt network: %v", err)
 		}
+		if err = cluster.RecordNetwork(clusterName, network); err != nil {
+			log.Fatalf("Failed to record libvirt network: %v", err)
+		}
+		gatewayIP := network.GatewayIP
 		// Proceed with the rest of the setup
-		logging.Info(fmt.Sprintf("Libvirt bridge: %s, Gateway IP: %s", bridgeName, gatewayIP))
-
-		// Step 2: Run DNS checks
-		logging.Step("Step 2: Running DNS Checks...")
-		err = dns.TestDNS(dns.DNSConfig{
-			ClusterName: clusterName,
-			BaseDomain:  baseDom,
-			DNSDir:      dnsDir,
-			DNSSvc:      dnsSvc,
-			LibvirtGwIP: gatewayIP,
-		})
-		if err != nil {
-			log.Fatalf("Failed to run DNS checks: %v", err)
+		logging.Info(fmt.Sprintf("Libvirt bridge: %s, Gateway IP: %s, Machine network: %s", network.Bridge, gatewayIP, network.MachineNetwork))
+
+		// Step 2: Run DNS checks (libvirt mode does not depend on the host dnsmasq)
+		if dnsMode == dns.ModeLibvirt {
+			logging.Info("Cluster DNS records will be served by the libvirt network")
+		} else {
+			logging.Step("Step 2: Running DNS Checks...")
+			err = dns.TestDNS(dns.DNSConfig{
+				ClusterName: clusterName,
+				BaseDomain:  baseDom,
+				DNSDir:      dnsDir,
+				DNSSvc:      dnsSvc,
+				LibvirtGwIP: gatewayIP,
+			})
+			if err != nil {
+				log.Fatalf("Failed to run DNS checks: %v", err)
+			}
 		}
 	},
 }
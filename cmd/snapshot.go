@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+)
+
+var (
+	snapshotShutdown        bool
+	snapshotShutdownTimeout time.Duration
+)
+
+// Create the 'snapshot' subcommand
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manages snapshots of all cluster VMs",
+}
+
+// Create the 'create' subcommand to snapshot every cluster VM
+var createSnapshotCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Snapshot every VM of the cluster",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.CreateClusterSnapshot(cmd.Context(), snapshotParams(args[0]))
+	},
+}
+
+// Create the 'list' subcommand to show the cluster snapshots
+var listSnapshotsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snapshots of the cluster",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshots, err := cluster.ListClusterSnapshots(clusterName)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tOCP\tSHUTDOWN\tNODES")
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", s.Name, s.CreatedAt.Format("2006-01-02 15:04"), s.OCPVersion, s.Shutdown, strings.Join(s.Nodes, ","))
+		}
+		return w.Flush()
+	},
+}
+
+// Create the 'revert' subcommand to roll every cluster VM back
+var revertSnapshotCmd = &cobra.Command{
+	Use:   "revert <name>",
+	Short: "Revert every VM of the cluster to a snapshot",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.RevertClusterSnapshot(snapshotParams(args[0]))
+	},
+}
+
+// Create the 'delete' subcommand to remove a cluster snapshot
+var deleteSnapshotCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a snapshot from every VM of the cluster",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cluster.DeleteClusterSnapshot(snapshotParams(args[0]))
+	},
+}
+
+// snapshotParams returns the snapshot parameters for the current cluster
+func snapshotParams(name string) cluster.SnapshotParams {
+	return cluster.SnapshotParams{
+		ClusterName:     clusterName,
+		Name:            name,
+		OCPVersion:      ocpVersion,
+		Shutdown:        snapshotShutdown,
+		ShutdownTimeout: snapshotShutdownTimeout,
+		URI:             connectURI,
+	}
+}
+
+func init() {
+	createSnapshotCmd.Flags().BoolVar(&snapshotShutdown, "shutdown", false, "Shut the VMs down gracefully before the snapshot so etcd is consistent")
+	createSnapshotCmd.Flags().DurationVar(&snapshotShutdownTimeout, "shutdown-timeout", 5*time.Minute, "How long to wait for each VM to shut down")
+
+	snapshotCmd.AddCommand(createSnapshotCmd, listSnapshotsCmd, revertSnapshotCmd, deleteSnapshotCmd)
+	clusterCmd.AddCommand(snapshotCmd)
+}
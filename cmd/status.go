@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"openshift-qemu/pkg/cluster"
+	"openshift-qemu/pkg/libvirt"
+)
+
+var statusAll bool
+
+// Create the 'status' subcommand to show the VMs and networks owned by the cluster
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the VMs and networks created for the cluster",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := clusterName
+		if statusAll {
+			name = ""
+		}
+		status, err := cluster.ClusterStatus(name, connectURI)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CLUSTER\tKIND\tNAME\tROLE\tSTATE\tCREATED\tVERSION")
+		for _, d := range status.Domains {
+			fmt.Fprintf(w, "%s\tvm\t%s\t%s\t%s\t%s\t%s\n", d.Cluster, d.Name, d.Role, libvirt.DomainStateName(d.State), d.Created.Format("2006-01-02 15:04"), d.Version)
+		}
+		for _, n := range status.Networks {
+			state := "inactive"
+			if n.Active {
+				state = "active"
+			}
+			// Networks found without metadata have no creation time or version
+			created, version := "-", "-"
+			if !n.Created.IsZero() {
+				created, version = n.Created.Format("2006-01-02 15:04"), n.Version
+			}
+			fmt.Fprintf(w, "%s\tnetwork\t%s\t%s\t%s\t%s\t%s\n", n.Cluster, n.Name, n.Role, state, created, version)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+
+		if status.State != nil && status.State.OCPVersion != "" {
+			fmt.Printf("\nOpenShift %s on network %s (%s, %s)\n", status.State.OCPVersion, status.State.Network, status.State.Arch, status.State.MachineType)
+		}
+		return nil
+	},
+}
+
+func init() {
+	statusCmd.Flags().BoolVar(&statusAll, "all", false, "Show the VMs and networks of every cluster")
+	clusterCmd.AddCommand(statusCmd)
+}
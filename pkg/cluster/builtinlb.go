@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"openshift-qemu/pkg/lb"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// statePollInterval is how often the built-in load balancer looks for node changes in
+// the cluster state.
+const statePollInterval = 5 * time.Second
+
+// writeBuiltinLBUnit writes the unit running openshift-qemu lb serve for a cluster.
+func writeBuiltinLBUnit(clusterName string, hostLB *state.HostLB) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate openshift-qemu for the load balancer unit: %v", err)
+	}
+	unit, err := renderTemplate("lb.service.tmpl", hostLBServiceData{
+		ClusterName: clusterName,
+		Unit:        hostLB.Unit,
+		Executable:  executable,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(hostLBUnitPath(hostLB), []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("failed to write unit %s: %v", hostLB.Unit, err)
+	}
+	return nil
+}
+
+// builtinLBFrontends returns what the built-in load balancer serves for the recorded
+// nodes: the frontends and backends of haproxy.cfg, with the servers addressed by IP.
+// Nodes are only served once they are recorded with an address, so the load balancer can
+// start before the infra nodes it routes ingress to exist.
+func builtinLBFrontends(st *state.ClusterState) ([]lb.Frontend, error) {
+	ips := map[string]string{}
+	workers := map[string]bool{}
+	for _, node := range st.Nodes {
+		ips[node.Host] = node.IP
+		workers[node.Host] = node.Role == RoleWorker
+	}
+	recorded := *st
+	recorded.InfraNodes = nil
+	for _, host := range st.InfraNodes {
+		if workers[host] {
+			recorded.InfraNodes = append(recorded.InfraNodes, host)
+		}
+	}
+	data, err := stateHAProxyConfig(&recorded, "")
+	if err != nil {
+		return nil, err
+	}
+	ingress := data.IngressNodes()
+	if len(st.InfraNodes) > 0 && len(recorded.InfraNodes) == 0 {
+		// Ingress belongs to the infra nodes; do not send it to other nodes meanwhile
+		ingress = nil
+	}
+
+	servers := func(hosts []HAProxyServer, port int) []lb.Server {
+		var list []lb.Server
+		for _, host := range hosts {
+			if ips[host.Name] == "" {
+				continue
+			}
+			list = append(list, lb.Server{Name: host.Name, Address: net.JoinHostPort(ips[host.Name], strconv.Itoa(port)), Disabled: host.Disabled})
+		}
+		return list
+	}
+	listen := func(port int) []string {
+		addrs := []string{net.JoinHostPort(st.HostLB.IP, strconv.Itoa(port))}
+		if st.HostLB.IPv6 != "" {
+			addrs = append(addrs, net.JoinHostPort(st.HostLB.IPv6, strconv.Itoa(port)))
+		}
+		return addrs
+	}
+
+	api := data.MasterNodes
+	if data.Bootstrap != nil {
+		api = append([]HAProxyServer{*data.Bootstrap}, api...)
+	}
+	return []lb.Frontend{
+		{Name: "master-api", Listen: listen(6443), Servers: servers(api, 6443)},
+		{Name: "master-mapi", Listen: listen(22623), Servers: servers(api, 22623)},
+		{Name: "ingress-http", Listen: listen(80), Servers: servers(ingress, 80)},
+		{Name: "ingress-https", Listen: listen(443), Servers: servers(ingress, 443)},
+	}, nil
+}
+
+// ServeLB runs the built-in load balancer of a cluster until the context ends. It follows
+// the cluster state, so nodes are added and removed as they are recorded. SIGHUP applies
+// the state again, which also ends maintenance set only through the runtime API.
+func ServeLB(ctx context.Context, clusterName string) error {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return err
+	}
+	if st.HostLB == nil || st.HostLB.Mode != LBModeBuiltin {
+		return fmt.Errorf("cluster %s does not use the built-in load balancer (--lb-mode=%s)", clusterName, LBModeBuiltin)
+	}
+	frontends, err := builtinLBFrontends(st)
+	if err != nil {
+		return err
+	}
+
+	balancer := lb.New(lb.DefaultOptions)
+	if err = balancer.Apply(frontends); err != nil {
+		return err
+	}
+	defer balancer.Close()
+	go balancer.Run(ctx)
+	runtimeErr := make(chan error, 1)
+	go func() {
+		runtimeErr <- balancer.ServeRuntime(ctx, hostLBSocket(st.HostLB))
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(statePollInterval)
+	defer ticker.Stop()
+	logging.Ok(fmt.Sprintf("Load balancer of %s listening on %s", clusterName, st.HostLB.IP))
+
+	for {
+		reload := false
+		select {
+		case <-ctx.Done():
+			return nil
+		case err = <-runtimeErr:
+			return err
+		case <-hup:
+			reload = true
+		case <-ticker.C:
+		}
+
+		st, err = state.Load(clusterName)
+		if err != nil {
+			logging.Warn(fmt.Sprintf("Keeping the current nodes: %v", err))
+			continue
+		}
+		if st.HostLB == nil {
+			logging.Warn(fmt.Sprintf("Cluster %s no longer has a load balancer on this host; keeping the current nodes", clusterName))
+			continue
+		}
+		next, err := builtinLBFrontends(st)
+		if err != nil {
+			logging.Warn(fmt.Sprintf("Keeping the current nodes: %v", err))
+			continue
+		}
+		if !reload && reflect.DeepEqual(next, frontends) {
+			continue
+		}
+		if err = balancer.Apply(next); err != nil {
+			logging.Warn(fmt.Sprintf("Failed to apply node changes: %v", err))
+			continue
+		}
+		frontends = next
+		logging.Info(fmt.Sprintf("Load balancer updated: %d API and %d ingress servers", len(next[0].Servers), len(next[2].Servers)))
+	}
+}
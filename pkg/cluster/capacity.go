@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// lbDiskGB is the virtual size of the CentOS cloud image the load balancer boots from.
+const lbDiskGB = 10
+
+// CapacityParams describes the cluster to fit on the host.
+type CapacityParams struct {
+	VMDir           string
+	URI             string // libvirt connection URI
+	NMaster         int
+	NWorker         int
+	BtsMem          int
+	BtsCPU          int
+	MasMem          int
+	MasCPU          int
+	WorMem          int
+	WorCPU          int
+	LBMem           int
+	LBCPU           int
+	LBMode          string // LBModeVM or LBModeHost; only the LB VM takes resources
+	RootDiskGB      uint
+	Disks           []DiskSpec
+	AllowOvercommit bool // report a shortfall as a warning instead of failing
+}
+
+// roleDemand is what the nodes of one role ask for.
+type roleDemand struct {
+	Role      string
+	Count     int
+	CPUs      int
+	MemoryMiB int
+	DiskGB    map[string]uint // storage pool -> GB
+}
+
+// demands returns the vCPUs, memory and disk asked for per role. Disks are counted at
+// their full size although qcow2 images grow on demand: a cluster that fills them must
+// not run the pool out of space.
+func (p CapacityParams) demands(rootPool string) []roleDemand {
+	lbCount := 0
+	if p.LBMode == LBModeVM {
+		lbCount = 1
+	}
+	roles := []roleDemand{
+		{Role: RoleLB, Count: lbCount, CPUs: p.LBCPU, MemoryMiB: p.LBMem},
+		{Role: RoleBootstrap, Count: 1, CPUs: p.BtsCPU, MemoryMiB: p.BtsMem},
+		{Role: RoleMaster, Count: p.NMaster, CPUs: p.MasCPU, MemoryMiB: p.MasMem},
+		{Role: RoleWorker, Count: p.NWorker, CPUs: p.WorCPU, MemoryMiB: p.WorMem},
+	}
+	for i := range roles {
+		d := &roles[i]
+		d.DiskGB = map[string]uint{rootPool: p.RootDiskGB * uint(d.Count)}
+		if d.Role == RoleLB {
+			d.DiskGB[rootPool] = lbDiskGB
+		}
+		for _, spec := range p.Disks {
+			if spec.Role != d.Role {
+				continue
+			}
+			perNode := spec.SizeGB * uint(spec.Count)
+			if spec.Shared {
+				d.DiskGB[spec.Pool] += perNode
+			} else {
+				d.DiskGB[spec.Pool] += perNode * uint(d.Count)
+			}
+		}
+	}
+	return roles
+}
+
+// shortfall is a resource the cluster needs more of than the host has left.
+type shortfall struct {
+	Resource  string
+	Requested string
+	Available string
+	Ratio     float64 // committed plus requested over what the host has; 0 when it has nothing
+}
+
+// CheckCapacity compares the vCPUs, memory and disk of the cluster with what the host
+// has left after its running domains, and fails on a shortfall unless overcommit is
+// allowed.
+func CheckCapacity(params CapacityParams) error {
+	logging.Info("Checking if the host can fit the cluster:")
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	host, err := libvirt.GetHostCapacity(conn)
+	if err != nil {
+		return err
+	}
+	rootPool, err := libvirt.PoolForDir(conn, params.VMDir)
+	if err != nil {
+		return err
+	}
+
+	roles := params.demands(rootPool)
+	cpus, memoryMiB, diskGB := 0, 0, map[string]uint{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tCOUNT\tVCPUS\tMEMORY\tDISK")
+	for _, d := range roles {
+		if d.Count == 0 {
+			continue
+		}
+		roleDisk := uint(0)
+		for pool, gb := range d.DiskGB {
+			diskGB[pool] += gb
+			roleDisk += gb
+		}
+		cpus += d.Count * d.CPUs
+		memoryMiB += d.Count * d.MemoryMiB
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d MiB\t%d GB\n", d.Role, d.Count, d.Count*d.CPUs, d.Count*d.MemoryMiB, roleDisk)
+	}
+	fmt.Fprintf(w, "total\t\t%d\t%d MiB\t%d GB\n", cpus, memoryMiB, sumGB(diskGB))
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	logging.Info(fmt.Sprintf("Host has %d CPUs and %d MiB of memory (%d MiB free or reclaimable); %d running domains use %d vCPUs and %d MiB",
+		host.CPUs, host.MemoryKiB/1024, host.FreeMemoryKiB/1024, host.RunningDomains, host.CommittedVCPUs, host.CommittedKiB/1024))
+
+	var short []shortfall
+	if committed := host.CommittedVCPUs + uint(cpus); committed > host.CPUs {
+		short = append(short, shortfall{
+			Resource:  "vCPUs",
+			Requested: fmt.Sprint(cpus),
+			Available: fmt.Sprint(subtractFloor(uint64(host.CPUs), uint64(host.CommittedVCPUs))),
+			Ratio:     float64(committed) / float64(host.CPUs),
+		})
+	}
+	// Guests that have not touched their memory yet will, so count their maximum
+	available := subtractFloor(host.MemoryKiB, host.CommittedKiB)
+	if host.FreeMemoryKiB < available {
+		available = host.FreeMemoryKiB
+	}
+	if requested := uint64(memoryMiB) * 1024; requested > available {
+		short = append(short, shortfall{
+			Resource:  "memory",
+			Requested: fmt.Sprintf("%d MiB", memoryMiB),
+			Available: fmt.Sprintf("%d MiB", available/1024),
+			Ratio:     float64(host.CommittedKiB+requested) / float64(host.MemoryKiB),
+		})
+	}
+	for pool, gb := range diskGB {
+		resource := "disk in pool " + pool
+		var free uint64
+		if pool == "" {
+			// No pool targets the VM directory, so root disks are plain files in it
+			resource = "disk in " + params.VMDir
+			if libvirt.IsRemote(params.URI) {
+				logging.Warn(fmt.Sprintf("No storage pool has %s as its target; not checking its free space over a remote connection", params.VMDir))
+				continue
+			}
+			free, err = libvirt.DirFreeBytes(params.VMDir)
+		} else {
+			free, err = libvirt.PoolFreeBytes(conn, pool)
+		}
+		if err != nil {
+			return err
+		}
+		if requested := uint64(gb) << 30; requested > free {
+			s := shortfall{Resource: resource, Requested: fmt.Sprintf("%d GB", gb), Available: fmt.Sprintf("%d GB", free>>30)}
+			if free > 0 {
+				s.Ratio = float64(requested) / float64(free)
+			}
+			short = append(short, s)
+		}
+	}
+
+	if len(short) == 0 {
+		logging.Ok("The host can fit the cluster")
+		return nil
+	}
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tREQUESTED\tAVAILABLE\tOVERCOMMIT")
+	for _, s := range short {
+		ratio := "-"
+		if s.Ratio > 0 {
+			ratio = fmt.Sprintf("%.2fx", s.Ratio)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Resource, s.Requested, s.Available, ratio)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if params.AllowOvercommit {
+		logging.Warn("The host is overcommitted; continuing because overcommit is allowed")
+		return nil
+	}
+	return fmt.Errorf("the host cannot fit the cluster; shrink it, free resources or pass --allow-overcommit")
+}
+
+// subtractFloor returns a - b, or 0 when b is larger.
+func subtractFloor(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// sumGB adds up the disk sizes of every pool.
+func sumGB(perPool map[string]uint) uint {
+	total := uint(0)
+	for _, gb := range perPool {
+		total += gb
+	}
+	return total
+}
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/state"
+)
+
+// AttachConsole attaches the terminal to the serial console of a cluster node, given by
+// host name (e.g. master-1) or VM name.
+func AttachConsole(clusterName, node, uri string) error {
+	n, err := findNode(clusterName, node)
+	if err != nil {
+		return err
+	}
+	return libvirt.AttachConsole(uri, n.Name)
+}
+
+// RunOnNode runs a shell command on a cluster node over SSH, or through the guest agent
+// when SSH is not available, and returns its output.
+func RunOnNode(ctx context.Context, clusterName, node, command, uri string) (string, error) {
+	n, err := findNode(clusterName, node)
+	if err != nil {
+		return "", err
+	}
+	conn, err := libvirt.NewLibvirtConnection(uri)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	user := "core"
+	if n.Role == RoleLB {
+		user = "root"
+	}
+	return libvirt.RunInGuest(ctx, conn, libvirt.GuestAccess{VMName: n.Name, IP: n.IP, SSHKeyPath: "sshkey", SSHUser: user}, command)
+}
+
+// findNode returns the recorded node given by host name or VM name.
+func findNode(clusterName, node string) (*state.Node, error) {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range st.Nodes {
+		if n.Name == node || n.Host == node {
+			return &st.Nodes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cluster %s has no node %s", clusterName, node)
+}
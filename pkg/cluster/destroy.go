@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/nftables"
+	"openshift-qemu/pkg/state"
+)
+
+// DestroyParams holds what is needed to remove a cluster.
+type DestroyParams struct {
+	ClusterName string
+	SetupDir    string // removed too when set
+	URI         string // libvirt connection URI
+}
+
+// DestroyCluster removes everything tagged with the cluster's ownership metadata: its VMs
+// with their root and extra disks, and networks created for it. VMs recorded in the cluster
+// state without metadata are removed too. DHCP reservations and libvirt DNS records of
+// recorded nodes, host port forwarding and a load balancer on the host are dropped, then the
+// cluster is forgotten.
+func DestroyCluster(params DestroyParams) error {
+	logging.Info(fmt.Sprintf("Destroying cluster %s", params.ClusterName))
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	domains, err := libvirt.ListClusterDomains(conn, params.ClusterName)
+	if err != nil {
+		return err
+	}
+	networks, err := libvirt.ListClusterNetworks(conn, params.ClusterName, createdNetworks([]*state.ClusterState{st}))
+	if err != nil {
+		return err
+	}
+
+	var names, volumes []string
+	for _, dom := range domains {
+		names = append(names, dom.Name)
+		volumes = append(volumes, dom.Volumes...)
+	}
+	for _, node := range st.Nodes {
+		if !containsString(names, node.Name) {
+			names = append(names, node.Name)
+		}
+		volumes = append(volumes, node.Disks...)
+	}
+	if len(names) == 0 && len(networks) == 0 {
+		logging.Warn(fmt.Sprintf("No VMs or networks belong to cluster %s", params.ClusterName))
+	}
+
+	for _, name := range names {
+		if err = libvirt.RemoveVM(conn, name); err != nil {
+			return err
+		}
+		if node := st.Node(name); node != nil && st.Network != "" {
+			if err = forgetNodeAddresses(conn, st.Network, *node); err != nil {
+				logging.Warn(fmt.Sprintf("Failed to remove addresses of %s: %v", name, err))
+			}
+		}
+	}
+
+	if lb := clusterLB(st); st.HostLB != nil && st.Network != "" {
+		if err = forgetNodeAddresses(conn, st.Network, *lb); err != nil {
+			logging.Warn(fmt.Sprintf("Failed to remove addresses of %s: %v", lb.Name, err))
+		}
+	}
+
+	// Shared disks are listed on every VM that uses them
+	deleted := map[string]bool{}
+	for _, ref := range volumes {
+		if deleted[ref] {
+			continue
+		}
+		pool, volume := parseDiskRef(ref)
+		if err = libvirt.DeleteVolume(conn, pool, volume); err != nil {
+			return err
+		}
+		deleted[ref] = true
+	}
+
+	for _, network := range networks {
+		logging.Info(fmt.Sprintf("Removing network %s", network.Name))
+		if err = libvirt.RemoveNetwork(conn, network.Name); err != nil {
+			return err
+		}
+	}
+
+	if libvirt.IsRemote(params.URI) {
+		if st.Forward != nil {
+			logging.Warn(fmt.Sprintf("Forwarding rules of %s are left on the libvirt host; remove them there", params.ClusterName))
+		}
+		if st.HostLB != nil {
+			logging.Warn(fmt.Sprintf("Load balancer unit %s is left on the libvirt host; remove it there", st.HostLB.Unit))
+		}
+	} else {
+		if err = nftables.Remove(params.ClusterName); err != nil {
+			return err
+		}
+		if st.HostLB != nil {
+			if err = removeHostLB(params.ClusterName, st.HostLB); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = os.Remove(state.Path(params.ClusterName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove state of cluster %s: %v", params.ClusterName, err)
+	}
+	if params.SetupDir != "" && filepath.Clean(params.SetupDir) != "/" {
+		logging.Info(fmt.Sprintf("Removing setup directory %s", params.SetupDir))
+		if err = os.RemoveAll(params.SetupDir); err != nil {
+			return fmt.Errorf("failed to remove setup directory %s: %v", params.SetupDir, err)
+		}
+	}
+	logging.Ok(fmt.Sprintf("Cluster %s destroyed", params.ClusterName))
+	return nil
+}
+
+// forgetNodeAddresses removes the DHCP reservations and libvirt DNS records of a node.
+func forgetNodeAddresses(conn libvirt.VirtConnection, virNet string, node state.Node) error {
+	for _, ip := range []string{node.IP, node.IPv6} {
+		if ip == "" {
+			continue
+		}
+		if _, err := libvirt.RemoveDHCPReservations(conn, virNet, ip); err != nil {
+			return err
+		}
+		if _, err := libvirt.RemoveNetworkDNSHost(conn, virNet, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsString reports whether a list contains a string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
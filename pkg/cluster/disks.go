@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"openshift-qemu/pkg/libvirt"
+)
+
+// defaultDiskPool is the storage pool extra disks are created in unless a spec names one.
+const defaultDiskPool = "default"
+
+// DiskSpec declares extra disks for every node of a role.
+type DiskSpec struct {
+	Role   string
+	Count  int
+	SizeGB uint
+	Bus    string // libvirt.DiskBus*
+	Serial string // serial prefix; defaults to the host name, or the role for shared disks
+	Shared bool   // one set of disks attached to every node of the role
+	Pool   string
+}
+
+// ParseDiskSpec parses a disk declaration such as
+// role=worker,size=100,count=2,bus=virtio,serial=odf,shared=false,pool=default.
+func ParseDiskSpec(spec string) (DiskSpec, error) {
+	d := DiskSpec{Count: 1, Bus: libvirt.DiskBusVirtio, Pool: defaultDiskPool}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return d, fmt.Errorf("invalid disk field %q in %q (expected key=value)", field, spec)
+		}
+		var err error
+		switch key {
+		case "role":
+			d.Role = value
+		case "size":
+			var size uint64
+			size, err = strconv.ParseUint(strings.TrimSuffix(strings.ToUpper(value), "G"), 10, 32)
+			d.SizeGB = uint(size)
+		case "count":
+			d.Count, err = strconv.Atoi(value)
+		case "bus":
+			d.Bus = value
+		case "serial":
+			d.Serial = value
+		case "shared":
+			d.Shared, err = strconv.ParseBool(value)
+		case "pool":
+			d.Pool = value
+		default:
+			return d, fmt.Errorf("unknown disk field %q in %q", key, spec)
+		}
+		if err != nil {
+			return d, fmt.Errorf("invalid %s in disk %q: %v", key, spec, err)
+		}
+	}
+
+	switch d.Role {
+	case RoleLB, RoleBootstrap, RoleMaster, RoleWorker:
+	default:
+		return d, fmt.Errorf("unknown role %q in disk %q", d.Role, spec)
+	}
+	if d.Count < 1 {
+		return d, fmt.Errorf("disk %q needs a count of at least 1", spec)
+	}
+	return d, nil
+}
+
+// applyDisks sets the extra disks of each node from the specs of its role. Disks are
+// numbered per node across specs, so serials stay stable as long as the specs do.
+func applyDisks(clusterName string, nodes []Node, specs []DiskSpec) ([]Node, error) {
+	for i, node := range nodes {
+		n := 0
+		for _, spec := range specs {
+			if spec.Role != node.Role {
+				continue
+			}
+			for j := 0; j < spec.Count; j++ {
+				n++
+				disk := libvirt.ExtraDisk{Pool: spec.Pool, SizeGB: spec.SizeGB, Bus: spec.Bus, Shared: spec.Shared}
+				prefix := spec.Serial
+				if spec.Shared {
+					if prefix == "" {
+						prefix = node.Role + "-shared"
+					}
+					disk.Volume = fmt.Sprintf("%s-%s-shared%d.raw", clusterName, node.Role, n)
+				} else {
+					if prefix == "" {
+						prefix = node.Host + "-data"
+					}
+					disk.Volume = fmt.Sprintf("%s-data%d.qcow2", node.Name, n)
+				}
+				disk.Serial = fmt.Sprintf("%s%d", prefix, n)
+				if err := libvirt.ValidateExtraDisk(disk); err != nil {
+					return nil, err
+				}
+				nodes[i].Disks = append(nodes[i].Disks, disk)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// createNodeDisks creates the volumes of the extra disks of a node.
+func createNodeDisks(conn libvirt.VirtConnection, node Node) error {
+	for _, disk := range node.Disks {
+		if err := libvirt.CreateVolume(conn, disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diskRef and parseDiskRef convert between an extra disk and its pool/volume record.
+func diskRef(disk libvirt.ExtraDisk) string {
+	return disk.Pool + "/" + disk.Volume
+}
+
+func parseDiskRef(ref string) (string, string) {
+	pool, volume, _ := strings.Cut(ref, "/")
+	return pool, volume
+}
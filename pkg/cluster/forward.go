@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/nftables"
+	"openshift-qemu/pkg/state"
+)
+
+// DefaultForwardPorts are the API, HTTPS ingress and HTTP ingress ports of the load balancer.
+var DefaultForwardPorts = []int{6443, 443, 80}
+
+// Formats of the name resolution snippet for users of a forwarded cluster.
+const (
+	SnippetHosts   = "hosts"
+	SnippetDNSMasq = "dnsmasq"
+)
+
+// forwardedRoutes are the ingress host names users reach through /etc/hosts; dnsmasq
+// covers every route with a wildcard instead.
+var forwardedRoutes = []string{"console-openshift-console", "oauth-openshift", "downloads-openshift-console", "canary-openshift-ingress-canary"}
+
+// ForwardParams holds the configuration for host-side access to the cluster.
+type ForwardParams struct {
+	ClusterName string
+	HostIP      string // address of the host users connect to
+	Ports       []int
+	URI         string // libvirt connection URI
+}
+
+// EnableForwarding exposes the load balancer ports on an address of the host with nftables
+// DNAT rules kept in a table of the cluster's own, replacing earlier rules of the cluster.
+func EnableForwarding(params ForwardParams) error {
+	if err := libvirt.RequireLocal(params.URI, "Forwarding host ports"); err != nil {
+		return err
+	}
+	if err := checkHostIP(params.HostIP); err != nil {
+		return err
+	}
+	if len(params.Ports) == 0 {
+		params.Ports = DefaultForwardPorts
+	}
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	lb := clusterLB(st)
+	if lb == nil {
+		return fmt.Errorf("no load balancer recorded for cluster %s in %s", params.ClusterName, state.Path(params.ClusterName))
+	}
+
+	forward := nftables.Forward{Cluster: params.ClusterName, HostIP: params.HostIP, GuestIP: lb.IP, Ports: params.Ports}
+	if err = nftables.Apply(forward); err != nil {
+		return err
+	}
+	st.Forward = &state.Forward{HostIP: params.HostIP, LBIP: lb.IP, Ports: params.Ports}
+	if err = st.Save(); err != nil {
+		return err
+	}
+	logging.Ok(fmt.Sprintf("Forwarding %s ports %v to %s", params.HostIP, params.Ports, lb.IP))
+	logging.Warn("libvirt drops the forwarding exceptions when it reloads its firewall rules; enable forwarding again after restarting libvirt or the network")
+	return nil
+}
+
+// DisableForwarding removes the forwarding rules of the cluster.
+func DisableForwarding(clusterName, uri string) error {
+	if err := libvirt.RequireLocal(uri, "Removing forwarded host ports"); err != nil {
+		return err
+	}
+	if err := nftables.Remove(clusterName); err != nil {
+		return err
+	}
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return err
+	}
+	if st.Forward == nil {
+		return nil
+	}
+	st.Forward = nil
+	return st.Save()
+}
+
+// ForwardSnippet returns the /etc/hosts lines or dnsmasq options that resolve the cluster
+// names to the forwarded host address, for users to add on their machines.
+func ForwardSnippet(clusterName, baseDomain, format string) (string, error) {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return "", err
+	}
+	if st.Forward == nil {
+		return "", fmt.Errorf("cluster %s is not forwarded; enable forwarding first", clusterName)
+	}
+	domain := clusterName + "." + baseDomain
+	ip := st.Forward.HostIP
+
+	var b strings.Builder
+	switch format {
+	case SnippetHosts:
+		names := []string{"api." + domain}
+		for _, route := range forwardedRoutes {
+			names = append(names, route+".apps."+domain)
+		}
+		fmt.Fprintf(&b, "%s %s\n", ip, strings.Join(names, " "))
+	case SnippetDNSMasq:
+		fmt.Fprintf(&b, "address=/api.%s/%s\n", domain, ip)
+		fmt.Fprintf(&b, "address=/apps.%s/%s\n", domain, ip)
+	default:
+		return "", fmt.Errorf("unknown snippet format %q (expected %s or %s)", format, SnippetHosts, SnippetDNSMasq)
+	}
+	return b.String(), nil
+}
+
+// clusterLB returns the recorded load balancer of the cluster, or nil. A load balancer on
+// the host is returned as a node with the gateway addresses it listens on.
+func clusterLB(st *state.ClusterState) *state.Node {
+	if st.HostLB != nil {
+		return &state.Node{Name: st.Name + "-" + RoleLB, Host: RoleLB, Role: RoleLB, IP: st.HostLB.IP, IPv6: st.HostLB.IPv6}
+	}
+	for i := range st.Nodes {
+		if st.Nodes[i].Role == RoleLB {
+			return &st.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// checkHostIP checks that the address is an IPv4 address of this host.
+func checkHostIP(hostIP string) error {
+	ip := net.ParseIP(hostIP)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid host IPv4 address %q", hostIP)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list host addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an address of this host", hostIP)
+}
@@ -0,0 +1,430 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+	"openshift-qemu/pkg/systemd"
+)
+
+// Kinds of orphaned resources, in the order they are removed: nothing is removed while
+// something collected later still depends on it.
+const (
+	OrphanDomain      = "domain"
+	OrphanDisk        = "disk"
+	OrphanReservation = "dhcp-host"
+	OrphanNetwork     = "network"
+	OrphanDNSSnippet  = "dnsmasq-snippet"
+	OrphanHostsFile   = "hosts-file"
+
+	// A state file whose VMs are all gone. It is only reported: destroy removes it
+	// together with what else the cluster left on the host.
+	OrphanState = "state"
+)
+
+// Names of the files the tool creates for a node, e.g. ocp4-master-1.qcow2,
+// ocp4-worker-1-data1.qcow2, ocp4-worker-shared1.raw and ocp4-lb_VARS.fd.
+var (
+	nodeFilePattern   = regexp.MustCompile(`^(.+)-(lb|bootstrap|master-\d+|worker-\d+)(-data\d+\.qcow2|\.qcow2|_VARS\.fd)$`)
+	sharedFilePattern = regexp.MustCompile(`^(.+)-(lb|bootstrap|master|worker)-shared\d+\.raw$`)
+	hostNamePattern   = regexp.MustCompile(`^(lb|bootstrap|master-\d+|worker-\d+)$`)
+)
+
+// dnsTestCluster is the name the DNS self-test uses for its temporary files.
+const dnsTestCluster = "dnstest"
+
+// Orphan is a resource created by the tool for a cluster that has no state file, or the
+// state file of a cluster that has no VMs left.
+type Orphan struct {
+	Kind    string
+	Name    string
+	Cluster string // empty when the owner cannot be told
+	Detail  string
+	Removed bool
+
+	remove func() error
+}
+
+// GCParams holds where the tool leaves resources on the host.
+type GCParams struct {
+	VMDir  string
+	DNSDir string
+	DNSSvc string
+	URI    string
+	Remove bool // delete the orphans instead of only listing them
+}
+
+// gcInventory is what is known and in use on the host.
+type gcInventory struct {
+	known    map[string]bool // clusters with a state file
+	states   []*state.ClusterState
+	domains  []libvirt.DomainResources
+	inUse    map[string]bool // disk files and pool/volume refs used by a domain
+	macs     map[string]bool
+	networks map[string]bool // networks a domain is attached to
+}
+
+// CollectGarbage finds the resources left behind by clusters without a state file and,
+// if asked to, removes them in dependency order. Running domains are never removed. State
+// files whose VMs are all gone are reported for destroy to clean up.
+func CollectGarbage(params GCParams) ([]Orphan, error) {
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	inv, err := takeInventory(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	orphans = append(orphans, orphanDomains(conn, inv)...)
+	if libvirt.IsRemote(params.URI) {
+		logging.Warn("Disk images and DNS files are not checked over a remote connection")
+	} else {
+		orphans = append(orphans, orphanDisks(conn, inv, params.VMDir)...)
+	}
+	reservations, err := orphanReservations(conn, inv)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, reservations...)
+	networks, err := orphanNetworks(conn, inv)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, networks...)
+	if !libvirt.IsRemote(params.URI) {
+		orphans = append(orphans, orphanDNSFiles(inv, params.DNSDir)...)
+	}
+	orphans = append(orphans, orphanStates(inv)...)
+
+	if !params.Remove {
+		return orphans, nil
+	}
+	reload := false
+	for i := range orphans {
+		if orphans[i].remove == nil {
+			continue
+		}
+		if err = orphans[i].remove(); err != nil {
+			return orphans, fmt.Errorf("failed to remove %s %s: %v", orphans[i].Kind, orphans[i].Name, err)
+		}
+		orphans[i].Removed = true
+		reload = reload || orphans[i].Kind == OrphanDNSSnippet
+	}
+	if reload && params.DNSSvc != "" {
+		dnsService := &systemd.Systemd{Name: params.DNSSvc}
+		if err = dnsService.Reload(); err != nil {
+			return orphans, fmt.Errorf("failed to reload DNS service %s: %v", params.DNSSvc, err)
+		}
+	}
+	return orphans, nil
+}
+
+// takeInventory loads the known clusters and what every domain uses.
+func takeInventory(conn libvirt.VirtConnection) (*gcInventory, error) {
+	inv := &gcInventory{known: map[string]bool{}, inUse: map[string]bool{}, macs: map[string]bool{}, networks: map[string]bool{}}
+
+	names, err := state.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		st, err := state.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		inv.known[name] = true
+		inv.states = append(inv.states, st)
+	}
+
+	if inv.domains, err = libvirt.ListDomainResources(conn); err != nil {
+		return nil, err
+	}
+	for _, dom := range inv.domains {
+		// Domains about to be collected no longer count as users
+		if isOrphanDomain(inv, dom) && dom.IsShutoff() {
+			continue
+		}
+		for _, f := range dom.Files {
+			inv.inUse[f] = true
+		}
+		for _, v := range dom.Volumes {
+			inv.inUse[v] = true
+		}
+		for _, mac := range dom.MACs {
+			inv.macs[strings.ToLower(mac)] = true
+		}
+		for _, network := range dom.Networks {
+			inv.networks[network] = true
+		}
+	}
+	return inv, nil
+}
+
+// isOrphanDomain reports whether a domain is owned by a cluster without a state file.
+func isOrphanDomain(inv *gcInventory, dom libvirt.DomainResources) bool {
+	return dom.Owner != nil && !inv.known[dom.Owner.Cluster]
+}
+
+// orphanDomains returns the tool's domains of unknown clusters. Their root disks, NVRAM
+// and extra disk volumes go with them.
+func orphanDomains(conn libvirt.VirtConnection, inv *gcInventory) []Orphan {
+	var orphans []Orphan
+	for _, dom := range inv.domains {
+		if !isOrphanDomain(inv, dom) {
+			continue
+		}
+		o := Orphan{Kind: OrphanDomain, Name: dom.Name, Cluster: dom.Owner.Cluster, Detail: libvirt.DomainStateName(dom.State)}
+		if !dom.IsShutoff() {
+			o.Detail += "; stop it to collect it"
+		} else {
+			name, volumes := dom.Name, dom.Owner.Volumes
+			o.remove = func() error {
+				if err := libvirt.RemoveVM(conn, name); err != nil {
+					return err
+				}
+				for _, ref := range volumes {
+					if inv.inUse[ref] {
+						continue
+					}
+					pool, volume := parseDiskRef(ref)
+					if err := libvirt.DeleteVolume(conn, pool, volume); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans
+}
+
+// orphanDisks returns disk images and NVRAM stores in the VM directory named like the
+// tool's that no domain uses and no known cluster owns.
+func orphanDisks(conn libvirt.VirtConnection, inv *gcInventory, vmDir string) []Orphan {
+	entries, err := os.ReadDir(vmDir)
+	if err != nil {
+		logging.Warn(fmt.Sprintf("Cannot read VM directory %s: %v", vmDir, err))
+		return nil
+	}
+
+	var orphans []Orphan
+	for _, entry := range entries {
+		m := nodeFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			m = sharedFilePattern.FindStringSubmatch(entry.Name())
+		}
+		path := filepath.Join(vmDir, entry.Name())
+		if m == nil || entry.IsDir() || inv.known[m[1]] || inv.inUse[path] {
+			continue
+		}
+		// Images attached as pool volumes are in use under their volume name
+		if volumeInUse(inv, entry.Name()) || ownedByOrphanDomain(inv, path) {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Kind: OrphanDisk, Name: path, Cluster: m[1], Detail: "not used by any VM",
+			remove: func() error { return libvirt.RemoveDiskImage(conn, path) },
+		})
+	}
+	return orphans
+}
+
+// volumeInUse reports whether a domain uses a volume of the given name in any pool.
+func volumeInUse(inv *gcInventory, volume string) bool {
+	for ref := range inv.inUse {
+		if _, v := parseDiskRef(ref); v == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedByOrphanDomain reports whether a file goes away with an orphaned domain.
+func ownedByOrphanDomain(inv *gcInventory, path string) bool {
+	for _, dom := range inv.domains {
+		if isOrphanDomain(inv, dom) && containsString(dom.Files, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// orphanReservations returns DHCP host entries named like cluster nodes whose MAC no
+// domain has and whose address no known cluster recorded.
+func orphanReservations(conn libvirt.VirtConnection, inv *gcInventory) ([]Orphan, error) {
+	recorded := map[string]bool{}
+	for _, st := range inv.states {
+		for _, node := range st.Nodes {
+			recorded[strings.ToLower(node.MAC)] = true
+			recorded[node.IP] = true
+			recorded[node.IPv6] = true
+		}
+	}
+
+	networks, err := libvirt.ListNetworkNames(conn)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, network := range networks {
+		reservations, err := libvirt.ListDHCPReservations(conn, network)
+		if err != nil {
+			logging.Warn(fmt.Sprintf("Cannot list DHCP reservations of %s: %v", network, err))
+			continue
+		}
+		for _, res := range reservations {
+			mac := strings.ToLower(res.MAC)
+			if !hostNamePattern.MatchString(res.Name) || inv.macs[mac] || recorded[res.IP] || (mac != "" && recorded[mac]) {
+				continue
+			}
+			network, ip := network, res.IP
+			orphans = append(orphans, Orphan{
+				Kind: OrphanReservation, Name: res.String(), Detail: "network " + network,
+				remove: func() error {
+					_, err := libvirt.RemoveDHCPReservations(conn, network, ip)
+					return err
+				},
+			})
+		}
+	}
+	return orphans, nil
+}
+
+// orphanNetworks returns networks created by the tool, tagged or named ocp-*, that no
+// domain is attached to and no known cluster uses.
+func orphanNetworks(conn libvirt.VirtConnection, inv *gcInventory) ([]Orphan, error) {
+	used := map[string]bool{}
+	for _, st := range inv.states {
+		used[st.Network] = true
+	}
+
+	networks, err := libvirt.ListNetworkNames(conn)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, network := range networks {
+		if used[network] || inv.networks[network] {
+			continue
+		}
+		owner, err := libvirt.NetworkOwner(conn, network)
+		if err != nil {
+			return nil, err
+		}
+		cluster := ""
+		switch {
+		case owner != nil && inv.known[owner.Cluster]:
+			continue
+		case owner != nil:
+			cluster = owner.Cluster
+		case !strings.HasPrefix(network, "ocp-"):
+			continue
+		}
+		name := network
+		orphans = append(orphans, Orphan{
+			Kind: OrphanNetwork, Name: name, Cluster: cluster, Detail: "no VM attached",
+			remove: func() error { return libvirt.RemoveNetwork(conn, name) },
+		})
+	}
+	return orphans, nil
+}
+
+// orphanDNSFiles returns the dnsmasq snippets and /etc/hosts.<cluster> files of unknown
+// clusters. Only snippets with the tool's content are considered, and only hosts files
+// such a snippet points at, plus the leftovers of the DNS self-test.
+func orphanDNSFiles(inv *gcInventory, dnsDir string) []Orphan {
+	var hostsFiles, snippets []Orphan
+	entries, err := os.ReadDir(dnsDir)
+	if err != nil {
+		logging.Warn(fmt.Sprintf("Cannot read DNS directory %s: %v", dnsDir, err))
+	}
+	for _, entry := range entries {
+		cluster, ok := strings.CutSuffix(entry.Name(), ".conf")
+		if !ok || entry.IsDir() || inv.known[cluster] {
+			continue
+		}
+		path := filepath.Join(dnsDir, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		hostsFile := "/etc/hosts." + cluster
+		text := strings.TrimSpace(string(content))
+		if text != "addn-hosts="+hostsFile && !strings.HasPrefix(text, "server=/"+cluster+".") {
+			continue
+		}
+		snippets = append(snippets, Orphan{Kind: OrphanDNSSnippet, Name: path, Cluster: cluster, remove: removeFile(path)})
+		if strings.HasPrefix(text, "addn-hosts=") {
+			if _, err = os.Stat(hostsFile); err == nil {
+				hostsFiles = append(hostsFiles, Orphan{Kind: OrphanHostsFile, Name: hostsFile, Cluster: cluster, remove: removeFile(hostsFile)})
+			}
+		}
+	}
+	testHosts := "/etc/hosts." + dnsTestCluster
+	if _, err = os.Stat(testHosts); err == nil && !containsOrphan(hostsFiles, testHosts) {
+		hostsFiles = append(hostsFiles, Orphan{Kind: OrphanHostsFile, Name: testHosts, Cluster: dnsTestCluster, remove: removeFile(testHosts)})
+	}
+	// dnsmasq stops reading a hosts file once its snippet is gone and it is reloaded
+	return append(snippets, hostsFiles...)
+}
+
+// orphanStates returns the state files of clusters that recorded VMs of which none
+// exists anymore, e.g. after the domains were undefined by hand. Everything else the
+// cluster left counts as in use while its state file exists, so destroy is pointed at.
+func orphanStates(inv *gcInventory) []Orphan {
+	existing := map[string]bool{}
+	for _, dom := range inv.domains {
+		existing[dom.Name] = true
+	}
+
+	var orphans []Orphan
+	for _, st := range inv.states {
+		if len(st.Nodes) == 0 {
+			continue
+		}
+		gone := true
+		for _, node := range st.Nodes {
+			gone = gone && !existing[node.Name]
+		}
+		if !gone {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Kind: OrphanState, Name: state.Path(st.Name), Cluster: st.Name,
+			Detail: fmt.Sprintf("none of its %d VMs exist; run cluster destroy -c %s", len(st.Nodes), st.Name),
+		})
+	}
+	return orphans
+}
+
+// removeFile returns a function removing a file that may already be gone.
+func removeFile(path string) func() error {
+	return func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+}
+
+// containsOrphan reports whether an orphan with the given name is in the list.
+func containsOrphan(orphans []Orphan, name string) bool {
+	for _, o := range orphans {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
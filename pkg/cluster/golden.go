@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"openshift-qemu/pkg/dns"
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// goldenManifest is the file describing a golden image set.
+const goldenManifest = "golden.json"
+
+// goldenArtifacts are the files of the setup directory kept with a golden image. The
+// restored cluster needs the same ignition and credentials as the baked one.
+var goldenArtifacts = []string{
+	"bootstrap.ign",
+	"master.ign",
+	"worker.ign",
+	"metadata.json",
+	"auth/kubeconfig",
+	"auth/kubeadmin-password",
+}
+
+// GoldenNode is a baked VM: its base image and saved domain XML.
+type GoldenNode struct {
+	state.Node
+	Image     string `json:"image"`               // base image, relative to the golden directory
+	Domain    string `json:"domain"`              // domain XML, relative to the golden directory
+	DiskPath  string `json:"diskPath"`            // disk path in the saved domain XML
+	NVRAMVars string `json:"nvramVars,omitempty"` // copy of the UEFI variable store
+	TPMState  string `json:"tpmState,omitempty"`  // copy of the swtpm state directory
+}
+
+// GoldenImage describes a cluster baked into read-only base images. Certificates and
+// etcd membership are bound to the cluster name and node addresses, so clusters created
+// from it keep the same identity.
+type GoldenImage struct {
+	Name             string       `json:"name"`
+	CreatedAt        time.Time    `json:"createdAt"`
+	ClusterName      string       `json:"clusterName"`
+	BaseDomain       string       `json:"baseDomain"`
+	OCPVersion       string       `json:"ocpVersion,omitempty"`
+	Network          string       `json:"network"`
+	MachineNetwork   string       `json:"machineNetwork"`
+	MachineNetworkV6 string       `json:"machineNetworkV6,omitempty"`
+	Nodes            []GoldenNode `json:"nodes"`
+}
+
+// GoldenParams holds the configuration for baking and restoring golden images.
+type GoldenParams struct {
+	Name            string
+	GoldenDir       string
+	ClusterName     string
+	BaseDomain      string
+	SetupDir        string
+	VMDir           string
+	VirNet          string
+	DNSMode         string
+	DNSConfig       dns.DNSConfig
+	ShutdownTimeout time.Duration
+	Timeouts        libvirt.WaitTimeouts
+	IPSources       []libvirt.IPSource
+	URI             string // libvirt connection URI
+}
+
+// BakeCluster saves every VM disk of an installed cluster as a read-only base image,
+// together with the domain definitions, addresses and setup artefacts. Running VMs are
+// shut down for the copy and started again afterwards.
+func BakeCluster(ctx context.Context, params GoldenParams) error {
+	if err := libvirt.RequireLocal(params.URI, "Baking golden images"); err != nil {
+		return err
+	}
+	st, err := loadClusterNodes(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	// Domains would keep pointing at the original data volumes
+	for _, node := range st.Nodes {
+		if len(node.Disks) > 0 {
+			return fmt.Errorf("cannot bake %s: extra disks are not supported in golden images", node.Name)
+		}
+	}
+	dir := filepath.Join(params.GoldenDir, params.Name)
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("golden image %s already exists in %s", params.Name, dir)
+	}
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	golden := GoldenImage{
+		Name:        params.Name,
+		CreatedAt:   time.Now().UTC(),
+		ClusterName: params.ClusterName,
+		BaseDomain:  params.BaseDomain,
+		OCPVersion:  st.OCPVersion,
+		Network:     st.Network,
+	}
+	machineNetwork, err := libvirt.GetNetworkCIDR(conn, st.Network)
+	if err != nil {
+		return err
+	}
+	golden.MachineNetwork = machineNetwork.String()
+	machineNetworkV6, err := libvirt.GetNetworkCIDR6(conn, st.Network)
+	if err != nil {
+		return err
+	}
+	if machineNetworkV6 != nil {
+		golden.MachineNetworkV6 = machineNetworkV6.String()
+	}
+
+	var running []string
+	for _, node := range st.Nodes {
+		up, err := libvirt.IsVMRunning(conn, node.Name)
+		if err != nil {
+			return err
+		}
+		if up {
+			running = append(running, node.Name)
+		}
+	}
+	stopped, err := shutdownVMs(ctx, conn, running, params.ShutdownTimeout)
+	defer startVMs(conn, stopped)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, "artifacts"), 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	for _, node := range st.Nodes {
+		domainXML, err := libvirt.GetVMXML(conn, node.Name)
+		if err != nil {
+			return err
+		}
+		diskPath, err := libvirt.DomainDiskPath(domainXML)
+		if err != nil {
+			return fmt.Errorf("VM %s: %v", node.Name, err)
+		}
+
+		goldenNode := GoldenNode{
+			Node:     node,
+			Image:    node.Host + ".qcow2",
+			Domain:   node.Host + ".xml",
+			DiskPath: diskPath,
+		}
+		if err = libvirt.BakeImage(diskPath, filepath.Join(dir, goldenNode.Image)); err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dir, goldenNode.Domain), []byte(domainXML), 0o644); err != nil {
+			return fmt.Errorf("failed to save domain XML of %s: %v", node.Name, err)
+		}
+		if node.NVRAM != "" {
+			goldenNode.NVRAMVars = node.Host + "_VARS.fd"
+			if err = libvirt.CopyFile(node.NVRAM, filepath.Join(dir, goldenNode.NVRAMVars)); err != nil {
+				return fmt.Errorf("failed to save NVRAM of %s: %v", node.Name, err)
+			}
+		}
+		if node.TPM {
+			tpmDir, err := libvirt.TPMStateDir(conn, node.Name)
+			if err != nil {
+				return err
+			}
+			goldenNode.TPMState = node.Host + "-tpm2"
+			if err = libvirt.CopyDir(tpmDir, filepath.Join(dir, goldenNode.TPMState)); err != nil {
+				return fmt.Errorf("failed to save TPM state of %s: %v", node.Name, err)
+			}
+		}
+		golden.Nodes = append(golden.Nodes, goldenNode)
+	}
+
+	for _, artifact := range goldenArtifacts {
+		if err = copyIfExists(filepath.Join(params.SetupDir, artifact), filepath.Join(dir, "artifacts", artifact)); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(golden, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode golden image manifest: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, goldenManifest), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write golden image manifest: %v", err)
+	}
+	logging.Ok(fmt.Sprintf("Cluster %s baked into golden image %s (%s)", params.ClusterName, params.Name, dir))
+	return nil
+}
+
+// CreateFromGolden creates a cluster whose VM disks are qcow2 overlays on a golden image.
+// The addresses, DHCP reservations and DNS records of the baked cluster are restored.
+func CreateFromGolden(ctx context.Context, params GoldenParams) error {
+	if err := libvirt.RequireLocal(params.URI, "Creating clusters from golden images"); err != nil {
+		return err
+	}
+	dir := filepath.Join(params.GoldenDir, params.Name)
+	golden, err := loadGoldenImage(dir)
+	if err != nil {
+		return err
+	}
+	if golden.ClusterName != params.ClusterName || golden.BaseDomain != params.BaseDomain {
+		return fmt.Errorf("golden image %s was baked from %s.%s; certificates require the same cluster name and domain", params.Name, golden.ClusterName, golden.BaseDomain)
+	}
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Node addresses are baked into etcd and the certificates
+	machineNetwork, err := libvirt.GetNetworkCIDR(conn, params.VirNet)
+	if err != nil {
+		return err
+	}
+	if machineNetwork.String() != golden.MachineNetwork {
+		return fmt.Errorf("network %s uses %s but golden image %s needs %s", params.VirNet, machineNetwork, params.Name, golden.MachineNetwork)
+	}
+
+	var recorded []state.Node
+	for _, goldenNode := range golden.Nodes {
+		recorded = append(recorded, goldenNode.Node)
+	}
+	nodes := nodesFromState(recorded)
+	lb, err := nodeByRole(nodes, RoleLB)
+	if err != nil {
+		return err
+	}
+
+	st, err := recordNodes(params.ClusterName, params.VirNet, nodes)
+	if err != nil {
+		return err
+	}
+	st.OCPVersion = golden.OCPVersion
+	if err = st.Save(); err != nil {
+		return err
+	}
+	if err = reserveNodeAddresses(conn, params.VirNet, nodes); err != nil {
+		return fmt.Errorf("failed to add DHCP reservations: %v", err)
+	}
+	if err = configureClusterDNS(conn, params.DNSMode, params.VirNet, params.DNSConfig, lb, nodes); err != nil {
+		return err
+	}
+
+	for _, goldenNode := range golden.Nodes {
+		overlay := filepath.Join(params.VMDir, goldenNode.Name+".qcow2")
+		if err = libvirt.CreateOverlay(filepath.Join(dir, goldenNode.Image), overlay); err != nil {
+			return err
+		}
+		domainXML, err := os.ReadFile(filepath.Join(dir, goldenNode.Domain))
+		if err != nil {
+			return fmt.Errorf("failed to read domain XML of %s: %v", goldenNode.Name, err)
+		}
+		if err = libvirt.DefineVMXML(conn, libvirt.RebaseDomainXML(string(domainXML), goldenNode.DiskPath, overlay, golden.Network, params.VirNet)); err != nil {
+			return fmt.Errorf("failed to define %s: %v", goldenNode.Name, err)
+		}
+		if err = restoreGoldenFirmware(conn, dir, goldenNode); err != nil {
+			return err
+		}
+	}
+
+	for _, artifact := range goldenArtifacts {
+		if err = copyIfExists(filepath.Join(dir, "artifacts", artifact), filepath.Join(params.SetupDir, artifact)); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range nodes {
+		if err = libvirt.StartVM(conn, node.Name); err != nil {
+			return err
+		}
+	}
+	// Baked domains log their console where the original cluster did, so it is not scanned
+	if err = waitForVMIPs(ctx, conn, st, params.VirNet, params.IPSources, "", nodes, params.Timeouts.WithDefaults()); err != nil {
+		return err
+	}
+
+	logging.Warn("Kubelet client certificates may have rotated since baking; approve pending CSRs with 'oc adm certificate approve' if nodes stay NotReady")
+	logging.Ok(fmt.Sprintf("Cluster %s created from golden image %s", params.ClusterName, params.Name))
+	return nil
+}
+
+// restoreGoldenFirmware puts the baked NVRAM and TPM state of a node in place, so disks
+// encrypted against the TPM still unlock. The domain must already be defined.
+func restoreGoldenFirmware(conn libvirt.VirtConnection, dir string, goldenNode GoldenNode) error {
+	if goldenNode.NVRAMVars != "" {
+		if err := libvirt.CopyFile(filepath.Join(dir, goldenNode.NVRAMVars), goldenNode.NVRAM); err != nil {
+			return fmt.Errorf("failed to restore NVRAM of %s: %v", goldenNode.Name, err)
+		}
+	}
+	if goldenNode.TPMState != "" {
+		tpmDir, err := libvirt.TPMStateDir(conn, goldenNode.Name)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(tpmDir), 0o711); err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(tpmDir), err)
+		}
+		if err = libvirt.CopyDir(filepath.Join(dir, goldenNode.TPMState), tpmDir); err != nil {
+			return fmt.Errorf("failed to restore TPM state of %s: %v", goldenNode.Name, err)
+		}
+	}
+	return nil
+}
+
+// loadGoldenImage reads the manifest of a golden image directory.
+func loadGoldenImage(dir string) (*GoldenImage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, goldenManifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read golden image manifest: %v", err)
+	}
+	golden := &GoldenImage{}
+	if err = json.Unmarshal(data, golden); err != nil {
+		return nil, fmt.Errorf("failed to parse golden image manifest: %v", err)
+	}
+	return golden, nil
+}
+
+// copyIfExists copies a file, creating parent directories. A missing source is skipped.
+func copyIfExists(src, dst string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(dst), err)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %v", src, dst, err)
+	}
+	return nil
+}
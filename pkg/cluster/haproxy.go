@@ -1,79 +1,281 @@
 package cluster
 
 import (
+	"bytes"
+	"context"
 	"embed"
+	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
 	"text/template"
 
 	"openshift-qemu/pkg/dns"
 	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+	"openshift-qemu/pkg/systemd"
 )
 
-//go:embed templates/haproxy.cfg.tmpl
-var haproxyTemplate embed.FS
+//go:embed templates/haproxy.cfg.tmpl templates/haproxy.service.tmpl templates/lb.service.tmpl
+var lbTemplates embed.FS
+
+// HAProxyServer is a backend server of the load balancer.
+type HAProxyServer struct {
+	Name     string // host name, e.g. master-1
+	Address  string // fully qualified host name
+	Disabled bool   // kept in maintenance across reloads
+}
 
 // HAProxyConfig holds the data to be passed into the template.
 type HAProxyConfig struct {
 	ClusterName string
 	BaseDomain  string
-	MasterNodes []string
+	Bootstrap   *HAProxyServer // serves the API until the masters take over; nil once removed
+	MasterNodes []HAProxyServer
+	WorkerNodes []HAProxyServer
+	InfraNodes  []HAProxyServer // workers labelled to run the ingress routers
+	IPv6        bool            // also listen on IPv6 for dual-stack clusters
+
+	Bind    string // IPv4 address the frontends listen on, * for any
+	BindV6  string // IPv6 address the frontends listen on
+	Socket  string // runtime API socket
+	PIDFile string
+	Daemon  bool // fork, as the haproxy.service of the load balancer image expects
 }
 
-// GenerateHAProxyConfig generates the haproxy.cfg using a template.
-func GenerateHAProxyConfig(clusterName, baseDomain string, nMast int) error {
-	masterNodes := make([]string, nMast)
-	for i := 1; i <= nMast; i++ {
-		masterNodes[i-1] = fmt.Sprintf("master-%d.%s.%s", i, clusterName, baseDomain)
+// IngressNodes returns the nodes the routers run on: infra nodes if any are labelled,
+// otherwise the workers, and the masters only in a compact cluster, where they are
+// schedulable.
+func (c HAProxyConfig) IngressNodes() []HAProxyServer {
+	switch {
+	case len(c.InfraNodes) > 0:
+		return c.InfraNodes
+	case len(c.WorkerNodes) > 0:
+		return c.WorkerNodes
 	}
+	return c.MasterNodes
+}
 
-	data := HAProxyConfig{
-		ClusterName: clusterName,
-		BaseDomain:  baseDomain,
-		MasterNodes: masterNodes,
+// newHAProxyConfig builds the load balancer configuration of a cluster with the given
+// master and worker host names. Infra nodes must be among the workers; disabled servers
+// start in maintenance.
+func newHAProxyConfig(clusterName, baseDomain string, bootstrap bool, masters, workers, infraNodes, disabled []string, ipv6 bool) (HAProxyConfig, error) {
+	server := func(host string) HAProxyServer {
+		return HAProxyServer{Name: host, Address: fmt.Sprintf("%s.%s.%s", host, clusterName, baseDomain), Disabled: containsString(disabled, host)}
+	}
+	c := HAProxyConfig{
+		ClusterName: clusterName, BaseDomain: baseDomain, IPv6: ipv6,
+		Bind: "*", BindV6: "::", Socket: haproxySocket, PIDFile: "/var/run/haproxy.pid", Daemon: true,
+	}
+	if bootstrap {
+		b := server(RoleBootstrap)
+		c.Bootstrap = &b
+	}
+	for _, host := range masters {
+		c.MasterNodes = append(c.MasterNodes, server(host))
 	}
+	for _, host := range workers {
+		c.WorkerNodes = append(c.WorkerNodes, server(host))
+	}
+	for _, host := range infraNodes {
+		if !containsString(workers, host) {
+			return c, fmt.Errorf("infra node %s is not a worker of cluster %s", host, clusterName)
+		}
+		c.InfraNodes = append(c.InfraNodes, server(host))
+	}
+	return c, nil
+}
 
+// GenerateHAProxyConfig generates the haproxy.cfg of a new cluster using a template.
+func GenerateHAProxyConfig(clusterName, baseDomain string, nMast, nWork int, infraNodes []string, ipv6 bool) error {
+	masters, workers := plannedHosts(nMast, nWork)
+	data, err := newHAProxyConfig(clusterName, baseDomain, true, masters, workers, infraNodes, nil, ipv6)
+	if err != nil {
+		return err
+	}
 	return executeTemplate("haproxy.cfg", data)
 }
 
+// plannedHosts returns the host names of the masters and workers of a new cluster.
+func plannedHosts(nMast, nWork int) ([]string, []string) {
+	var masters, workers []string
+	for i := 1; i <= nMast; i++ {
+		masters = append(masters, fmt.Sprintf("%s-%d", RoleMaster, i))
+	}
+	for i := 1; i <= nWork; i++ {
+		workers = append(workers, fmt.Sprintf("%s-%d", RoleWorker, i))
+	}
+	return masters, workers
+}
+
 // executeTemplate is a helper function to parse and execute templates
 func executeTemplate(outputPath string, data interface{}) error {
-	tmpl, err := template.ParseFS(haproxyTemplate, "templates/haproxy.cfg.tmpl")
+	content, err := renderTemplate("haproxy.cfg.tmpl", data)
 	if err != nil {
-		return fmt.Errorf("error parsing template: %v", err)
+		return err
+	}
+	if err = os.WriteFile(outputPath, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("error creating file: %v", err)
 	}
+	return nil
+}
 
-	f, err := os.Create(outputPath)
+// renderTemplate executes one of the load balancer templates.
+func renderTemplate(name string, data interface{}) (string, error) {
+	tmpl, err := template.ParseFS(lbTemplates, "templates/"+name)
 	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+		return "", fmt.Errorf("error parsing template: %v", err)
+	}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error executing template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// LBSyncParams holds what is needed to update the load balancer of an existing cluster.
+type LBSyncParams struct {
+	ClusterName string
+	BaseDomain  string
+	InfraNodes  []string // workers running the routers; nil keeps the recorded ones
+	URI         string   // libvirt connection URI
+}
+
+// haproxyConfigPath is where the load balancer image keeps the HAProxy configuration.
+const haproxyConfigPath = "/etc/haproxy/haproxy.cfg"
+
+// SyncLBConfig regenerates haproxy.cfg from the nodes recorded in the cluster state and
+// pushes it to the load balancer, which reloads HAProxy once the new file validates.
+func SyncLBConfig(ctx context.Context, params LBSyncParams) error {
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	if params.InfraNodes != nil {
+		st.InfraNodes = params.InfraNodes
+	}
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = pushHAProxyConfig(ctx, conn, st, params.BaseDomain, true); err != nil {
+		return err
+	}
+	return st.Save()
+}
+
+// pushHAProxyConfig renders haproxy.cfg for the recorded nodes and installs it on the load
+// balancer once it validates. Without reload the running HAProxy keeps its configuration,
+// for changes already made through the runtime API.
+func pushHAProxyConfig(ctx context.Context, conn libvirt.VirtConnection, st *state.ClusterState, baseDomain string, reload bool) error {
+	lb := clusterLB(st)
+	if lb == nil {
+		return fmt.Errorf("no load balancer recorded for cluster %s in %s", st.Name, state.Path(st.Name))
+	}
+	if st.HostLB != nil && libvirt.ConnIsRemote(conn) {
+		return fmt.Errorf("the load balancer of cluster %s runs on the libvirt host; update it there", st.Name)
+	}
+
+	data, err := stateHAProxyConfig(st, baseDomain)
+	if err != nil {
+		return err
+	}
+	if st.HostLB != nil && st.HostLB.Mode == LBModeBuiltin {
+		// The built-in load balancer reads the nodes from the cluster state itself
+		logging.Info(fmt.Sprintf("Updating %s with %d masters and ingress on %d nodes", st.HostLB.Unit, len(data.MasterNodes), len(data.IngressNodes())))
+		if err = st.Save(); err != nil || !reload {
+			return err
+		}
+		service := &systemd.Systemd{Name: st.HostLB.Unit}
+		return service.Reload()
+	}
+	if st.HostLB != nil {
+		data.listenOnHost(st.HostLB)
+	}
+	content, err := renderTemplate("haproxy.cfg.tmpl", data)
+	if err != nil {
+		return err
+	}
+
+	if st.HostLB != nil {
+		logging.Info(fmt.Sprintf("Updating HAProxy configuration with %d masters and ingress on %d nodes for %s", len(data.MasterNodes), len(data.IngressNodes()), st.HostLB.Unit))
+		return installHostHAProxyConfig(st.Name, st.HostLB, content, reload)
+	}
+	logging.Info(fmt.Sprintf("Pushing HAProxy configuration with %d masters and ingress on %d nodes to %s", len(data.MasterNodes), len(data.IngressNodes()), lb.Name))
+	staged := haproxyConfigPath + ".new"
+	command := fmt.Sprintf("printf %%s %s | base64 -d > %s && haproxy -c -q -f %s && mv %s %s",
+		base64.StdEncoding.EncodeToString([]byte(content)), staged, staged, staged, haproxyConfigPath)
+	if reload {
+		command += " && systemctl reload haproxy"
+	}
+	if _, err = libvirt.RunInGuest(ctx, conn, lbAccess(lb), command); err != nil {
+		return fmt.Errorf("failed to update HAProxy on %s: %v", lb.Name, err)
+	}
+	return nil
+}
+
+// stateHAProxyConfig builds the load balancer configuration of the nodes recorded in the
+// cluster state.
+func stateHAProxyConfig(st *state.ClusterState, baseDomain string) (HAProxyConfig, error) {
+	var masters, workers []string
+	bootstrap, ipv6 := false, false
+	for _, node := range st.Nodes {
+		switch node.Role {
+		case RoleBootstrap:
+			bootstrap = true
+		case RoleMaster:
+			masters = append(masters, node.Host)
+		case RoleWorker:
+			workers = append(workers, node.Host)
+		}
+		ipv6 = ipv6 || node.IPv6 != ""
 	}
-	defer f.Close()
+	return newHAProxyConfig(st.Name, baseDomain, bootstrap, masters, workers, st.InfraNodes, st.LBDisabled, ipv6)
+}
 
-	return tmpl.Execute(f, data)
+// lbAccess returns how to run commands on the load balancer.
+func lbAccess(lb *state.Node) libvirt.GuestAccess {
+	return libvirt.GuestAccess{VMName: lb.Name, IP: lb.IP, SSHKeyPath: "sshkey", SSHUser: "root"}
 }
 
 // LBVMParams holds the parameters for creating the load balancer VM.
 type LBVMParams struct {
-	ClusterName       string
-	CPU               int
-	MEM               int
-	VirNet            string
-	VMDiskPath        string
-	SSHPubKey         string
-	BaseDomain        string
-	LibguestfsBackend string
-}
-
-// ConfigureLBVM customizes and configures the load balancer VM.
-func ConfigureLBVM(clusterName, sshPubKey string) (string, error) {
+	ClusterName string
+	CPU         int
+	MEM         int
+	VirNet      string
+	VMDiskPath  string
+	SSHPubKey   string
+	BaseDomain  string
+	DNSMode     string
+	URI         string // libvirt connection URI
+	Timeouts    libvirt.WaitTimeouts
+	IPSources   []libvirt.IPSource
+	Boot        BootOptions
+	Arch        string
+	Machine     MachineOptions
+	LogDir      string // serial console logs; empty disables them
+	Disks       []DiskSpec
+	Tuning      []TuningSpec
+}
+
+// ConfigureLBVM customizes and configures the load balancer VM. virt-customize edits the
+// image in place, so the libvirt host must be this one.
+func ConfigureLBVM(clusterName, sshPubKey, uri string) (string, error) {
+	if err := libvirt.RequireLocal(uri, "Customizing the load balancer image"); err != nil {
+		return "", err
+	}
 	vmDiskPath := fmt.Sprintf("/var/lib/libvirt/images/%s-lb.qcow2", clusterName)
 	params := libvirt.VirtCustomizeParams{
 		ImagePath:      vmDiskPath,
 		SSHPubKeyFile:  sshPubKey,
-		Packages:       []string{"haproxy", "bind-utils"},
+		Packages:       []string{"haproxy", "bind-utils", "qemu-guest-agent", "socat"},
 		Uninstall:      []string{"cloud-init"},
 		CopyInFiles:    []string{"haproxy.cfg:/etc/haproxy", "bootstrap.ign:/opt/"},
-		RunCommands:    []string{"systemctl daemon-reload", "systemctl enable haproxy"},
+		RunCommands:    []string{"systemctl daemon-reload", "systemctl enable haproxy qemu-guest-agent"},
 		RelabelSELinux: true,
 	}
 
@@ -85,52 +287,105 @@ func ConfigureLBVM(clusterName, sshPubKey string) (string, error) {
 }
 
 // CreateLBVM creates, starts, and configures networking for the Load Balancer VM.
-func CreateLBVM(params LBVMParams, dnsDir, dnsSvc, gatewayIP string) error {
-	conn, err := libvirt.NewLibvirtConnection(params.LibguestfsBackend)
+func CreateLBVM(ctx context.Context, params LBVMParams, dnsDir, dnsSvc, gatewayIP string) error {
+	if err := checkRemoteSteps(&params.LogDir, params.DNSMode, params.URI); err != nil {
+		return err
+	}
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
 	if err != nil {
 		return fmt.Errorf("failed to connect to libvirt: %v", err)
 	}
 	defer conn.Close()
 
-	if err = createAndStartLBVM(conn, params); err != nil {
+	// Reserve the LB address and publish its DNS names before the VM first boots
+	plan, err := planClusterNodes(conn, params.VirNet, params.ClusterName, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to plan load balancer address: %v", err)
+	}
+	lb, err := nodeByRole(plan, RoleLB)
+	if err != nil {
 		return err
 	}
 
-	lbIP, lbMAC, err := waitForVMIP(conn, params.ClusterName)
+	dnsConfig := dns.DNSConfig{
+		ClusterName: params.ClusterName,
+		BaseDomain:  params.BaseDomain,
+		DNSDir:      dnsDir,
+		DNSSvc:      dnsSvc,
+		LibvirtGwIP: gatewayIP,
+	}
+
+	lb = params.Boot.apply([]Node{lb}, filepath.Dir(params.VMDiskPath), params.Arch)[0]
+	withDisks, err := applyDisks(params.ClusterName, []Node{lb}, params.Disks)
 	if err != nil {
 		return err
 	}
-
-	if err = libvirt.AddDHCPReservation(conn, params.VirNet, lbMAC, lbIP); err != nil {
+	lb = withDisks[0]
+	lbSize := func(string) (int, int) { return params.MEM, params.CPU }
+	tuned, err := applyTuning(conn, []Node{lb}, params.Tuning, lbSize)
+	if err != nil {
+		return err
+	}
+	lb = tuned[0]
+	machine, err := resolveMachine(conn, params.ClusterName, params.Arch, params.Machine, []Node{lb})
+	if err != nil {
+		return err
+	}
+	st, err := recordNodes(params.ClusterName, params.VirNet, []Node{lb})
+	if err != nil {
+		return err
+	}
+	if err = reserveNodeAddresses(conn, params.VirNet, []Node{lb}); err != nil {
 		return fmt.Errorf("failed to add DHCP reservation: %v", err)
 	}
-
-	if err = updateClusterDNS(lbIP, params.ClusterName, params.BaseDomain); err != nil {
+	if err = configureClusterDNS(conn, params.DNSMode, params.VirNet, dnsConfig, lb, []Node{lb}); err != nil {
 		return err
 	}
 
-	if err = dns.ReloadDNS(dns.DNSConfig{
-		ClusterName: params.ClusterName,
-		BaseDomain:  params.BaseDomain,
-		DNSDir:      dnsDir,
-		DNSSvc:      dnsSvc,
-		LibvirtGwIP: gatewayIP,
-	}); err != nil {
-		return fmt.Errorf("failed to restart DNS service: %v", err)
+	if err = createAndStartLBVM(conn, params, machine, lb); err != nil {
+		return err
 	}
 
-	return libvirt.WaitForSSHAccess(lbIP, fmt.Sprintf("lb.%s.%s", params.ClusterName, params.BaseDomain), "sshkey", "root")
+	timeouts := params.Timeouts.WithDefaults()
+	if err = libvirt.WaitForRunning(ctx, conn, lb.Name, timeouts.Start); err != nil {
+		return err
+	}
+	if _, _, err = libvirt.WaitForIP(ctx, conn, lb.Name, ipLookup(st, params.VirNet, params.IPSources, lb), consoleLog(params.LogDir, lb.Name), timeouts.IP); err != nil {
+		return err
+	}
+	return libvirt.WaitForSSHAccess(ctx, conn, lb.Name, lb.IP, lb.FQDN(params.ClusterName, params.BaseDomain), "sshkey", "root", consoleLog(params.LogDir, lb.Name), timeouts.SSH)
 }
 
 // createAndStartLBVM handles the VM creation and startup.
-func createAndStartLBVM(conn libvirt.VirtConnection, params LBVMParams) error {
+func createAndStartLBVM(conn libvirt.VirtConnection, params LBVMParams, machine libvirt.Machine, lb Node) error {
+	if err := createNodeDisks(conn, lb); err != nil {
+		return err
+	}
+	logPath := consoleLog(params.LogDir, lb.Name)
+	if logPath != "" {
+		if err := libvirt.ResetConsoleLog(logPath); err != nil {
+			return err
+		}
+	}
+
 	vmParams := libvirt.VMParams{
-		Name:      fmt.Sprintf("%s-lb", params.ClusterName),
-		Memory:    uint(params.MEM),
-		CPUs:      uint(params.CPU),
-		DiskPath:  params.VMDiskPath,
-		OSVariant: osVariant,
-		Network:   params.VirNet,
+		Name:       lb.Name,
+		Memory:     uint(params.MEM),
+		CPUs:       uint(params.CPU),
+		DiskPath:   params.VMDiskPath,
+		OSVariant:  osVariant,
+		Network:    params.VirNet,
+		MAC:        lb.MAC,
+		Arch:       machine.Arch,
+		Machine:    machine.MachineType,
+		CPUMode:    machine.CPUMode,
+		Firmware:   lb.Firmware,
+		NVRAM:      lb.NVRAM,
+		TPM:        lb.TPM,
+		ConsoleLog: logPath,
+		Disks:      lb.Disks,
+		Tuning:     lb.Tuning,
+		Owner:      libvirt.NewOwnership(params.ClusterName, lb.Role),
 	}
 
 	if err := libvirt.CreateVM(conn, vmParams); err != nil {
@@ -143,20 +398,3 @@ func createAndStartLBVM(conn libvirt.VirtConnection, params LBVMParams) error {
 
 	return nil
 }
-
-// updateClusterDNS adds the IP and hostname to the appropriate /etc/hosts file.
-func updateClusterDNS(ip, clusterName, baseDomain string) error {
-	filePath := fmt.Sprintf("/etc/hosts.%s", clusterName)
-	entry := fmt.Sprintf("%s lb.%s.%s api.%s.%s api-int.%s.%s", ip, clusterName, baseDomain, clusterName, baseDomain, clusterName, baseDomain)
-
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0o600)
-	if err != nil {
-		return fmt.Errorf("failed to open hosts file: %v", err)
-	}
-	defer f.Close()
-
-	if _, err = f.WriteString(entry + "\n"); err != nil {
-		return fmt.Errorf("failed to write to hosts file: %v", err)
-	}
-	return nil
-}
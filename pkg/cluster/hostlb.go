@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"openshift-qemu/pkg/dns"
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+	"openshift-qemu/pkg/systemd"
+)
+
+// Load balancer modes select what routes the API and ingress ports to the nodes.
+const (
+	LBModeVM      = "vm"      // HAProxy in a VM of its own
+	LBModeHost    = "host"    // HAProxy on the libvirt host, listening on the network gateway
+	LBModeBuiltin = "builtin" // openshift-qemu lb serve on the libvirt host, likewise
+)
+
+// hostLBPorts are the API, machine config and ingress ports a load balancer on the host
+// serves to the guests.
+var hostLBPorts = []int{6443, 22623, 80, 443}
+
+// hostHAProxyDir holds the HAProxy configuration of load balancers on the host.
+const hostHAProxyDir = "/etc/openshift-qemu"
+
+// ValidateLBMode checks the load balancer mode.
+func ValidateLBMode(mode string) error {
+	if mode != LBModeVM && mode != LBModeHost && mode != LBModeBuiltin {
+		return fmt.Errorf("unknown load balancer mode %q (expected %s, %s or %s)", mode, LBModeVM, LBModeHost, LBModeBuiltin)
+	}
+	return nil
+}
+
+// HostLBParams holds the configuration of a load balancer on the libvirt host.
+type HostLBParams struct {
+	Mode        string // LBModeHost or LBModeBuiltin
+	ClusterName string
+	BaseDomain  string
+	VirNet      string
+	DNSMode     string
+	NMaster     int
+	NWorker     int
+	InfraNodes  []string
+	URI         string // libvirt connection URI
+}
+
+// hostLBServiceData holds the data of the systemd unit templates.
+type hostLBServiceData struct {
+	ClusterName string
+	Unit        string
+	ConfigPath  string // haproxy.cfg of the cluster
+	PIDFile     string
+	Executable  string // this program, for the built-in load balancer
+}
+
+// CreateHostLB runs the load balancer of the cluster on the libvirt host instead of in a
+// VM: HAProxy, or the built-in load balancer of openshift-qemu lb serve. It listens on the
+// gateway address of the network, where the API and *.apps names point, and runs as a
+// systemd unit of the cluster's own.
+func CreateHostLB(params HostLBParams, dnsDir, dnsSvc, gatewayIP string) error {
+	if err := libvirt.RequireLocal(params.URI, "--lb-mode="+params.Mode); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("haproxy"); err != nil && params.Mode == LBModeHost {
+		return fmt.Errorf("--lb-mode=host needs HAProxy installed on the host: %v", err)
+	}
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	gatewayIP6, err := libvirt.GetNetworkGatewayIP6(conn, params.VirNet)
+	if err != nil {
+		return err
+	}
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	setNetwork(st, params.VirNet)
+	if params.InfraNodes != nil {
+		st.InfraNodes = params.InfraNodes
+	}
+	unitPrefix := "openshift-qemu-haproxy-"
+	if params.Mode == LBModeBuiltin {
+		unitPrefix = "openshift-qemu-lb-"
+	}
+	st.HostLB = &state.HostLB{Mode: params.Mode, IP: gatewayIP, IPv6: gatewayIP6, Unit: unitPrefix + params.ClusterName}
+	if err = st.Save(); err != nil {
+		return err
+	}
+
+	// HAProxy resolves the node names, so they are published first
+	lb := nodesFromState([]state.Node{*clusterLB(st)})[0]
+	dnsConfig := dns.DNSConfig{
+		ClusterName: params.ClusterName,
+		BaseDomain:  params.BaseDomain,
+		DNSDir:      dnsDir,
+		DNSSvc:      dnsSvc,
+		LibvirtGwIP: gatewayIP,
+	}
+	if err = configureClusterDNS(conn, params.DNSMode, params.VirNet, dnsConfig, lb, []Node{lb}); err != nil {
+		return err
+	}
+
+	if params.Mode == LBModeBuiltin {
+		err = writeBuiltinLBUnit(params.ClusterName, st.HostLB)
+	} else {
+		err = writeHostHAProxy(params, st)
+	}
+	if err != nil {
+		return err
+	}
+	if err = systemd.DaemonReload(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	if err = openHostLBPorts(st.HostLB, true); err != nil {
+		return err
+	}
+
+	service := &systemd.Systemd{Name: st.HostLB.Unit}
+	if err = service.Enable(); err != nil {
+		return fmt.Errorf("failed to enable %s: %v", st.HostLB.Unit, err)
+	}
+	if err = service.Restart(); err != nil {
+		return fmt.Errorf("failed to start %s, see journalctl -u %s: %v", st.HostLB.Unit, st.HostLB.Unit, err)
+	}
+	logging.Ok(fmt.Sprintf("Load balancer of %s listening on %s", params.ClusterName, gatewayIP))
+	return nil
+}
+
+// writeHostHAProxy writes the HAProxy configuration and unit of a new cluster.
+func writeHostHAProxy(params HostLBParams, st *state.ClusterState) error {
+	masters, workers := plannedHosts(params.NMaster, params.NWorker)
+	data, err := newHAProxyConfig(params.ClusterName, params.BaseDomain, true, masters, workers, st.InfraNodes, nil, st.HostLB.IPv6 != "")
+	if err != nil {
+		return err
+	}
+	data.listenOnHost(st.HostLB)
+	content, err := renderTemplate("haproxy.cfg.tmpl", data)
+	if err != nil {
+		return err
+	}
+	if err = installHostHAProxyConfig(params.ClusterName, st.HostLB, content, false); err != nil {
+		return err
+	}
+	unit, err := renderTemplate("haproxy.service.tmpl", hostLBServiceData{
+		ClusterName: params.ClusterName,
+		Unit:        st.HostLB.Unit,
+		ConfigPath:  hostHAProxyConfigPath(params.ClusterName),
+		PIDFile:     data.PIDFile,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(hostLBUnitPath(st.HostLB), []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("failed to write unit %s: %v", st.HostLB.Unit, err)
+	}
+
+	// SELinux confines HAProxy to the HTTP ports unless it may bind and connect to any
+	if exec.Command("selinuxenabled").Run() == nil {
+		if out, err := exec.Command("setsebool", "-P", "haproxy_connect_any", "1").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to allow HAProxy to use the API ports: %v: %s", err, out)
+		}
+	}
+	return nil
+}
+
+// listenOnHost makes HAProxy listen on the host addresses of the network only and keep its
+// runtime files in the runtime directory of its unit, so the load balancers of several
+// clusters can share the host.
+func (c *HAProxyConfig) listenOnHost(lb *state.HostLB) {
+	c.Bind, c.BindV6 = lb.IP, lb.IPv6
+	c.Socket = hostLBSocket(lb)
+	c.PIDFile = filepath.Join("/run", lb.Unit, "haproxy.pid")
+	c.Daemon = false
+}
+
+// hostHAProxyConfigPath returns the HAProxy configuration of the host load balancer of a cluster.
+func hostHAProxyConfigPath(clusterName string) string {
+	return filepath.Join(hostHAProxyDir, fmt.Sprintf("haproxy-%s.cfg", clusterName))
+}
+
+// hostLBUnitPath returns the unit file of a host load balancer.
+func hostLBUnitPath(lb *state.HostLB) string {
+	return filepath.Join("/etc/systemd/system", lb.Unit+".service")
+}
+
+// hostLBSocket returns the runtime API socket of a host load balancer.
+func hostLBSocket(lb *state.HostLB) string {
+	return filepath.Join("/run", lb.Unit, "admin.sock")
+}
+
+// installHostHAProxyConfig validates the configuration of a host load balancer and moves
+// it into place, then reloads HAProxy if asked to.
+func installHostHAProxyConfig(clusterName string, lb *state.HostLB, content string, reload bool) error {
+	if err := os.MkdirAll(hostHAProxyDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", hostHAProxyDir, err)
+	}
+	path := hostHAProxyConfigPath(clusterName)
+	staged := path + ".new"
+	if err := os.WriteFile(staged, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", staged, err)
+	}
+	if out, err := exec.Command("haproxy", "-c", "-q", "-f", staged).CombinedOutput(); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("HAProxy rejected the configuration: %v: %s", err, out)
+	}
+	if err := os.Rename(staged, path); err != nil {
+		return fmt.Errorf("failed to install %s: %v", path, err)
+	}
+	if !reload {
+		return nil
+	}
+	service := &systemd.Systemd{Name: lb.Unit}
+	if err := service.Reload(); err != nil {
+		return fmt.Errorf("failed to reload %s: %v", lb.Unit, err)
+	}
+	return nil
+}
+
+// hostRuntime sends commands to the runtime API socket of a load balancer on this host.
+func hostRuntime(ctx context.Context, socket string, commands []string) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to HAProxy runtime API: %v", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+	// Without the interactive prompt HAProxy closes the connection after answering
+	if _, err = fmt.Fprintf(conn, "%s\n", strings.Join(commands, "; ")); err != nil {
+		return "", fmt.Errorf("HAProxy runtime API failed: %v", err)
+	}
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("HAProxy runtime API failed: %v", err)
+	}
+	return string(out), nil
+}
+
+// openHostLBPorts lets the guests reach the load balancer ports on the gateway addresses,
+// or takes that back. firewalld puts libvirt bridges into its libvirt zone, which only
+// admits DHCP, DNS and SSH; without firewalld nothing filters the ports.
+func openHostLBPorts(lb *state.HostLB, open bool) error {
+	if exec.Command("systemctl", "is-active", "--quiet", "firewalld").Run() != nil {
+		return nil
+	}
+	action := "--add-rich-rule"
+	if !open {
+		action = "--remove-rich-rule"
+	}
+	for _, ip := range []string{lb.IP, lb.IPv6} {
+		if ip == "" {
+			continue
+		}
+		family := "ipv4"
+		if strings.Contains(ip, ":") {
+			family = "ipv6"
+		}
+		for _, port := range hostLBPorts {
+			rule := fmt.Sprintf(`rule family="%s" destination address="%s" port port="%d" protocol="tcp" accept`, family, ip, port)
+			for _, args := range [][]string{{"--zone=libvirt"}, {"--permanent", "--zone=libvirt"}} {
+				args = append(args, action+"="+rule)
+				if out, err := exec.Command("firewall-cmd", args...).CombinedOutput(); err != nil {
+					return fmt.Errorf("firewall-cmd %s failed: %v: %s", strings.Join(args, " "), err, out)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removeHostLB stops the load balancer of a cluster on the host and removes its unit,
+// configuration and firewall rules.
+func removeHostLB(clusterName string, lb *state.HostLB) error {
+	logging.Info(fmt.Sprintf("Removing load balancer unit %s", lb.Unit))
+	service := &systemd.Systemd{Name: lb.Unit, Status: systemd.StatusActive, IsEnabled: true}
+	if err := service.Stop(); err != nil {
+		logging.Warn(fmt.Sprintf("Failed to stop %s: %v", lb.Unit, err))
+	}
+	if err := service.Disable(); err != nil {
+		logging.Warn(fmt.Sprintf("Failed to disable %s: %v", lb.Unit, err))
+	}
+	for _, path := range []string{hostLBUnitPath(lb), hostHAProxyConfigPath(clusterName)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+	}
+	if err := systemd.DaemonReload(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	if err := openHostLBPorts(lb, false); err != nil {
+		logging.Warn(fmt.Sprintf("Failed to remove firewall rules of %s: %v", lb.Unit, err))
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package cluster
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strings"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// haproxySocket is the runtime API socket enabled in haproxy.cfg.
+const haproxySocket = "/var/lib/haproxy/stats"
+
+// LBParams holds the configuration for managing the load balancer of a running cluster.
+type LBParams struct {
+	ClusterName   string
+	BaseDomain    string
+	Persist       bool // also write the change to haproxy.cfg so it survives a reload
+	KeepBootstrap bool // only take the bootstrap node out of the load balancer
+	URI           string
+}
+
+// LBServerStatus is the health of a backend, or of a server in it, as HAProxy sees it.
+type LBServerStatus struct {
+	Backend string
+	Server  string // BACKEND for the backend itself
+	Status  string // UP, DOWN, MAINT, ...
+	Check   string // result of the last health check
+	Weight  string
+}
+
+// lbSession is an open connection to the load balancer of a cluster.
+type lbSession struct {
+	conn  libvirt.VirtConnection
+	st    *state.ClusterState
+	lb    *state.Node
+	close func()
+}
+
+// openLB loads the cluster state and connects to libvirt for runtime API access.
+func openLB(params LBParams) (*lbSession, error) {
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return nil, err
+	}
+	lb := clusterLB(st)
+	if lb == nil {
+		return nil, fmt.Errorf("no load balancer recorded for cluster %s in %s", params.ClusterName, state.Path(params.ClusterName))
+	}
+	if st.HostLB != nil {
+		if err = libvirt.RequireLocal(params.URI, "Managing a load balancer on the libvirt host"); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return nil, err
+	}
+	return &lbSession{conn: conn, st: st, lb: lb, close: func() { conn.Close() }}, nil
+}
+
+// runtime sends commands to the HAProxy runtime API of the load balancer and returns
+// the answer.
+func (s *lbSession) runtime(ctx context.Context, commands ...string) (string, error) {
+	if s.st.HostLB != nil {
+		return hostRuntime(ctx, hostLBSocket(s.st.HostLB), commands)
+	}
+	command := fmt.Sprintf("echo '%s' | socat stdio %s", strings.Join(commands, "; "), haproxySocket)
+	out, err := libvirt.RunInGuest(ctx, s.conn, lbAccess(s.lb), command)
+	if err != nil {
+		return "", fmt.Errorf("HAProxy runtime API on %s failed: %v", s.lb.Name, err)
+	}
+	return out, nil
+}
+
+// status returns the backends and servers of the load balancer.
+func (s *lbSession) status(ctx context.Context) ([]LBServerStatus, error) {
+	out, err := s.runtime(ctx, "show stat")
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(strings.TrimSpace(out), "# "))).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, fmt.Errorf("failed to parse HAProxy statistics: %v", err)
+	}
+	column := map[string]int{}
+	for i, name := range records[0] {
+		column[name] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := column[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var servers []LBServerStatus
+	for _, record := range records[1:] {
+		if field(record, "svname") == "FRONTEND" {
+			continue
+		}
+		servers = append(servers, LBServerStatus{
+			Backend: field(record, "pxname"),
+			Server:  field(record, "svname"),
+			Status:  field(record, "status"),
+			Check:   field(record, "check_status"),
+			Weight:  field(record, "weight"),
+		})
+	}
+	return servers, nil
+}
+
+// setServer runs a runtime command for the server in every backend it belongs to.
+func (s *lbSession) setServer(ctx context.Context, server, action string) error {
+	servers, err := s.status(ctx)
+	if err != nil {
+		return err
+	}
+	var commands []string
+	for _, sv := range servers {
+		if sv.Server == server {
+			commands = append(commands, fmt.Sprintf("%s server %s/%s", action, sv.Backend, server))
+		}
+	}
+	if len(commands) == 0 {
+		return fmt.Errorf("load balancer of cluster %s has no server %s", s.st.Name, server)
+	}
+	out, err := s.runtime(ctx, commands...)
+	if err != nil {
+		return err
+	}
+	// Successful commands answer with empty lines
+	if msg := strings.TrimSpace(out); msg != "" {
+		return fmt.Errorf("HAProxy refused to %s server %s: %s", action, server, msg)
+	}
+	return nil
+}
+
+// persist writes the recorded state to haproxy.cfg without reloading HAProxy, which
+// already runs with the change.
+func (s *lbSession) persist(ctx context.Context, baseDomain string) error {
+	if err := pushHAProxyConfig(ctx, s.conn, s.st, baseDomain, false); err != nil {
+		return err
+	}
+	return s.st.Save()
+}
+
+// serverName returns the HAProxy server name of a node given by host or VM name.
+func (s *lbSession) serverName(node string) string {
+	for _, n := range s.st.Nodes {
+		if n.Name == node {
+			return n.Host
+		}
+	}
+	return node
+}
+
+// LBStatus returns the health of every backend and server of the load balancer.
+func LBStatus(ctx context.Context, params LBParams) ([]LBServerStatus, error) {
+	s, err := openLB(params)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return s.status(ctx)
+}
+
+// DisableLBServer puts a server into maintenance in every backend, so it receives no
+// new connections.
+func DisableLBServer(ctx context.Context, params LBParams, node string) error {
+	s, err := openLB(params)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	server := s.serverName(node)
+	if err = s.setServer(ctx, server, "disable"); err != nil {
+		return err
+	}
+	logging.Ok(fmt.Sprintf("Server %s disabled", server))
+	if !params.Persist || containsString(s.st.LBDisabled, server) {
+		return nil
+	}
+	s.st.LBDisabled = append(s.st.LBDisabled, server)
+	return s.persist(ctx, params.BaseDomain)
+}
+
+// EnableLBServer takes a server out of maintenance in every backend.
+func EnableLBServer(ctx context.Context, params LBParams, node string) error {
+	s, err := openLB(params)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	server := s.serverName(node)
+	if err = s.setServer(ctx, server, "enable"); err != nil {
+		return err
+	}
+	logging.Ok(fmt.Sprintf("Server %s enabled", server))
+	if !containsString(s.st.LBDisabled, server) {
+		return nil
+	}
+	var disabled []string
+	for _, d := range s.st.LBDisabled {
+		if d != server {
+			disabled = append(disabled, d)
+		}
+	}
+	s.st.LBDisabled = disabled
+	return s.persist(ctx, params.BaseDomain)
+}
+
+// RemoveBootstrap takes the bootstrap node out of the API backends through the runtime
+// API, without restarting HAProxy, then removes the bootstrap VM unless it is kept.
+// haproxy.cfg is rewritten either way, so a later reload does not bring it back.
+func RemoveBootstrap(ctx context.Context, params LBParams) error {
+	s, err := openLB(params)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	var bootstrap *state.Node
+	for i := range s.st.Nodes {
+		if s.st.Nodes[i].Role == RoleBootstrap {
+			bootstrap = &s.st.Nodes[i]
+		}
+	}
+	if bootstrap == nil {
+		return fmt.Errorf("cluster %s has no bootstrap node", params.ClusterName)
+	}
+	if err = s.setServer(ctx, bootstrap.Host, "disable"); err != nil {
+		return err
+	}
+	logging.Ok("Bootstrap node removed from the load balancer")
+
+	if params.KeepBootstrap {
+		if !containsString(s.st.LBDisabled, bootstrap.Host) {
+			s.st.LBDisabled = append(s.st.LBDisabled, bootstrap.Host)
+		}
+		return s.persist(ctx, params.BaseDomain)
+	}
+
+	logging.Info(fmt.Sprintf("Removing bootstrap VM %s", bootstrap.Name))
+	if err = libvirt.RemoveVM(s.conn, bootstrap.Name); err != nil {
+		return err
+	}
+	if s.st.Network != "" {
+		if err = forgetNodeAddresses(s.conn, s.st.Network, *bootstrap); err != nil {
+			logging.Warn(fmt.Sprintf("Failed to remove addresses of %s: %v", bootstrap.Name, err))
+		}
+	}
+	s.st.RemoveNode(bootstrap.Name)
+	return s.persist(ctx, params.BaseDomain)
+}
@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"fmt"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// MachineOptions overrides the machine type and CPU mode picked from the host capabilities.
+type MachineOptions struct {
+	MachineType string
+	CPUMode     string
+}
+
+// resolveMachine chooses the machine type and CPU mode of the cluster VMs and checks that
+// the host can boot the firmware of the nodes. A choice recorded in the cluster state is
+// kept unless overridden, so VMs created later match the existing ones.
+func resolveMachine(conn libvirt.VirtConnection, clusterName, arch string, opts MachineOptions, nodes []Node) (libvirt.Machine, error) {
+	if arch == "" {
+		arch = libvirt.ArchX86_64
+	}
+	caps, err := libvirt.GetHostCaps(conn, arch)
+	if err != nil {
+		return libvirt.Machine{}, err
+	}
+	for _, node := range nodes {
+		if err = caps.ValidateFirmware(node.Firmware); err != nil {
+			return libvirt.Machine{}, fmt.Errorf("cannot create %s: %v", node.Name, err)
+		}
+	}
+
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return libvirt.Machine{}, err
+	}
+	if st.MachineType != "" && st.Arch == arch && opts == (MachineOptions{}) {
+		return libvirt.Machine{Arch: st.Arch, MachineType: st.MachineType, CPUMode: st.CPUMode}, nil
+	}
+
+	machine, err := caps.SelectMachine(opts.MachineType, opts.CPUMode)
+	if err != nil {
+		return machine, err
+	}
+	logging.Info(fmt.Sprintf("Using machine type %s with CPU mode %s for %s guests", machine.MachineType, machine.CPUMode, machine.Arch))
+
+	st.Arch, st.MachineType, st.CPUMode = machine.Arch, machine.MachineType, machine.CPUMode
+	return machine, st.Save()
+}
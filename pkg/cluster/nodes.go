@@ -1,199 +1,276 @@
 package cluster
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"time"
+	"strings"
 
 	"openshift-qemu/pkg/libvirt"
 	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
 )
 
 // NodeParams holds the configuration for creating bootstrap, master, and worker nodes.
 type NodeParams struct {
-	ClusterName       string
-	BaseDomain        string
-	VMDir             string
-	LBIP              string
-	WSPort            int
-	Image             string
-	VirNet            string
-	BtsMem            int
-	BtsCPU            int
-	MasMem            int
-	MasCPU            int
-	WorMem            int
-	WorCPU            int
-	NMaster           int
-	NWorker           int
-	RHCOSArg          string
-	LibguestfsBackend string
+	ClusterName string
+	BaseDomain  string
+	VMDir       string
+	LBIP        string
+	WSPort      int
+	Image       string
+	VirNet      string
+	BtsMem      int
+	BtsCPU      int
+	MasMem      int
+	MasCPU      int
+	WorMem      int
+	WorCPU      int
+	NMaster     int
+	NWorker     int
+	RHCOSArg    string
+	DNSMode     string
+	URI         string // libvirt connection URI
+	Timeouts    libvirt.WaitTimeouts
+	IPSources   []libvirt.IPSource
+	Boot        BootOptions
+	Arch        string
+	Machine     MachineOptions
+	LogDir      string // serial console logs; empty disables them
+	Disks       []DiskSpec
+	Tuning      []TuningSpec
+	RootDiskGB  uint     // size of the empty root disk each node installs to
+	InfraNodes  []string // workers running the ingress routers
+}
+
+// BootOptions selects the firmware and TPM of each node role.
+type BootOptions struct {
+	Firmware map[string]string // role -> libvirt.Firmware*; roles not listed boot with BIOS
+	TPM      []string          // roles that get an emulated TPM 2.0
+}
+
+// Validate checks the roles and firmware names, and that the firmware can boot the architecture.
+func (b BootOptions) Validate(arch string) error {
+	if err := libvirt.ValidateArch(arch, ""); err != nil {
+		return err
+	}
+	roles := map[string]bool{RoleLB: true, RoleBootstrap: true, RoleMaster: true, RoleWorker: true}
+	for role, firmware := range b.Firmware {
+		if !roles[role] {
+			return fmt.Errorf("unknown role %q in firmware selection", role)
+		}
+		if err := libvirt.ValidateFirmware(firmware); err != nil {
+			return err
+		}
+		if err := libvirt.ValidateArch(arch, firmware); err != nil {
+			return err
+		}
+	}
+	for _, role := range b.TPM {
+		if !roles[role] {
+			return fmt.Errorf("unknown role %q in TPM selection", role)
+		}
+	}
+	return nil
+}
+
+// apply sets the firmware and TPM of each node by role. UEFI variable stores are kept in vmDir.
+func (b BootOptions) apply(nodes []Node, vmDir, arch string) []Node {
+	for i, node := range nodes {
+		nodes[i].Firmware = libvirt.FirmwareBIOS
+		if firmware, ok := b.Firmware[node.Role]; ok {
+			nodes[i].Firmware = firmware
+		}
+		if arch == libvirt.ArchAArch64 && !libvirt.IsUEFI(nodes[i].Firmware) {
+			nodes[i].Firmware = libvirt.FirmwareUEFI
+		}
+		if libvirt.IsUEFI(nodes[i].Firmware) {
+			nodes[i].NVRAM = libvirt.NVRAMPath(vmDir, node.Name)
+		}
+		for _, role := range b.TPM {
+			if role == node.Role {
+				nodes[i].TPM = true
+			}
+		}
+	}
+	return nodes
 }
 
 // CreateNodes handles the creation of bootstrap, master, and worker nodes using libvirt.
-func CreateNodes(params NodeParams) error {
+func CreateNodes(ctx context.Context, params NodeParams) error {
 	logging.Info("Creating Bootstrap, Master, and Worker nodes...")
 
-	conn, err := libvirt.NewLibvirtConnection(params.LibguestfsBackend)
+	if err := checkRemoteSteps(&params.LogDir, params.DNSMode, params.URI); err != nil {
+		return err
+	}
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
 	if err != nil {
 		logging.Fatal("Failed to connect to libvirt", err)
 		return err
 	}
 	defer conn.Close()
 
-	// Create the Bootstrap VM
-	err = createBootstrapNode(conn, params)
+	// Plan MAC and IP addresses up front so reservations and DNS exist before first boot
+	plan, err := planClusterNodes(conn, params.VirNet, params.ClusterName, params.NMaster, params.NWorker)
 	if err != nil {
-		logging.Fatal("Failed to create bootstrap node", err)
-		return err
+		return fmt.Errorf("failed to plan cluster addresses: %v", err)
+	}
+	if params.LBIP == "" {
+		// A load balancer on the host is not where the plan puts the LB VM
+		recorded, err := state.Load(params.ClusterName)
+		if err != nil {
+			return err
+		}
+		lb, err := nodeByRole(plan, RoleLB)
+		if err != nil {
+			return err
+		}
+		params.LBIP = lb.IP
+		if recorded.HostLB != nil {
+			params.LBIP = recorded.HostLB.IP
+		}
+	}
+	nodes := []Node{}
+	for _, node := range plan {
+		if node.Role != RoleLB {
+			nodes = append(nodes, node)
+		}
 	}
 
-	// Create the Master VMs
-	err = createMasterNodes(conn, params)
-	if err != nil {
-		logging.Fatal("Failed to create master nodes", err)
+	nodes = params.Boot.apply(nodes, params.VMDir, params.Arch)
+	if nodes, err = applyDisks(params.ClusterName, nodes, params.Disks); err != nil {
 		return err
 	}
-
-	// Create the Worker VMs
-	err = createWorkerNodes(conn, params)
+	if nodes, err = applyTuning(conn, nodes, params.Tuning, params.nodeSize); err != nil {
+		return err
+	}
+	machine, err := resolveMachine(conn, params.ClusterName, params.Arch, params.Machine, nodes)
 	if err != nil {
-		logging.Fatal("Failed to create worker nodes", err)
 		return err
 	}
-
-	// Start the VMs and wait for IPs
-	err = waitForVMIPs(conn, params)
+	st, err := recordNodes(params.ClusterName, params.VirNet, nodes)
 	if err != nil {
 		return err
 	}
-	bootstrapIP, _, err := libvirt.GetVMIP(conn, fmt.Sprintf("%s-bootstrap", params.ClusterName))
-	return libvirt.WaitForSSHAccess(bootstrapIP, fmt.Sprintf("bootstrap.%s.%s", params.ClusterName, params.BaseDomain), "sshkey", "core")
-}
-
-// createBootstrapNode creates the bootstrap node VM.
-func createBootstrapNode(conn libvirt.VirtConnection, params NodeParams) error {
-	logging.Info("Creating Bootstrap VM")
-
-	bootstrapParams := libvirt.VMParams{
-		Name:      fmt.Sprintf("%s-bootstrap", params.ClusterName),
-		Memory:    uint(params.BtsMem),
-		CPUs:      uint(params.BtsCPU),
-		DiskPath:  fmt.Sprintf("%s/%s-bootstrap.qcow2", params.VMDir, params.ClusterName),
-		OSVariant: osVariant,
-		Location:  "rhcos-install/",
-		ExtraArgs: fmt.Sprintf("nomodeset rd.neednet=1 coreos.inst=yes coreos.inst.install_dev=vda %s=http://%s:%d/%s coreos.inst.ignition_url=http://%s:%d/bootstrap.ign", params.RHCOSArg, params.LBIP, params.WSPort, params.Image, params.LBIP, params.WSPort),
-		Network:   params.VirNet,
+	if err = reserveNodeAddresses(conn, params.VirNet, nodes); err != nil {
+		return fmt.Errorf("failed to add DHCP reservations: %v", err)
+	}
+	if err = publishNodeDNS(conn, params.DNSMode, params.VirNet, params.ClusterName, params.BaseDomain, nodes); err != nil {
+		return err
 	}
 
-	return libvirt.CreateVM(conn, bootstrapParams)
-}
-
-// createMasterNodes creates the master node VMs.
-func createMasterNodes(conn libvirt.VirtConnection, params NodeParams) error {
-	for i := 1; i <= params.NMaster; i++ {
-		masterName := fmt.Sprintf("%s-master-%d", params.ClusterName, i)
-		logging.Info(fmt.Sprintf("Creating Master-%d VM", i))
-
-		masterParams := libvirt.VMParams{
-			Name:      masterName,
-			Memory:    uint(params.MasMem),
-			CPUs:      uint(params.MasCPU),
-			DiskPath:  fmt.Sprintf("%s/%s-master-%d.qcow2", params.VMDir, params.ClusterName, i),
-			OSVariant: osVariant,
-			Location:  "rhcos-install/",
-			ExtraArgs: fmt.Sprintf("nomodeset rd.neednet=1 coreos.inst=yes coreos.inst.install_dev=vda %s=http://%s:%d/%s coreos.inst.ignition_url=http://%s:%d/master.ign", params.RHCOSArg, params.LBIP, params.WSPort, params.Image, params.LBIP, params.WSPort),
-			Network:   params.VirNet,
+	// Define the Bootstrap, Master and Worker VMs
+	for _, node := range nodes {
+		if err = createNode(conn, params, machine, node); err != nil {
+			logging.Fatal(fmt.Sprintf("Failed to create %s node", node.Host), err)
+			return err
 		}
+	}
 
-		err := libvirt.CreateVM(conn, masterParams)
-		if err != nil {
+	// Start the VMs and wait for IPs
+	for _, node := range nodes {
+		if err = libvirt.StartVM(conn, node.Name); err != nil {
 			return err
 		}
 	}
-	return nil
-}
+	timeouts := params.Timeouts.WithDefaults()
+	err = waitForVMIPs(ctx, conn, st, params.VirNet, params.IPSources, params.LogDir, nodes, timeouts)
+	if err != nil {
+		return err
+	}
+	bootstrap, err := nodeByRole(nodes, RoleBootstrap)
+	if err != nil {
+		return err
+	}
 
-// createWorkerNodes creates the worker node VMs.
-func createWorkerNodes(conn libvirt.VirtConnection, params NodeParams) error {
-	for i := 1; i <= params.NWorker; i++ {
-		workerName := fmt.Sprintf("%s-worker-%d", params.ClusterName, i)
-		logging.Info(fmt.Sprintf("Creating Worker-%d VM", i))
+	// The load balancer was configured before the nodes existed; route to the real topology
+	err = SyncLBConfig(ctx, LBSyncParams{ClusterName: params.ClusterName, BaseDomain: params.BaseDomain, InfraNodes: params.InfraNodes, URI: params.URI})
+	if err != nil {
+		logging.Warn(fmt.Sprintf("Load balancer not updated, run lb sync once it is reachable: %v", err))
+	}
+	return libvirt.WaitForSSHAccess(ctx, conn, bootstrap.Name, bootstrap.IP, bootstrap.FQDN(params.ClusterName, params.BaseDomain), "sshkey", "core", consoleLog(params.LogDir, bootstrap.Name), timeouts.SSH)
+}
 
-		workerParams := libvirt.VMParams{
-			Name:      workerName,
-			Memory:    uint(params.WorMem),
-			CPUs:      uint(params.WorCPU),
-			DiskPath:  fmt.Sprintf("%s/%s-worker-%d.qcow2", params.VMDir, params.ClusterName, i),
-			OSVariant: osVariant,
-			Location:  "rhcos-install/",
-			ExtraArgs: fmt.Sprintf("nomodeset rd.neednet=1 coreos.inst=yes coreos.inst.install_dev=vda %s=http://%s:%d/%s coreos.inst.ignition_url=http://%s:%d/worker.ign", params.RHCOSArg, params.LBIP, params.WSPort, params.Image, params.LBIP, params.WSPort),
-			Network:   params.VirNet,
-		}
+// createNode defines the VM of a bootstrap, master or worker node.
+func createNode(conn libvirt.VirtConnection, params NodeParams, machine libvirt.Machine, node Node) error {
+	logging.Info(fmt.Sprintf("Creating %s VM", node.Host))
 
-		err := libvirt.CreateVM(conn, workerParams)
-		if err != nil {
+	memory, cpus := params.nodeSize(node.Role)
+	diskPath := fmt.Sprintf("%s/%s.qcow2", params.VMDir, node.Name)
+	if err := libvirt.CreateRootDisk(conn, diskPath, params.RootDiskGB); err != nil {
+		return err
+	}
+	if err := createNodeDisks(conn, node); err != nil {
+		return err
+	}
+	logPath := consoleLog(params.LogDir, node.Name)
+	if logPath != "" {
+		if err := libvirt.ResetConsoleLog(logPath); err != nil {
 			return err
 		}
 	}
-	return nil
-}
-
-// waitForVMIPs waits for VMs to obtain IP addresses and configures DHCP reservations.
-func waitForVMIPs(conn libvirt.VirtConnection, params NodeParams) error {
-	logging.Info("Waiting for VMs to obtain IP addresses")
 
-	roles := []string{"bootstrap", "master", "worker"}
-	for _, role := range roles {
-		for i := 1; i <= getRoleCount(params, role); i++ {
-			vmName := fmt.Sprintf("%s-%s-%d", params.ClusterName, role, i)
-			ip, mac, err := waitForVMIP(conn, vmName)
-			if err != nil {
-				logging.Fatal(fmt.Sprintf("Failed to get IP for %s", vmName), err)
-			}
-			if err = libvirt.AddDHCPReservation(conn, ip, mac, params.VirNet); err != nil {
-				return err
-			}
-			updateHostDNS(params, ip, vmName)
-		}
+	vmParams := libvirt.VMParams{
+		Name:       node.Name,
+		Memory:     uint(memory),
+		CPUs:       uint(cpus),
+		DiskPath:   diskPath,
+		OSVariant:  osVariant,
+		Location:   "rhcos-install/",
+		ExtraArgs:  fmt.Sprintf("nomodeset rd.neednet=1 coreos.inst=yes coreos.inst.install_dev=vda %s=http://%s:%d/%s coreos.inst.ignition_url=http://%s:%d/%s.ign", params.RHCOSArg, params.LBIP, params.WSPort, params.Image, params.LBIP, params.WSPort, node.Role),
+		Network:    params.VirNet,
+		MAC:        node.MAC,
+		Arch:       machine.Arch,
+		Machine:    machine.MachineType,
+		CPUMode:    machine.CPUMode,
+		Firmware:   node.Firmware,
+		NVRAM:      node.NVRAM,
+		TPM:        node.TPM,
+		ConsoleLog: logPath,
+		Disks:      node.Disks,
+		Tuning:     node.Tuning,
+		Owner:      libvirt.NewOwnership(params.ClusterName, node.Role),
 	}
-	return nil
+
+	return libvirt.CreateVM(conn, vmParams)
 }
 
-// getRoleCount returns the number of VMs for a given role (bootstrap, master, or worker).
-func getRoleCount(params NodeParams, role string) int {
+// nodeSize returns the memory in MiB and vCPUs of a node of the role.
+func (params NodeParams) nodeSize(role string) (int, int) {
 	switch role {
-	case "bootstrap":
-		return 1
-	case "master":
-		return params.NMaster
-	case "worker":
-		return params.NWorker
-	default:
-		return 0
+	case RoleBootstrap:
+		return params.BtsMem, params.BtsCPU
+	case RoleMaster:
+		return params.MasMem, params.MasCPU
 	}
+	return params.WorMem, params.WorCPU
 }
 
-// waitForVMIP waits for a VM to obtain an IP address.
-func waitForVMIP(conn libvirt.VirtConnection, vmName string) (string, string, error) {
-	var ip, mac string
-	for {
-		var err error
-		time.Sleep(5 * time.Second)
-		ip, mac, err = libvirt.GetVMIP(conn, vmName) // Retrieves the IP and MAC using libvirt API
-		if err == nil && ip != "" && mac != "" {
-			logging.Info(fmt.Sprintf("Obtained IP: %s for VM: %s", ip, vmName))
-			return ip, mac, nil
-		}
-		return "", "", err
+// consoleLog returns the console log of a VM, or nothing when console logging is off.
+func consoleLog(logDir, vmName string) string {
+	if logDir == "" {
+		return ""
 	}
+	return libvirt.ConsoleLogPath(logDir, vmName)
 }
 
-// updateHostDNS adds a /etc/hosts entry for the VM.
-func updateHostDNS(params NodeParams, ip, vmName string) {
-	hostsEntry := fmt.Sprintf("%s %s.%s.%s", ip, vmName, params.ClusterName, params.BaseDomain)
-	err := os.WriteFile(fmt.Sprintf("/etc/hosts.%s", params.ClusterName), []byte(hostsEntry), 0o644)
-	if err != nil {
-		logging.Fatal(fmt.Sprintf("Failed to add hosts entry for %s", vmName), err)
+// waitForVMIPs waits for VMs to start and obtain their reserved IP addresses. A VM that
+// comes up on another address fails the wait.
+func waitForVMIPs(ctx context.Context, conn libvirt.VirtConnection, st *state.ClusterState, virNet string, sources []libvirt.IPSource, logDir string, nodes []Node, timeouts libvirt.WaitTimeouts) error {
+	logging.Info("Waiting for VMs to obtain IP addresses")
+
+	for _, node := range nodes {
+		if err := libvirt.WaitForRunning(ctx, conn, node.Name, timeouts.Start); err != nil {
+			return err
+		}
+		ip, mac, err := libvirt.WaitForIP(ctx, conn, node.Name, ipLookup(st, virNet, sources, node), consoleLog(logDir, node.Name), timeouts.IP)
+		if err != nil {
+			return err
+		}
+		// DNS, the hosts file and the load balancer were set up for the reserved address
+		if ip != node.IP || !strings.EqualFold(mac, node.MAC) {
+			return fmt.Errorf("%s obtained %s (%s) instead of its reserved %s (%s); DNS and the load balancer point at the reserved address, check the DHCP reservations of network %s",
+				node.Name, ip, mac, node.IP, node.MAC, virNet)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,342 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"openshift-qemu/pkg/dns"
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// Node roles, also used as the host name prefix of each VM.
+const (
+	RoleLB        = "lb"
+	RoleBootstrap = "bootstrap"
+	RoleMaster    = "master"
+	RoleWorker    = "worker"
+)
+
+// Host offsets inside the machine network for each role. Masters and workers
+// are numbered from 1, so master-1 gets masterHostOffset+1.
+const (
+	lbHostOffset        = 10
+	bootstrapHostOffset = 11
+	masterHostOffset    = 20
+	workerHostOffset    = 100
+)
+
+// Node is a cluster VM together with its pre-computed network identity.
+type Node struct {
+	Name string // libvirt domain name, e.g. ocp4-master-1
+	Host string // short host name, e.g. master-1
+	Role string
+	MAC  string
+	IP   string
+	IPv6 string // empty on IPv4-only networks
+
+	Firmware string // libvirt.Firmware*; empty means BIOS
+	NVRAM    string // UEFI variable store
+	TPM      bool
+
+	Disks  []libvirt.ExtraDisk // data disks besides the root disk
+	Tuning libvirt.Tuning
+}
+
+// FQDN returns the fully qualified host name of the node.
+func (n Node) FQDN(clusterName, baseDomain string) string {
+	return fmt.Sprintf("%s.%s.%s", n.Host, clusterName, baseDomain)
+}
+
+// PlanNodes computes the names, MAC addresses and IP addresses of every VM in the cluster.
+// machineNetworkV6 is optional; when set, every node also gets an IPv6 address at the same host offset.
+func PlanNodes(clusterName string, nMasters, nWorkers int, machineNetwork, machineNetworkV6 *net.IPNet) ([]Node, error) {
+	nodes := []Node{}
+
+	add := func(role, host string, offset int) error {
+		ip, err := libvirt.HostIP(machineNetwork, offset)
+		if err != nil {
+			return fmt.Errorf("no address for %s: %v", host, err)
+		}
+		var ipv6 string
+		if machineNetworkV6 != nil {
+			if ipv6, err = libvirt.HostIP(machineNetworkV6, offset); err != nil {
+				return fmt.Errorf("no IPv6 address for %s: %v", host, err)
+			}
+		}
+		nodes = append(nodes, Node{
+			Name: fmt.Sprintf("%s-%s", clusterName, host),
+			Host: host,
+			Role: role,
+			MAC:  libvirt.GenerateMAC(clusterName, host),
+			IP:   ip,
+			IPv6: ipv6,
+		})
+		return nil
+	}
+
+	if err := add(RoleLB, RoleLB, lbHostOffset); err != nil {
+		return nil, err
+	}
+	if err := add(RoleBootstrap, RoleBootstrap, bootstrapHostOffset); err != nil {
+		return nil, err
+	}
+	if nMasters >= workerHostOffset-masterHostOffset {
+		return nil, fmt.Errorf("too many masters (%d)", nMasters)
+	}
+	for i := 1; i <= nMasters; i++ {
+		if err := add(RoleMaster, fmt.Sprintf("%s-%d", RoleMaster, i), masterHostOffset+i); err != nil {
+			return nil, err
+		}
+	}
+	for i := 1; i <= nWorkers; i++ {
+		if err := add(RoleWorker, fmt.Sprintf("%s-%d", RoleWorker, i), workerHostOffset+i); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// MaxSubnetPrefix returns the longest IPv4 prefix whose subnet holds the host offsets of
+// a cluster with nWorkers workers, below its broadcast address.
+func MaxSubnetPrefix(nWorkers int) int {
+	last := workerHostOffset + nWorkers
+	prefix := 30
+	for prefix > 0 && last >= 1<<uint(32-prefix)-1 {
+		prefix--
+	}
+	return prefix
+}
+
+// planClusterNodes looks up the machine network of virNet and plans the cluster nodes on it.
+func planClusterNodes(conn libvirt.VirtConnection, virNet, clusterName string, nMasters, nWorkers int) ([]Node, error) {
+	machineNetwork, err := libvirt.GetNetworkCIDR(conn, virNet)
+	if err != nil {
+		return nil, err
+	}
+	machineNetworkV6, err := libvirt.GetNetworkCIDR6(conn, virNet)
+	if err != nil {
+		return nil, err
+	}
+	return PlanNodes(clusterName, nMasters, nWorkers, machineNetwork, machineNetworkV6)
+}
+
+// nodeByRole returns the first planned node with the given role.
+func nodeByRole(nodes []Node, role string) (Node, error) {
+	for _, node := range nodes {
+		if node.Role == role {
+			return node, nil
+		}
+	}
+	return Node{}, fmt.Errorf("no %s node planned", role)
+}
+
+// nodeDiskRefs returns the pool/volume records of the extra disks of a node.
+func nodeDiskRefs(node Node) []string {
+	var refs []string
+	for _, disk := range node.Disks {
+		refs = append(refs, diskRef(disk))
+	}
+	return refs
+}
+
+// recordNodes stores the planned nodes in the cluster state and returns the updated state.
+func recordNodes(clusterName, virNet string, nodes []Node) (*state.ClusterState, error) {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	setNetwork(st, virNet)
+	for _, node := range nodes {
+		st.SetNode(state.Node{
+			Name: node.Name, Host: node.Host, Role: node.Role, MAC: node.MAC, IP: node.IP, IPv6: node.IPv6,
+			Firmware: node.Firmware, NVRAM: node.NVRAM, TPM: node.TPM,
+			Disks: nodeDiskRefs(node),
+		})
+	}
+	return st, st.Save()
+}
+
+// ipLookup returns how to discover the address of a node. The static source falls back to
+// the address recorded in the cluster state, which may have been edited for static setups.
+func ipLookup(st *state.ClusterState, virNet string, sources []libvirt.IPSource, node Node) libvirt.IPLookup {
+	lookup := libvirt.IPLookup{Network: virNet, Sources: sources}
+	if recorded := st.Node(node.Name); recorded != nil {
+		lookup.StaticIP = recorded.IP
+	}
+	return lookup
+}
+
+// nodesFromState converts recorded nodes back into planned nodes.
+func nodesFromState(recorded []state.Node) []Node {
+	nodes := make([]Node, 0, len(recorded))
+	for _, n := range recorded {
+		nodes = append(nodes, Node{
+			Name: n.Name, Host: n.Host, Role: n.Role, MAC: n.MAC, IP: n.IP, IPv6: n.IPv6,
+			Firmware: n.Firmware, NVRAM: n.NVRAM, TPM: n.TPM,
+		})
+	}
+	return nodes
+}
+
+// reserveNodeAddresses writes a DHCP host entry for each node into the libvirt network.
+func reserveNodeAddresses(conn libvirt.VirtConnection, virNet string, nodes []Node) error {
+	for _, node := range nodes {
+		if err := libvirt.AddDHCPReservation(conn, virNet, libvirt.DHCPReservation{
+			MAC:  node.MAC,
+			IP:   node.IP,
+			Name: node.Host,
+		}); err != nil {
+			return err
+		}
+		if node.IPv6 == "" {
+			continue
+		}
+		if err := libvirt.AddDHCPReservation(conn, virNet, libvirt.DHCPReservation{
+			IP:   node.IPv6,
+			Name: node.Host,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostNames returns the DNS names of a node. The LB also answers for the API names.
+func hostNames(node Node, clusterName, baseDomain string) []string {
+	names := []string{node.FQDN(clusterName, baseDomain)}
+	if node.Role == RoleLB {
+		names = append(names,
+			fmt.Sprintf("api.%s.%s", clusterName, baseDomain),
+			fmt.Sprintf("api-int.%s.%s", clusterName, baseDomain))
+	}
+	return names
+}
+
+// hostsEntries returns the /etc/hosts lines for a node, one per address family.
+func hostsEntries(node Node, clusterName, baseDomain string) []string {
+	names := strings.Join(hostNames(node, clusterName, baseDomain), " ")
+	entries := []string{fmt.Sprintf("%s %s", node.IP, names)}
+	if node.IPv6 != "" {
+		entries = append(entries, fmt.Sprintf("%s %s", node.IPv6, names))
+	}
+	return entries
+}
+
+// publishNodeDNS publishes the DNS records of the nodes either in /etc/hosts.<cluster>
+// or in the libvirt network, depending on the DNS mode.
+func publishNodeDNS(conn libvirt.VirtConnection, dnsMode, virNet, clusterName, baseDomain string, nodes []Node) error {
+	if dnsMode != dns.ModeLibvirt {
+		return writeHostsEntries(clusterName, baseDomain, nodes)
+	}
+
+	for _, node := range nodes {
+		for _, ip := range []string{node.IP, node.IPv6} {
+			if ip == "" {
+				continue
+			}
+			host := libvirt.DNSHost{IP: ip, Hostnames: hostNames(node, clusterName, baseDomain)}
+			if err := libvirt.SetNetworkDNSHost(conn, virNet, host); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRemoteSteps fails early for steps that need files on a remote libvirt host, and
+// turns off console logs, which libvirt would write there out of reach of the waiters.
+func checkRemoteSteps(logDir *string, dnsMode, uri string) error {
+	if !libvirt.IsRemote(uri) {
+		return nil
+	}
+	if dnsMode != dns.ModeLibvirt {
+		if err := libvirt.RequireLocal(uri, "--dns-mode=host"); err != nil {
+			return fmt.Errorf("%v (use --dns-mode=libvirt)", err)
+		}
+	}
+	if *logDir != "" {
+		logging.Warn("Console logs are not captured over a remote connection; use 'cluster console' instead")
+		*logDir = ""
+	}
+	return nil
+}
+
+// configureClusterDNS publishes the DNS records of the nodes and points the host resolver
+// at them. In libvirt mode the network's dnsmasq also answers *.apps with the LB addresses.
+func configureClusterDNS(conn libvirt.VirtConnection, dnsMode, virNet string, dnsConfig dns.DNSConfig, lb Node, nodes []Node) error {
+	// The network's dnsmasq must own the cluster domain and *.apps before guests attach to it
+	if dnsMode == dns.ModeLibvirt {
+		clusterDomain := fmt.Sprintf("%s.%s", dnsConfig.ClusterName, dnsConfig.BaseDomain)
+		appsWildcards := []string{fmt.Sprintf("address=/apps.%s/%s", clusterDomain, lb.IP)}
+		if lb.IPv6 != "" {
+			appsWildcards = append(appsWildcards, fmt.Sprintf("address=/apps.%s/%s", clusterDomain, lb.IPv6))
+		}
+		if err := libvirt.SetNetworkDNSOptions(conn, virNet, clusterDomain, appsWildcards); err != nil {
+			return fmt.Errorf("failed to configure libvirt DNS: %v", err)
+		}
+	}
+
+	if err := publishNodeDNS(conn, dnsMode, virNet, dnsConfig.ClusterName, dnsConfig.BaseDomain, nodes); err != nil {
+		return err
+	}
+
+	if dnsMode == dns.ModeLibvirt && libvirt.ConnIsRemote(conn) {
+		// The bridge is on the libvirt host; this host cannot forward queries to it
+		logging.Warn(fmt.Sprintf("Not forwarding %s.%s to the remote libvirt network; resolve it on the libvirt host", dnsConfig.ClusterName, dnsConfig.BaseDomain))
+	} else if dnsMode == dns.ModeLibvirt {
+		bridgeName, err := libvirt.GetLibvirtBridge(conn, virNet)
+		if err != nil {
+			return err
+		}
+		if err = dns.ForwardClusterDomain(dnsConfig, bridgeName); err != nil {
+			return fmt.Errorf("failed to forward cluster domain: %v", err)
+		}
+	} else if err := dns.ReloadDNS(dnsConfig); err != nil {
+		return fmt.Errorf("failed to restart DNS service: %v", err)
+	}
+	return nil
+}
+
+// writeHostsEntries merges the nodes into /etc/hosts.<cluster>, replacing any previous
+// entries for the same addresses.
+func writeHostsEntries(clusterName, baseDomain string, nodes []Node) error {
+	filePath := fmt.Sprintf("/etc/hosts.%s", clusterName)
+
+	planned := map[string]bool{}
+	for _, node := range nodes {
+		planned[node.IP] = true
+		if node.IPv6 != "" {
+			planned[node.IPv6] = true
+		}
+	}
+
+	var lines []string
+	f, err := os.Open(filePath)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 0 && !planned[fields[0]] {
+				lines = append(lines, scanner.Text())
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read hosts file: %v", err)
+	}
+
+	for _, node := range nodes {
+		lines = append(lines, hostsEntries(node, clusterName, baseDomain)...)
+	}
+
+	if err = os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write hosts file: %v", err)
+	}
+	logging.Info(fmt.Sprintf("Wrote %d host entries to %s", len(nodes), filePath))
+	return nil
+}
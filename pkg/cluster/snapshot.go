@@ -0,0 +1,246 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/logging"
+	"openshift-qemu/pkg/state"
+)
+
+// SnapshotParams holds the configuration for cluster snapshot operations.
+type SnapshotParams struct {
+	ClusterName     string
+	Name            string
+	OCPVersion      string        // recorded if the cluster state does not know the version
+	Shutdown        bool          // shut the VMs down first so etcd is consistent on disk
+	ShutdownTimeout time.Duration // per VM
+	URI             string        // libvirt connection URI
+}
+
+// CreateClusterSnapshot snapshots every VM of the cluster under the same name. If any VM
+// fails, the snapshots taken so far are deleted again.
+func CreateClusterSnapshot(ctx context.Context, params SnapshotParams) error {
+	st, err := loadClusterNodes(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	if st.Snapshot(params.Name) != nil {
+		return fmt.Errorf("snapshot %s of cluster %s already exists", params.Name, params.ClusterName)
+	}
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	snapshot := state.Snapshot{
+		Name:       params.Name,
+		CreatedAt:  time.Now().UTC(),
+		OCPVersion: st.OCPVersion,
+		Shutdown:   params.Shutdown,
+	}
+	if snapshot.OCPVersion == "" {
+		snapshot.OCPVersion = params.OCPVersion
+	}
+	for _, node := range st.Nodes {
+		// Check every VM up front rather than failing halfway through the cluster
+		if err = libvirt.CheckSnapshotDisks(conn, node.Name); err != nil {
+			return err
+		}
+		snapshot.Nodes = append(snapshot.Nodes, node.Name)
+		running, err := libvirt.IsVMRunning(conn, node.Name)
+		if err != nil {
+			return err
+		}
+		if running {
+			snapshot.Running = append(snapshot.Running, node.Name)
+		}
+	}
+
+	// NVRAM and TPM state live outside the disks and can only be copied consistently,
+	// and pflash firmware only snapshotted, while the VM is off
+	for _, node := range st.Nodes {
+		if node.HasFirmwareState() {
+			if err = libvirt.RequireLocal(params.URI, fmt.Sprintf("Saving the UEFI and TPM state of %s", node.Name)); err != nil {
+				return err
+			}
+		}
+		if node.HasFirmwareState() && !params.Shutdown {
+			logging.Warn(fmt.Sprintf("%s has UEFI or TPM state; shutting the cluster down for the snapshot", node.Name))
+			params.Shutdown = true
+			snapshot.Shutdown = true
+		}
+	}
+
+	if params.Shutdown {
+		// Bring stopped VMs back up however the snapshot ends
+		stopped, err := shutdownVMs(ctx, conn, snapshot.Running, params.ShutdownTimeout)
+		defer startVMs(conn, stopped)
+		if err != nil {
+			return err
+		}
+	}
+
+	description := fmt.Sprintf("openshift-qemu snapshot of cluster %s", params.ClusterName)
+	var taken []string
+	for _, name := range snapshot.Nodes {
+		logging.Info(fmt.Sprintf("Creating snapshot %s of %s", params.Name, name))
+		if err = libvirt.CreateSnapshot(conn, name, params.Name, description); err != nil {
+			for _, done := range taken {
+				if cleanupErr := libvirt.DeleteSnapshot(conn, done, params.Name); cleanupErr != nil {
+					logging.Warn(cleanupErr.Error())
+				}
+			}
+			return err
+		}
+		taken = append(taken, name)
+	}
+
+	for _, node := range st.Nodes {
+		if node.HasFirmwareState() {
+			if err = libvirt.SaveFirmwareState(conn, node.Name, node.NVRAM, node.TPM, firmwareStateTag(params.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	st.Snapshots = append(st.Snapshots, snapshot)
+	if err = st.Save(); err != nil {
+		return err
+	}
+	logging.Ok(fmt.Sprintf("Snapshot %s of %d VMs created", params.Name, len(snapshot.Nodes)))
+	return nil
+}
+
+// RevertClusterSnapshot reverts every VM in the snapshot. VMs that were running when the
+// snapshot was taken are running afterwards.
+func RevertClusterSnapshot(params SnapshotParams) error {
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	snapshot := st.Snapshot(params.Name)
+	if snapshot == nil {
+		return fmt.Errorf("cluster %s has no snapshot %s", params.ClusterName, params.Name)
+	}
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	running := map[string]bool{}
+	for _, name := range snapshot.Running {
+		running[name] = true
+	}
+	for _, name := range snapshot.Nodes {
+		logging.Info(fmt.Sprintf("Reverting %s to snapshot %s", name, params.Name))
+		node := st.Node(name)
+		if node == nil || !node.HasFirmwareState() {
+			if err = libvirt.RevertSnapshot(conn, name, params.Name, running[name]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Firmware state must be back in place before the VM boots again
+		if err = libvirt.RevertSnapshot(conn, name, params.Name, false); err != nil {
+			return err
+		}
+		if err = libvirt.RestoreFirmwareState(conn, name, node.NVRAM, node.TPM, firmwareStateTag(params.Name)); err != nil {
+			return err
+		}
+		if running[name] {
+			if err = libvirt.StartVM(conn, name); err != nil {
+				return err
+			}
+		}
+	}
+	logging.Ok(fmt.Sprintf("Cluster %s reverted to snapshot %s", params.ClusterName, params.Name))
+	return nil
+}
+
+// DeleteClusterSnapshot deletes the snapshot from every VM and forgets it.
+func DeleteClusterSnapshot(params SnapshotParams) error {
+	st, err := state.Load(params.ClusterName)
+	if err != nil {
+		return err
+	}
+	snapshot := st.Snapshot(params.Name)
+	if snapshot == nil {
+		return fmt.Errorf("cluster %s has no snapshot %s", params.ClusterName, params.Name)
+	}
+
+	conn, err := libvirt.NewLibvirtConnection(params.URI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, name := range snapshot.Nodes {
+		if err = libvirt.DeleteSnapshot(conn, name, params.Name); err != nil {
+			return err
+		}
+		if node := st.Node(name); node != nil && node.HasFirmwareState() {
+			if err = libvirt.DeleteFirmwareState(conn, name, node.NVRAM, node.TPM, firmwareStateTag(params.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	st.RemoveSnapshot(params.Name)
+	return st.Save()
+}
+
+// ListClusterSnapshots returns the snapshots recorded for the cluster.
+func ListClusterSnapshots(clusterName string) ([]state.Snapshot, error) {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return st.Snapshots, nil
+}
+
+// loadClusterNodes loads the cluster state and fails if no VMs are recorded in it.
+func loadClusterNodes(clusterName string) (*state.ClusterState, error) {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if len(st.Nodes) == 0 {
+		return nil, fmt.Errorf("no VMs recorded for cluster %s in %s", clusterName, state.Path(clusterName))
+	}
+	return st, nil
+}
+
+// firmwareStateTag is the suffix of NVRAM and TPM state copies saved with a snapshot.
+func firmwareStateTag(snapshotName string) string {
+	return "snapshot-" + snapshotName
+}
+
+// shutdownVMs gracefully shuts the VMs down one by one and returns those it stopped,
+// even when a later one fails.
+func shutdownVMs(ctx context.Context, conn libvirt.VirtConnection, names []string, timeout time.Duration) ([]string, error) {
+	var stopped []string
+	for _, name := range names {
+		logging.Info(fmt.Sprintf("Shutting down %s", name))
+		if err := libvirt.ShutdownVM(ctx, conn, name, timeout); err != nil {
+			return stopped, err
+		}
+		stopped = append(stopped, name)
+	}
+	return stopped, nil
+}
+
+// startVMs starts the VMs, logging failures instead of stopping at the first one.
+func startVMs(conn libvirt.VirtConnection, names []string) {
+	for _, name := range names {
+		if err := libvirt.StartVM(conn, name); err != nil {
+			logging.Warn(err.Error())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"openshift-qemu/pkg/libvirt"
+	"openshift-qemu/pkg/state"
+)
+
+// Status is what libvirt and the cluster state know about a cluster.
+type Status struct {
+	Domains  []libvirt.OwnedDomain
+	Networks []libvirt.OwnedNetwork
+	State    *state.ClusterState
+}
+
+// ClusterStatus finds the VMs and networks owned by a cluster through their metadata, or
+// those of every cluster when clusterName is empty. Networks of libvirt hosts that drop
+// network metadata are found through the cluster state.
+func ClusterStatus(clusterName, uri string) (*Status, error) {
+	conn, err := libvirt.NewLibvirtConnection(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	names := []string{clusterName}
+	if clusterName == "" {
+		if names, err = state.List(); err != nil {
+			return nil, err
+		}
+	}
+	var states []*state.ClusterState
+	for _, name := range names {
+		st, err := state.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+
+	status := &Status{}
+	if status.Domains, err = libvirt.ListClusterDomains(conn, clusterName); err != nil {
+		return nil, err
+	}
+	if status.Networks, err = libvirt.ListClusterNetworks(conn, clusterName, createdNetworks(states)); err != nil {
+		return nil, err
+	}
+	if clusterName != "" {
+		status.State = states[0]
+	}
+	return status, nil
+}
+
+// createdNetworks maps the networks the tool created for each cluster to the cluster.
+// Networks a cluster only uses, such as one passed with --libvirt-network, are left out.
+func createdNetworks(states []*state.ClusterState) map[string]string {
+	networks := map[string]string{}
+	for _, st := range states {
+		if st.Network != "" && st.NetworkCreated {
+			networks[st.Network] = st.Name
+		}
+	}
+	return networks
+}
+
+// RecordNetwork stores the network of a cluster in its state, noting whether it was
+// created for the cluster so destroy may remove it even without network metadata.
+func RecordNetwork(clusterName string, network *libvirt.NetworkInfo) error {
+	st, err := state.Load(clusterName)
+	if err != nil {
+		return err
+	}
+	setNetwork(st, network.Name)
+	st.NetworkCreated = st.NetworkCreated || network.Created
+	return st.Save()
+}
+
+// setNetwork points the state at a network, forgetting that the previous one was created
+// for the cluster when it changes.
+func setNetwork(st *state.ClusterState, virNet string) {
+	if st.Network != virNet {
+		st.NetworkCreated = false
+	}
+	st.Network = virNet
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"openshift-qemu/pkg/libvirt"
+)
+
+// TuningSpec declares the placement and disk modes of every node of a role.
+type TuningSpec struct {
+	Role        string
+	CPUSet      []int // host CPUs handed out in node order, one per vCPU
+	EmulatorSet []int // host CPUs of the emulator threads of every node of the role
+	NUMANode    string
+	HugePageKiB uint
+	Cache       string
+	IO          string
+	Discard     string
+}
+
+// ParseTuningSpec parses a tuning declaration such as
+// role=master,cpuset=2-13,emulatorset=0-1,numa=0,hugepages=1G,cache=none,io=native,discard=unmap.
+func ParseTuningSpec(spec string) (TuningSpec, error) {
+	var t TuningSpec
+	prev := ""
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok && (prev == "cpuset" || prev == "emulatorset") {
+			// CPU sets contain commas: role=master,cpuset=2-5,8 keeps 8 in the set
+			key, value = prev, strings.TrimSpace(field)
+		} else if !ok {
+			return t, fmt.Errorf("invalid tuning field %q in %q (expected key=value)", field, spec)
+		}
+		prev = key
+		var err error
+		switch key {
+		case "role":
+			t.Role = value
+		case "cpuset":
+			var cpus []int
+			cpus, err = libvirt.ParseCPUSet(value)
+			t.CPUSet = append(t.CPUSet, cpus...)
+		case "emulatorset":
+			var cpus []int
+			cpus, err = libvirt.ParseCPUSet(value)
+			t.EmulatorSet = append(t.EmulatorSet, cpus...)
+		case "numa":
+			if _, err = strconv.ParseUint(value, 10, 16); err == nil {
+				t.NUMANode = value
+			}
+		case "hugepages":
+			t.HugePageKiB, err = parsePageSize(value)
+		case "cache":
+			t.Cache = value
+		case "io":
+			t.IO = value
+		case "discard":
+			t.Discard = value
+		default:
+			return t, fmt.Errorf("unknown tuning field %q in %q", key, spec)
+		}
+		if err != nil {
+			return t, fmt.Errorf("invalid %s in tuning %q: %v", key, spec, err)
+		}
+	}
+
+	switch t.Role {
+	case RoleLB, RoleBootstrap, RoleMaster, RoleWorker:
+	default:
+		return t, fmt.Errorf("unknown role %q in tuning %q", t.Role, spec)
+	}
+	return t, libvirt.ValidateDiskTuning(t.tuning(nil))
+}
+
+// parsePageSize parses a huge page size such as 2M or 1G into KiB.
+func parsePageSize(value string) (uint, error) {
+	units := map[string]uint64{"K": 1, "M": 1024, "G": 1024 * 1024}
+	value = strings.TrimSuffix(strings.ToUpper(value), "B")
+	if value == "" {
+		return 0, fmt.Errorf("empty page size")
+	}
+	unit, ok := units[value[len(value)-1:]]
+	if !ok {
+		return 0, fmt.Errorf("page size %q needs a K, M or G suffix", value)
+	}
+	size, err := strconv.ParseUint(value[:len(value)-1], 10, 32)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("invalid page size %q", value)
+	}
+	return uint(size * unit), nil
+}
+
+// tuning returns the libvirt tuning of a node pinned to vcpuPins.
+func (t TuningSpec) tuning(vcpuPins []int) libvirt.Tuning {
+	return libvirt.Tuning{
+		VCPUPins:     vcpuPins,
+		EmulatorPins: t.EmulatorSet,
+		NUMANode:     t.NUMANode,
+		HugePageKiB:  t.HugePageKiB,
+		Cache:        t.Cache,
+		IO:           t.IO,
+		Discard:      t.Discard,
+	}
+}
+
+// nodeSize returns the memory in MiB and vCPUs of a node.
+type nodeSize func(role string) (memory, cpus int)
+
+// applyTuning sets the tuning of each node from the spec of its role and checks the
+// result against the host topology. Each node of a role gets the next vCPU-sized slice
+// of the role's CPU set, so nodes of a role never share a CPU.
+func applyTuning(conn libvirt.VirtConnection, nodes []Node, specs []TuningSpec, size nodeSize) ([]Node, error) {
+	if len(specs) == 0 {
+		return nodes, nil
+	}
+
+	byRole := map[string]TuningSpec{}
+	for _, spec := range specs {
+		if _, ok := byRole[spec.Role]; ok {
+			return nil, fmt.Errorf("role %s is tuned more than once", spec.Role)
+		}
+		byRole[spec.Role] = spec
+	}
+
+	next := map[string]int{}
+	var vms []libvirt.TunedVM
+	for i, node := range nodes {
+		spec, ok := byRole[node.Role]
+		if !ok {
+			continue
+		}
+		memory, cpus := size(node.Role)
+		var pins []int
+		if len(spec.CPUSet) > 0 {
+			start := next[node.Role]
+			if start+cpus > len(spec.CPUSet) {
+				return nil, fmt.Errorf("CPU set of role %s has %d CPUs, too few to pin %d vCPUs for %s", node.Role, len(spec.CPUSet), cpus, node.Name)
+			}
+			pins = spec.CPUSet[start : start+cpus]
+			next[node.Role] = start + cpus
+		}
+		nodes[i].Tuning = spec.tuning(pins)
+		vms = append(vms, libvirt.TunedVM{Name: node.Name, MemoryMiB: uint(memory), Tuning: nodes[i].Tuning})
+	}
+
+	topology, err := libvirt.GetHostTopology(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err = topology.Validate(vms); err != nil {
+		return nil, fmt.Errorf("tuning does not fit the host: %v", err)
+	}
+	return nodes, nil
+}
@@ -1,9 +1,11 @@
 package dns
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -12,6 +14,12 @@ import (
 	"openshift-qemu/pkg/systemd"
 )
 
+// DNS modes select where cluster records are published.
+const (
+	ModeHost    = "host"    // /etc/hosts.<cluster> served by the host dnsmasq
+	ModeLibvirt = "libvirt" // <dns> records of the libvirt network's own dnsmasq
+)
+
 // DNSConfig holds relevant information for DNS setup and checks.
 type DNSConfig struct {
 	ClusterName string
@@ -39,6 +47,42 @@ func ReloadDNS(dnsConfig DNSConfig) error {
 	return nil
 }
 
+// ForwardClusterDomain points the host resolver at the libvirt network's dnsmasq for the
+// cluster domain. With systemd-resolved the route is set on the bridge link at runtime;
+// otherwise a server= snippet is written to the DNS directory and the DNS service is only
+// reloaded when the snippet changed.
+func ForwardClusterDomain(dnsConfig DNSConfig, bridgeName string) error {
+	clusterDomain := fmt.Sprintf("%s.%s", dnsConfig.ClusterName, dnsConfig.BaseDomain)
+
+	if exec.Command("systemctl", "is-active", "--quiet", "systemd-resolved").Run() == nil {
+		if out, err := exec.Command("resolvectl", "dns", bridgeName, dnsConfig.LibvirtGwIP).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set DNS server on %s: %v: %s", bridgeName, err, out)
+		}
+		if out, err := exec.Command("resolvectl", "domain", bridgeName, "~"+clusterDomain).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set DNS domain on %s: %v: %s", bridgeName, err, out)
+		}
+		logging.Info(fmt.Sprintf("Forwarding %s to %s via systemd-resolved", clusterDomain, dnsConfig.LibvirtGwIP))
+		return nil
+	}
+
+	content := []byte(fmt.Sprintf("server=/%s/%s\n", clusterDomain, dnsConfig.LibvirtGwIP))
+	snippet := filepath.Join(dnsConfig.DNSDir, dnsConfig.ClusterName+".conf")
+	if current, err := os.ReadFile(snippet); err == nil && bytes.Equal(current, content) {
+		logging.Info(fmt.Sprintf("%s already forwarded to %s", clusterDomain, dnsConfig.LibvirtGwIP))
+		return nil
+	}
+	if err := os.WriteFile(snippet, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", snippet, err)
+	}
+
+	dnsService := &systemd.Systemd{Name: dnsConfig.DNSSvc}
+	if err := dnsService.Reload(); err != nil {
+		return fmt.Errorf("failed to reload DNS service %s: %w", dnsConfig.DNSSvc, err)
+	}
+	logging.Info(fmt.Sprintf("Forwarding %s to %s via %s", clusterDomain, dnsConfig.LibvirtGwIP, snippet))
+	return nil
+}
+
 // Cleanup removes temporary DNS test files and reloads DNS services.
 func Cleanup(dnsDir string) error {
 	filesToRemove := []string{
@@ -0,0 +1,445 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"openshift-qemu/pkg/logging"
+)
+
+// Results of a health check, named like the HAProxy ones the status output mimics.
+const (
+	checkInit    = "INI"
+	checkOK      = "L4OK"
+	checkTimeout = "L4TOUT"
+	checkRefused = "L4CON"
+)
+
+// A server changes state after this many checks in a row disagree with it, as with
+// the HAProxy defaults.
+const (
+	rise = 2
+	fall = 3
+)
+
+// Server is a backend server of a frontend.
+type Server struct {
+	Name     string
+	Address  string // host:port
+	Disabled bool   // in maintenance
+}
+
+// Frontend is a port the load balancer listens on and the servers it forwards to.
+type Frontend struct {
+	Name    string
+	Listen  []string // host:port, one per address family
+	Servers []Server
+}
+
+// Options tune the health checks and the connections to the servers.
+type Options struct {
+	CheckInterval  time.Duration
+	CheckTimeout   time.Duration
+	ConnectTimeout time.Duration
+}
+
+// DefaultOptions match the check and connect timeouts of haproxy.cfg.
+var DefaultOptions = Options{
+	CheckInterval:  5 * time.Second,
+	CheckTimeout:   2 * time.Second,
+	ConnectTimeout: 10 * time.Second,
+}
+
+// server is a backend server together with its health.
+type server struct {
+	Server
+	up      bool
+	checked bool   // checked at least once
+	streak  int    // checks in a row that disagree with up
+	check   string // result of the last health check
+}
+
+// frontend is a listening frontend and its servers.
+type frontend struct {
+	name      string
+	listen    []string
+	listeners []net.Listener
+	servers   []*server
+}
+
+// Balancer proxies the TCP connections of each frontend to its healthy servers.
+type Balancer struct {
+	opts      Options
+	mu        sync.Mutex
+	frontends map[string]*frontend
+	order     []string // frontend names in the order they were applied
+	checkNow  chan struct{}
+}
+
+// New returns a load balancer without frontends.
+func New(opts Options) *Balancer {
+	return &Balancer{opts: opts, frontends: map[string]*frontend{}, checkNow: make(chan struct{}, 1)}
+}
+
+// Apply listens on the ports of the frontends and routes them to their servers. Frontends
+// no longer listed stop listening. Servers kept at the same address keep their health;
+// their maintenance state is taken from the frontends, as HAProxy does on reload.
+func (b *Balancer) Apply(frontends []Frontend) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keep := map[string]bool{}
+	b.order = nil
+	for _, f := range frontends {
+		keep[f.Name] = true
+		b.order = append(b.order, f.Name)
+		fe := b.frontends[f.Name]
+		var current []*server
+		if fe != nil {
+			current = fe.servers
+		}
+		if fe != nil && strings.Join(fe.listen, ",") != strings.Join(f.Listen, ",") {
+			fe.close()
+			fe = nil
+		}
+		if fe == nil {
+			fe = &frontend{name: f.Name, listen: f.Listen}
+			for _, addr := range f.Listen {
+				l, err := net.Listen("tcp", addr)
+				if err != nil {
+					fe.close()
+					delete(b.frontends, f.Name)
+					return fmt.Errorf("failed to listen on %s: %v", addr, err)
+				}
+				fe.listeners = append(fe.listeners, l)
+				go b.accept(fe, l)
+			}
+			b.frontends[f.Name] = fe
+		}
+		fe.servers = mergeServers(current, f.Servers)
+	}
+	for name, fe := range b.frontends {
+		if !keep[name] {
+			fe.close()
+			delete(b.frontends, name)
+		}
+	}
+
+	// Check new servers right away instead of leaving them down for an interval
+	select {
+	case b.checkNow <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// mergeServers returns the servers to use, carrying over the health of the current ones.
+func mergeServers(current []*server, servers []Server) []*server {
+	merged := make([]*server, 0, len(servers))
+	for _, s := range servers {
+		next := &server{Server: s, check: checkInit}
+		for _, c := range current {
+			if c.Name == s.Name && c.Address == s.Address {
+				next.up, next.checked, next.streak, next.check = c.up, c.checked, c.streak, c.check
+			}
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// close stops listening on the ports of the frontend. Open connections are kept.
+func (fe *frontend) close() {
+	for _, l := range fe.listeners {
+		l.Close()
+	}
+}
+
+// Close stops listening on every frontend.
+func (b *Balancer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fe := range b.frontends {
+		fe.close()
+	}
+}
+
+// accept hands the connections of a listener to the servers of its frontend.
+func (b *Balancer) accept(fe *frontend, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logging.Warn(fmt.Sprintf("%s: failed to accept a connection: %v", fe.name, err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go b.forward(fe, conn)
+	}
+}
+
+// forward connects a client to a healthy server of the frontend. Servers are tried in an
+// order picked from the client address, so a client sticks to one server like with
+// "balance source", and the next one is tried when a server cannot be reached.
+func (b *Balancer) forward(fe *frontend, client net.Conn) {
+	defer client.Close()
+	for _, addr := range b.candidates(fe, client.RemoteAddr()) {
+		upstream, err := net.DialTimeout("tcp", addr, b.opts.ConnectTimeout)
+		if err != nil {
+			continue
+		}
+		defer upstream.Close()
+		splice(client, upstream)
+		return
+	}
+}
+
+// candidates returns the addresses of the usable servers of a frontend, starting with
+// the one the client address hashes to.
+func (b *Balancer) candidates(fe *frontend, client net.Addr) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []string
+	for _, s := range fe.servers {
+		if s.up && !s.Disabled {
+			addrs = append(addrs, s.Address)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		host = client.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	start := int(h.Sum32() % uint32(len(addrs)))
+	return append(addrs[start:], addrs[:start]...)
+}
+
+// splice copies data both ways until both sides are done, passing on half-closes.
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
+
+// Run checks the health of the servers until the context ends.
+func (b *Balancer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		b.checkAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.checkNow:
+		}
+	}
+}
+
+// checkAll opens a TCP connection to every server at once and records the results.
+func (b *Balancer) checkAll() {
+	type target struct {
+		frontend string
+		server   *server
+		address  string
+	}
+	b.mu.Lock()
+	var targets []target
+	for _, fe := range b.frontends {
+		for _, s := range fe.servers {
+			targets = append(targets, target{fe.name, s, s.Address})
+		}
+	}
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			result := probe(t.address, b.opts.CheckTimeout)
+			b.mu.Lock()
+			t.server.record(t.frontend, result)
+			b.mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+}
+
+// probe connects to a server and returns the check result.
+func probe(addr string, timeout time.Duration) string {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err == nil {
+		conn.Close()
+		return checkOK
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return checkTimeout
+	}
+	return checkRefused
+}
+
+// record updates the health of a server with a check result. The first check decides
+// on its own; later ones flip the server after rise or fall checks in a row.
+func (s *server) record(frontend, result string) {
+	s.check = result
+	ok := result == checkOK
+	if ok == s.up {
+		s.streak = 0
+		s.checked = true
+		return
+	}
+	s.streak++
+	need := fall
+	if ok {
+		need = rise
+	}
+	if s.checked && s.streak < need {
+		return
+	}
+	s.up, s.streak, s.checked = ok, 0, true
+	if ok {
+		logging.Info(fmt.Sprintf("Server %s/%s is UP", frontend, s.Name))
+	} else {
+		logging.Warn(fmt.Sprintf("Server %s/%s is DOWN (%s)", frontend, s.Name, result))
+	}
+}
+
+// ServeRuntime answers the part of the HAProxy runtime API the lb commands use on a unix
+// socket: "show stat", "disable server" and "enable server", separated by semicolons.
+// Servers disabled here stay disabled until the next Apply.
+func (b *Balancer) ServeRuntime(ctx context.Context, socket string) error {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", socket, err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socket, err)
+	}
+	if err = os.Chmod(socket, 0o600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to restrict access to %s: %v", socket, err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("runtime API failed: %v", err)
+		}
+		go b.answer(conn)
+	}
+}
+
+// answer runs the commands of one runtime API request.
+func (b *Balancer) answer(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	var out strings.Builder
+	for _, command := range strings.Split(line, ";") {
+		out.WriteString(b.runtime(strings.Fields(command)))
+	}
+	io.WriteString(conn, out.String())
+}
+
+// runtime runs a runtime API command and returns its answer. Like HAProxy, commands
+// that succeed answer with an empty line.
+func (b *Balancer) runtime(command []string) string {
+	switch {
+	case len(command) == 2 && command[0] == "show" && command[1] == "stat":
+		return b.stat()
+	case len(command) == 3 && (command[0] == "disable" || command[0] == "enable") && command[1] == "server":
+		return b.setDisabled(command[2], command[0] == "disable")
+	}
+	return "Unknown command.\n"
+}
+
+// stat returns the health of the frontends and servers as the columns of "show stat"
+// that the lb commands read.
+func (b *Balancer) stat() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out strings.Builder
+	out.WriteString("# pxname,svname,status,check_status,weight\n")
+	for _, name := range b.order {
+		fe := b.frontends[name]
+		if fe == nil {
+			continue
+		}
+		active := 0
+		for _, s := range fe.servers {
+			status := "DOWN"
+			switch {
+			case s.Disabled:
+				status = "MAINT"
+			case s.up:
+				status = "UP"
+				active++
+			}
+			fmt.Fprintf(&out, "%s,%s,%s,%s,1\n", fe.name, s.Name, status, s.check)
+		}
+		status := "DOWN"
+		if active > 0 {
+			status = "UP"
+		}
+		fmt.Fprintf(&out, "%s,BACKEND,%s,,%d\n", fe.name, status, active)
+	}
+	out.WriteString("\n")
+	return out.String()
+}
+
+// setDisabled puts a server given as frontend/server into maintenance or takes it out.
+func (b *Balancer) setDisabled(ref string, disabled bool) string {
+	name, serverName, ok := strings.Cut(ref, "/")
+	if !ok {
+		return "Require 'backend/server'.\n"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if fe := b.frontends[name]; fe != nil {
+		for _, s := range fe.servers {
+			if s.Name == serverName {
+				s.Disabled = disabled
+				return "\n"
+			}
+		}
+	}
+	return "No such server.\n"
+}
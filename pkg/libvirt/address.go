@@ -0,0 +1,56 @@
+package libvirt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// macPrefix is the locally administered OUI used by QEMU/KVM guests.
+const macPrefix = "52:54:00"
+
+// Dynamic DHCPv6 range of networks created by this tool. Reserved node
+// addresses use lower host offsets and never collide with it.
+const (
+	ipv6RangeStart = 0x1000
+	ipv6RangeEnd   = 0x1fff
+)
+
+// GenerateMAC returns a stable MAC address for a node of the given cluster.
+// The same cluster and node name always produce the same address, so DHCP
+// reservations can be written before the domain is defined.
+func GenerateMAC(clusterName, nodeName string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", clusterName, nodeName)))
+	return fmt.Sprintf("%s:%02x:%02x:%02x", macPrefix, sum[0], sum[1], sum[2])
+}
+
+// HostIP returns the address at the given host offset inside a network,
+// e.g. offset 10 in 192.168.122.0/24 is 192.168.122.10.
+func HostIP(network *net.IPNet, offset int) (string, error) {
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	// The network and broadcast addresses are never handed out
+	if offset <= 0 || big.NewInt(int64(offset)).Cmp(new(big.Int).Sub(size, big.NewInt(1))) >= 0 {
+		return "", fmt.Errorf("host offset %d does not fit in network %s", offset, network.String())
+	}
+
+	base := network.IP.Mask(network.Mask)
+	ip := new(big.Int).Add(new(big.Int).SetBytes(base), big.NewInt(int64(offset)))
+	ipBytes := ip.Bytes()
+
+	// Left-pad to the original address length
+	addr := make(net.IP, len(base))
+	copy(addr[len(addr)-len(ipBytes):], ipBytes)
+	return addr.String(), nil
+}
+
+// GenerateULASubnet returns a stable unique local IPv6 /64 (fd00::/8) for the cluster,
+// using the cluster name as the global ID.
+func GenerateULASubnet(clusterName string) *net.IPNet {
+	sum := sha256.Sum256([]byte(clusterName))
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	copy(ip[1:6], sum[:5])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+}
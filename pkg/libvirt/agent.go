@@ -0,0 +1,201 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// agentTimeout is how long a single guest agent command may take, in seconds.
+const agentTimeout = 10
+
+// agentChannelXML is the virtio-serial channel qemu-guest-agent listens on. libvirt picks
+// the host socket path itself.
+const agentChannelXML = `
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>`
+
+// agentCommand sends a QMP command to the guest agent and decodes the "return" member of
+// the reply into result, if given.
+func agentCommand(dom *libvirt.Domain, command string, arguments interface{}, result interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode guest agent command %s: %v", command, err)
+	}
+	reply, err := dom.QemuAgentCommand(string(data), libvirt.DomainQemuAgentCommandTimeout(agentTimeout), 0)
+	if err != nil {
+		return fmt.Errorf("guest agent command %s failed: %v", command, err)
+	}
+	if result == nil {
+		return nil
+	}
+	var envelope struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err = json.Unmarshal([]byte(reply), &envelope); err != nil {
+		return fmt.Errorf("failed to parse guest agent reply to %s: %v", command, err)
+	}
+	if err = json.Unmarshal(envelope.Return, result); err != nil {
+		return fmt.Errorf("failed to parse guest agent reply to %s: %v", command, err)
+	}
+	return nil
+}
+
+// AgentAvailable reports whether the guest agent of a running VM answers.
+func AgentAvailable(conn *libvirt.Connect, vmName string) bool {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return false
+	}
+	defer dom.Free()
+	return agentCommand(dom, "guest-ping", nil, nil) == nil
+}
+
+// GuestExecResult is the outcome of a command run through the guest agent.
+type GuestExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// GuestExec runs a shell command in the VM through the guest agent and waits for it to
+// exit. It needs no network access to the guest, only a running agent.
+func GuestExec(ctx context.Context, conn *libvirt.Connect, vmName, command string) (*GuestExecResult, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	var started struct {
+		PID int `json:"pid"`
+	}
+	args := map[string]interface{}{"path": "/bin/sh", "arg": []string{"-c", command}, "capture-output": true}
+	if err = agentCommand(dom, "guest-exec", args, &started); err != nil {
+		return nil, fmt.Errorf("failed to run command in %s: %v", vmName, err)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var status struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			OutData  string `json:"out-data"`
+			ErrData  string `json:"err-data"`
+		}
+		if err = agentCommand(dom, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, fmt.Errorf("failed to get status of command in %s: %v", vmName, err)
+		}
+		if status.Exited {
+			stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+			stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+			return &GuestExecResult{ExitCode: status.ExitCode, Stdout: string(stdout), Stderr: string(stderr)}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("command in %s did not finish: %v", vmName, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// GuestAccess is how to reach a VM to run commands in it.
+type GuestAccess struct {
+	VMName     string
+	IP         string
+	SSHKeyPath string
+	SSHUser    string
+}
+
+// RunInGuest runs a shell command in the VM over SSH, falling back to the guest agent
+// when SSH is not reachable yet, e.g. while sshd is still starting or the network is
+// misconfigured. It returns the standard output. Whether SSH connects is probed first:
+// the command may not be safe to run twice, and its own exit code can be 255 like ssh's.
+func RunInGuest(ctx context.Context, conn *libvirt.Connect, access GuestAccess, command string) (string, error) {
+	if access.IP != "" {
+		var stderr bytes.Buffer
+		probe := access.ssh(ctx, "true")
+		probe.Stderr = &stderr
+		if err := probe.Run(); err == nil {
+			var stdout bytes.Buffer
+			cmd := access.ssh(ctx, command)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err = cmd.Run(); err != nil {
+				return stdout.String(), fmt.Errorf("command failed in %s: %v\nOutput: %s", access.VMName, err, stderr.String())
+			}
+			return stdout.String(), nil
+		}
+		logging.Warn(fmt.Sprintf("SSH to %s failed, using the guest agent: %s", access.VMName, strings.TrimSpace(stderr.String())))
+	}
+
+	result, err := GuestExec(ctx, conn, access.VMName, command)
+	if err != nil {
+		return "", err
+	}
+	if result.ExitCode != 0 {
+		return result.Stdout, fmt.Errorf("command failed in %s with exit code %d\nOutput: %s", access.VMName, result.ExitCode, result.Stderr)
+	}
+	return result.Stdout, nil
+}
+
+// ssh returns the command running a shell command in the VM over SSH.
+func (a GuestAccess) ssh(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh", "-i", a.SSHKeyPath, "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10",
+		fmt.Sprintf("%s@%s", a.SSHUser, a.IP), command)
+}
+
+// sshdState asks the guest agent whether sshd runs, to tell why SSH is not reachable.
+// It returns nothing when the agent does not answer.
+func sshdState(ctx context.Context, conn *libvirt.Connect, vmName string) string {
+	if conn == nil || !AgentAvailable(conn, vmName) {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, agentTimeout*time.Second)
+	defer cancel()
+	result, err := GuestExec(ctx, conn, vmName, "systemctl is-active sshd")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(result.Stdout)
+}
+
+// freezeFilesystems flushes and freezes the guest filesystems of a running VM and returns
+// a function thawing them. Without a guest agent nothing is frozen and a warning is logged.
+func freezeFilesystems(dom *libvirt.Domain, vmName string) func() {
+	if err := dom.FSFreeze(nil, 0); err != nil {
+		logging.Warn(fmt.Sprintf("Could not freeze the filesystems of %s, snapshotting without: %v", vmName, err))
+		return func() {}
+	}
+	return func() {
+		if err := dom.FSThaw(nil, 0); err != nil {
+			logging.Warn(fmt.Sprintf("Failed to thaw the filesystems of %s: %v", vmName, err))
+		}
+	}
+}
+
+// thawIfFrozen thaws the guest filesystems if the agent reports them frozen, as they are
+// after reverting to a snapshot taken with them frozen.
+func thawIfFrozen(dom *libvirt.Domain, vmName string) {
+	var status string
+	if err := agentCommand(dom, "guest-fsfreeze-status", nil, &status); err != nil || status != "frozen" {
+		return
+	}
+	if err := dom.FSThaw(nil, 0); err != nil {
+		logging.Warn(fmt.Sprintf("Failed to thaw the filesystems of %s: %v", vmName, err))
+	}
+}
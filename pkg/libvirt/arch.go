@@ -0,0 +1,64 @@
+package libvirt
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Guest architectures, named as in libvirt and the OpenShift mirrors.
+const (
+	ArchX86_64  = "x86_64"
+	ArchAArch64 = "aarch64"
+)
+
+// HostArch returns the architecture this binary was built for, which is the host's.
+func HostArch() string {
+	if runtime.GOARCH == "arm64" {
+		return ArchAArch64
+	}
+	return ArchX86_64
+}
+
+// ValidateArch checks a guest architecture and whether the firmware can boot it.
+// aarch64 guests always boot AAVMF (UEFI) and have no SMM for Secure Boot.
+func ValidateArch(arch, firmware string) error {
+	switch arch {
+	case ArchX86_64:
+		return nil
+	case ArchAArch64:
+		if firmware == FirmwareUEFISecure {
+			return fmt.Errorf("firmware %s is not supported on %s", firmware, arch)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported architecture %q (expected %s or %s)", arch, ArchX86_64, ArchAArch64)
+}
+
+// machineType returns the machine type alias for guests of the architecture. libvirt
+// expands it to the newest versioned type when the domain is defined.
+func machineType(arch string) string {
+	if arch == ArchAArch64 {
+		return "virt"
+	}
+	return "q35"
+}
+
+// archFeaturesXML returns the architecture specific <features>: the x86 APIC or the ARM GIC.
+func archFeaturesXML(arch string) string {
+	if arch == ArchAArch64 {
+		return "\n    <gic version='host'/>"
+	}
+	return "\n    <apic/>"
+}
+
+// archDevicesXML returns devices a guest of the architecture lacks by default. The ARM
+// virt machine has no emulated VGA, so VNC needs a virtio GPU.
+func archDevicesXML(arch string) string {
+	if arch == ArchAArch64 {
+		return `
+    <video>
+      <model type='virtio'/>
+    </video>`
+	}
+	return ""
+}
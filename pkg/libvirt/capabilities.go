@@ -0,0 +1,144 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"libvirt.org/go/libvirt"
+)
+
+// CPU modes of a VM.
+const (
+	CPUHostPassthrough = "host-passthrough" // expose the host CPU as is
+	CPUHostModel       = "host-model"       // closest named model, for hosts that cannot pass through
+)
+
+// HostCaps is what the hypervisor supports for guests of one architecture.
+type HostCaps struct {
+	Arch            string
+	MachineType     string   // newest q35 or virt machine type, e.g. pc-q35-8.2
+	Firmware        []string // supported Firmware* values
+	HostPassthrough bool
+}
+
+// Machine is the machine type and CPU mode chosen for the VMs of a cluster.
+type Machine struct {
+	Arch        string
+	MachineType string
+	CPUMode     string
+}
+
+type capsEnum struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"value"`
+}
+
+// GetHostCaps queries the domain capabilities of KVM guests of the architecture. Asking for
+// the q35 or virt alias makes libvirt resolve it to the newest versioned machine type
+// of the installed QEMU, whatever the distribution calls it.
+func GetHostCaps(conn *libvirt.Connect, arch string) (*HostCaps, error) {
+	capsXML, err := conn.GetDomainCapabilities("", arch, machineType(arch), "kvm", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain capabilities for %s: %v", arch, err)
+	}
+
+	var def struct {
+		Machine string `xml:"machine"`
+		OS      struct {
+			Enums  []capsEnum `xml:"enum"`
+			Loader struct {
+				Supported string     `xml:"supported,attr"`
+				Enums     []capsEnum `xml:"enum"`
+			} `xml:"loader"`
+		} `xml:"os"`
+		CPU struct {
+			Modes []struct {
+				Name      string `xml:"name,attr"`
+				Supported string `xml:"supported,attr"`
+			} `xml:"mode"`
+		} `xml:"cpu"`
+	}
+	if err = xml.Unmarshal([]byte(capsXML), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain capabilities: %v", err)
+	}
+
+	caps := &HostCaps{Arch: arch, MachineType: def.Machine}
+	for _, mode := range def.CPU.Modes {
+		if mode.Name == CPUHostPassthrough && mode.Supported == "yes" {
+			caps.HostPassthrough = true
+		}
+	}
+
+	// Older libvirt has no firmware enum; fall back to what the loader supports
+	bios, uefi := arch == ArchX86_64, def.OS.Loader.Supported == "yes"
+	if values, ok := enumValues(def.OS.Enums, "firmware"); ok {
+		bios, uefi = containsString(values, "bios"), containsString(values, "efi")
+	}
+	secure, _ := enumValues(def.OS.Loader.Enums, "secure")
+	if bios {
+		caps.Firmware = append(caps.Firmware, FirmwareBIOS)
+	}
+	if uefi {
+		caps.Firmware = append(caps.Firmware, FirmwareUEFI)
+		if containsString(secure, "yes") && ValidateArch(arch, FirmwareUEFISecure) == nil {
+			caps.Firmware = append(caps.Firmware, FirmwareUEFISecure)
+		}
+	}
+	return caps, nil
+}
+
+// enumValues returns the values of the named enum, and whether it is present.
+func enumValues(enums []capsEnum, name string) ([]string, bool) {
+	for _, enum := range enums {
+		if enum.Name == name {
+			return enum.Values, true
+		}
+	}
+	return nil, false
+}
+
+// ValidateFirmware checks that the host can boot guests with the firmware.
+func (c *HostCaps) ValidateFirmware(firmware string) error {
+	if !containsString(c.Firmware, firmware) {
+		return fmt.Errorf("firmware %s is not available for %s guests on this host (available: %v)", firmware, c.Arch, c.Firmware)
+	}
+	return nil
+}
+
+// SelectMachine picks the machine type and CPU mode of the VMs. Non-empty arguments
+// override the choice made from the capabilities.
+func (c *HostCaps) SelectMachine(machineType, cpuMode string) (Machine, error) {
+	m := Machine{Arch: c.Arch, MachineType: c.MachineType, CPUMode: CPUHostModel}
+	if c.HostPassthrough {
+		m.CPUMode = CPUHostPassthrough
+	}
+	if machineType != "" {
+		m.MachineType = machineType
+	}
+	if m.MachineType == "" {
+		return m, fmt.Errorf("no machine type available for %s guests", c.Arch)
+	}
+	switch cpuMode {
+	case "":
+	case CPUHostPassthrough:
+		if !c.HostPassthrough {
+			return m, fmt.Errorf("CPU mode %s is not supported on this host", cpuMode)
+		}
+		m.CPUMode = cpuMode
+	case CPUHostModel:
+		m.CPUMode = cpuMode
+	default:
+		return m, fmt.Errorf("unknown CPU mode %q (expected %s or %s)", cpuMode, CPUHostPassthrough, CPUHostModel)
+	}
+	return m, nil
+}
+
+// cpuXML renders the <cpu> element for the CPU mode, host-passthrough by default.
+func cpuXML(cpuMode string) string {
+	if cpuMode == "" {
+		cpuMode = CPUHostPassthrough
+	}
+	return fmt.Sprintf(`<cpu mode='%s'>
+    <model fallback='allow'/>
+  </cpu>`, cpuMode)
+}
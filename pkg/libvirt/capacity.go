@@ -0,0 +1,96 @@
+package libvirt
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"libvirt.org/go/libvirt"
+)
+
+// HostCapacity is the CPU and memory of the host and what running domains already use.
+type HostCapacity struct {
+	CPUs           uint
+	MemoryKiB      uint64
+	FreeMemoryKiB  uint64 // free, buffers and page cache
+	RunningDomains int
+	CommittedVCPUs uint   // vCPUs of running domains
+	CommittedKiB   uint64 // maximum memory of running domains
+}
+
+// GetHostCapacity reads the host size and adds up the vCPUs and memory of every running
+// domain. Free memory alone understates what is taken: guests that have not touched all
+// of their memory yet will.
+func GetHostCapacity(conn *libvirt.Connect) (*HostCapacity, error) {
+	info, err := conn.GetNodeInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host information: %v", err)
+	}
+	// MemFree leaves out the page cache, which the kernel hands back when guests need it;
+	// right after downloading the images that would make most hosts look full
+	stats, err := conn.GetMemoryStats(libvirt.NODE_MEMORY_STATS_ALL_CELLS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host memory statistics: %v", err)
+	}
+	c := &HostCapacity{CPUs: info.Cpus, MemoryKiB: info.Memory, FreeMemoryKiB: stats.Free + stats.Buffers + stats.Cached}
+
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running domains: %v", err)
+	}
+	for _, dom := range domains {
+		domInfo, err := dom.GetInfo()
+		dom.Free()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get domain information: %v", err)
+		}
+		c.RunningDomains++
+		c.CommittedVCPUs += domInfo.NrVirtCpu
+		c.CommittedKiB += domInfo.MaxMem
+	}
+	return c, nil
+}
+
+// PoolFreeBytes returns the space left in a storage pool.
+func PoolFreeBytes(conn *libvirt.Connect, poolName string) (uint64, error) {
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find storage pool %s: %v", poolName, err)
+	}
+	defer pool.Free()
+
+	info, err := pool.GetInfo()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get information of storage pool %s: %v", poolName, err)
+	}
+	return info.Available, nil
+}
+
+// PoolForDir returns the name of the storage pool whose target is the directory, or an
+// empty name when no pool has it as its target.
+func PoolForDir(conn *libvirt.Connect, dir string) (string, error) {
+	pool, err := conn.LookupStoragePoolByTargetPath(filepath.Clean(dir))
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_STORAGE_POOL {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to look up the storage pool of %s: %v", dir, err)
+	}
+	defer pool.Free()
+
+	name, err := pool.GetName()
+	if err != nil {
+		return "", fmt.Errorf("failed to get storage pool name: %v", err)
+	}
+	return name, nil
+}
+
+// DirFreeBytes returns the space left for unprivileged users on the filesystem holding a
+// local directory, for directories that are not the target of a storage pool.
+func DirFreeBytes(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, fmt.Errorf("failed to get free space of %s: %v", dir, err)
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,141 @@
+package libvirt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// consoleFailures are boot failures recognised in a serial console log, most specific first.
+// Only terminal messages count: Ignition logs every failed fetch attempt while it keeps
+// retrying, and gives up with "Ignition failed" only when the config cannot be had.
+var consoleFailures = []struct {
+	pattern *regexp.Regexp
+	reason  string
+}{
+	{regexp.MustCompile(`Ignition failed: .*(failed to fetch|error fetching|GET error)`), "Ignition could not fetch its config"},
+	{regexp.MustCompile(`Ignition failed|Failed to start .*Ignition`), "Ignition failed"},
+	{regexp.MustCompile(`Entering emergency mode|emergency shell|You are in emergency mode`), "the node dropped to the emergency shell"},
+	{regexp.MustCompile(`Kernel panic`), "the kernel panicked"},
+}
+
+// ConsoleError is returned when a VM's console log shows that it cannot finish booting.
+type ConsoleError struct {
+	VM     string
+	Reason string
+	Line   string
+	Log    string
+}
+
+func (e *ConsoleError) Error() string {
+	return fmt.Sprintf("VM %s failed to boot: %s (%q, see %s)", e.VM, e.Reason, e.Line, e.Log)
+}
+
+// ConsoleLogPath returns where the serial console of a VM is logged.
+func ConsoleLogPath(logDir, vmName string) string {
+	return filepath.Join(logDir, vmName+".console.log")
+}
+
+// ResetConsoleLog creates the log directory and drops the log of an earlier VM of the
+// same name, so its failures are not reported again.
+func ResetConsoleLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create console log directory: %v", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old console log %s: %v", path, err)
+	}
+	return nil
+}
+
+// consoleWatcher scans a console log for known boot failures, reading only what was
+// appended since the previous check.
+type consoleWatcher struct {
+	vm      string
+	path    string
+	offset  int64  // bytes already scanned
+	partial string // start of a line whose end has not been logged yet
+}
+
+// newConsoleWatcher returns a watcher for the console log of a VM. An empty path watches
+// nothing.
+func newConsoleWatcher(vmName, path string) *consoleWatcher {
+	return &consoleWatcher{vm: vmName, path: path}
+}
+
+// check scans what was appended to the log since the last call. A missing log is not an
+// error.
+func (w *consoleWatcher) check() error {
+	if w.path == "" {
+		return nil
+	}
+	f, err := os.Open(w.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	if info.Size() < w.offset {
+		// The log was reset for a new VM of the same name; start over
+		w.offset, w.partial = 0, ""
+	}
+	if _, err = f.Seek(w.offset, io.SeekStart); err != nil {
+		return nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	w.offset += int64(len(data))
+
+	// The unfinished last line is scanned too, and again once it is complete
+	lines := strings.Split(w.partial+string(data), "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines {
+		for _, failure := range consoleFailures {
+			if failure.pattern.MatchString(line) {
+				return &ConsoleError{VM: w.vm, Reason: failure.reason, Line: strings.TrimSpace(line), Log: w.path}
+			}
+		}
+	}
+	return nil
+}
+
+// serialXML returns a serial console, logged to a file when one is given. The log keeps
+// boot output even when nobody is attached.
+func serialXML(consoleLog string) string {
+	logXML := ""
+	if consoleLog != "" {
+		logXML = fmt.Sprintf("\n      <log file='%s' append='on'/>", consoleLog)
+	}
+	return fmt.Sprintf(`
+    <serial type='pty'>%s
+      <target port='0'/>
+    </serial>
+    <console type='pty'>
+      <target type='serial' port='0'/>
+    </console>`, logXML)
+}
+
+// AttachConsole connects the terminal to the serial console of a VM until the user
+// detaches with Ctrl+].
+func AttachConsole(uri, vmName string) error {
+	args := []string{"console", "--force", vmName}
+	if uri != "" {
+		args = append([]string{"-c", uri}, args...)
+	}
+	cmd := exec.Command("virsh", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to attach to the console of %s: %v", vmName, err)
+	}
+	return nil
+}
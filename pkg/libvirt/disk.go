@@ -0,0 +1,182 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// Buses an extra disk can be attached to.
+const (
+	DiskBusVirtio = "virtio" // /dev/disk/by-id/virtio-<serial>
+	DiskBusSCSI   = "scsi"   // /dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_<serial>
+)
+
+// maxVirtioSerial is the longest serial a virtio-blk disk reports to the guest.
+const maxVirtioSerial = 20
+
+// ExtraDisk is a data disk attached to a VM besides its root disk. It lives as a volume
+// in a storage pool so it can be listed and removed with the cluster.
+type ExtraDisk struct {
+	Pool   string
+	Volume string
+	SizeGB uint
+	Bus    string // DiskBusVirtio (default) or DiskBusSCSI
+	Serial string
+	Shared bool // raw, uncached and shareable, for disks attached to several VMs
+}
+
+// ValidateExtraDisk checks the bus and serial of a disk.
+func ValidateExtraDisk(disk ExtraDisk) error {
+	switch disk.Bus {
+	case "", DiskBusVirtio:
+		if len(disk.Serial) > maxVirtioSerial {
+			return fmt.Errorf("serial %q of disk %s is longer than %d characters", disk.Serial, disk.Volume, maxVirtioSerial)
+		}
+	case DiskBusSCSI:
+	default:
+		return fmt.Errorf("unknown bus %q for disk %s (expected %s or %s)", disk.Bus, disk.Volume, DiskBusVirtio, DiskBusSCSI)
+	}
+	if disk.SizeGB == 0 {
+		return fmt.Errorf("disk %s needs a size", disk.Volume)
+	}
+	return nil
+}
+
+// CreateVolume creates the volume of an extra disk. An existing shared volume is reused,
+// since every VM sharing it asks for it.
+func CreateVolume(conn *libvirt.Connect, disk ExtraDisk) error {
+	pool, err := conn.LookupStoragePoolByName(disk.Pool)
+	if err != nil {
+		return fmt.Errorf("failed to find storage pool %s: %v", disk.Pool, err)
+	}
+	defer pool.Free()
+
+	if vol, err := pool.LookupStorageVolByName(disk.Volume); err == nil {
+		vol.Free()
+		if disk.Shared {
+			return nil
+		}
+		return fmt.Errorf("volume %s already exists in pool %s", disk.Volume, disk.Pool)
+	}
+
+	format := "qcow2"
+	if disk.Shared {
+		format = "raw"
+	}
+	volXML := fmt.Sprintf(`
+<volume>
+  <name>%s</name>
+  <capacity unit='G'>%d</capacity>
+  <target>
+    <format type='%s'/>
+  </target>
+</volume>`, disk.Volume, disk.SizeGB, format)
+
+	vol, err := pool.StorageVolCreateXML(volXML, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create volume %s: %v", disk.Volume, err)
+	}
+	logging.Info(fmt.Sprintf("Created %dG volume %s/%s", disk.SizeGB, disk.Pool, disk.Volume))
+	return vol.Free()
+}
+
+// CreateRootDisk creates an empty qcow2 root disk in the storage pool of the directory
+// holding it, or with qemu-img when no pool has the directory as its target. A disk that
+// already exists is kept.
+func CreateRootDisk(conn *libvirt.Connect, path string, sizeGB uint) error {
+	poolName, err := PoolForDir(conn, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if poolName == "" {
+		return createRootDiskFile(conn, path, sizeGB)
+	}
+	disk := ExtraDisk{Pool: poolName, Volume: filepath.Base(path), SizeGB: sizeGB}
+	if vol, err := conn.LookupStorageVolByPath(path); err == nil {
+		vol.Free()
+		return nil
+	}
+	return CreateVolume(conn, disk)
+}
+
+// createRootDiskFile creates a root disk outside of any storage pool. The file is written
+// on this host, so the connection has to be local.
+func createRootDiskFile(conn *libvirt.Connect, path string, sizeGB uint) error {
+	if ConnIsRemote(conn) {
+		return fmt.Errorf("no storage pool has %s as its target; define one on the libvirt host to create disks over a remote connection", filepath.Dir(path))
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", path, fmt.Sprintf("%dG", sizeGB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create failed: %v\nOutput: %s", err, string(out))
+	}
+	logging.Info(fmt.Sprintf("Created %dG disk %s", sizeGB, path))
+	return nil
+}
+
+// DeleteVolume removes a volume. A volume that is already gone is not an error.
+func DeleteVolume(conn *libvirt.Connect, poolName, volume string) error {
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return fmt.Errorf("failed to find storage pool %s: %v", poolName, err)
+	}
+	defer pool.Free()
+
+	vol, err := pool.LookupStorageVolByName(volume)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_STORAGE_VOL {
+			return nil
+		}
+		return fmt.Errorf("failed to find volume %s: %v", volume, err)
+	}
+	defer vol.Free()
+
+	if err = vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+		return fmt.Errorf("failed to delete volume %s: %v", volume, err)
+	}
+	logging.Info(fmt.Sprintf("Deleted volume %s/%s", poolName, volume))
+	return nil
+}
+
+// extraDisksXML attaches the extra disks after the root disk (vda), with a virtio-scsi
+// controller when any of them is on the SCSI bus. Shared disks are never cached.
+func extraDisksXML(disks []ExtraDisk, tuning Tuning) string {
+	var b strings.Builder
+	virtio, scsi := 1, 0
+	for _, disk := range disks {
+		bus, dev := disk.Bus, ""
+		if bus == DiskBusSCSI {
+			dev = "sd" + string(rune('a'+scsi))
+			scsi++
+		} else {
+			bus, dev = DiskBusVirtio, "vd"+string(rune('a'+virtio))
+			virtio++
+		}
+		format, extra, driver := "qcow2", "", diskDriverAttrs(tuning, "none")
+		if disk.Shared {
+			shared := tuning
+			shared.Cache = ""
+			format, extra, driver = "raw", "\n      <shareable/>", diskDriverAttrs(shared, "none")
+		}
+		fmt.Fprintf(&b, `
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='%s'%s/>
+      <source pool='%s' volume='%s'/>
+      <target dev='%s' bus='%s'/>
+      <serial>%s</serial>%s
+    </disk>`, format, driver, disk.Pool, disk.Volume, dev, bus, disk.Serial, extra)
+	}
+	if scsi > 0 {
+		b.WriteString(`
+    <controller type='scsi' model='virtio-scsi'/>`)
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// dnsmasqNamespace is the libvirt XML namespace for passing raw options to the network's dnsmasq.
+const dnsmasqNamespace = "http://libvirt.org/schemas/network/dnsmasq/1.0"
+
+// DNSHost is a <host> entry in the DNS section of a libvirt network.
+type DNSHost struct {
+	IP        string   `xml:"ip,attr"`
+	Hostnames []string `xml:"hostname"`
+}
+
+// String renders the DNS host entry as libvirt network XML.
+func (h DNSHost) String() string {
+	out, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"host"`
+		DNSHost
+	}{DNSHost: h})
+	return string(out)
+}
+
+// ListNetworkDNSHosts returns the DNS host entries of a libvirt network
+func ListNetworkDNSHosts(conn *libvirt.Connect, networkName string) ([]DNSHost, error) {
+	def, err := getNetworkDef(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+	if def.DNS == nil {
+		return nil, nil
+	}
+	return def.DNS.Hosts, nil
+}
+
+// SetNetworkDNSHost publishes host names for an IP in the network's own dnsmasq, replacing any
+// previous entry for the same IP. The change is applied live, so no DNS service restart is needed.
+func SetNetworkDNSHost(conn *libvirt.Connect, networkName string, host DNSHost) error {
+	if _, err := RemoveNetworkDNSHost(conn, networkName, host.IP); err != nil {
+		return err
+	}
+
+	if err := updateNetworkSection(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, host.String()); err != nil {
+		return fmt.Errorf("failed to add DNS host %s: %v", host, err)
+	}
+	logging.Info(fmt.Sprintf("Added DNS record %s -> %s to network %s", strings.Join(host.Hostnames, ","), host.IP, networkName))
+	return nil
+}
+
+// RemoveNetworkDNSHost removes the DNS host entries of an IP and returns them
+func RemoveNetworkDNSHost(conn *libvirt.Connect, networkName, ip string) ([]DNSHost, error) {
+	hosts, err := ListNetworkDNSHosts(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []DNSHost
+	for _, host := range hosts {
+		if host.IP != ip {
+			continue
+		}
+		if err = updateNetworkSection(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, -1, host.String()); err != nil {
+			return nil, fmt.Errorf("failed to remove DNS host %s: %v", host, err)
+		}
+		removed = append(removed, host)
+	}
+	return removed, nil
+}
+
+// SetNetworkDNSOptions makes the network's dnsmasq authoritative for a domain and applies extra
+// dnsmasq options for it, such as a wildcard address. Options for the domain or its
+// subdomains that were set earlier are replaced. dnsmasq options cannot be updated live, so
+// an active network is restarted when they change; call this before any guest is attached
+// to the network.
+func SetNetworkDNSOptions(conn *libvirt.Connect, networkName, domain string, options []string) error {
+	network, err := conn.LookupNetworkByName(networkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	xmlDesc, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return fmt.Errorf("failed to get network XML description for %s: %v", networkName, err)
+	}
+
+	want := append([]string{fmt.Sprintf("local=/%s/", domain)}, options...)
+	stale := regexp.MustCompile(`\s*<dnsmasq:option value=['"]([^'"]*/(?:[^/'"]*\.)?` + regexp.QuoteMeta(domain) + `/[^'"]*)['"]\s*/>`)
+	if !sameStrings(domainOptions(stale, xmlDesc), want) {
+		// Drop options previously written for this domain
+		xmlDesc = stale.ReplaceAllString(xmlDesc, "")
+
+		optionsXML := ""
+		for _, option := range want {
+			optionsXML += fmt.Sprintf("\n    <dnsmasq:option value='%s'/>", option)
+		}
+
+		if strings.Contains(xmlDesc, "</dnsmasq:options>") {
+			xmlDesc = strings.Replace(xmlDesc, "</dnsmasq:options>", optionsXML+"\n  </dnsmasq:options>", 1)
+		} else {
+			xmlDesc = strings.Replace(xmlDesc, "</network>", "  <dnsmasq:options>"+optionsXML+"\n  </dnsmasq:options>\n</network>", 1)
+		}
+		if !strings.Contains(xmlDesc, dnsmasqNamespace) {
+			xmlDesc = strings.Replace(xmlDesc, "<network", fmt.Sprintf("<network xmlns:dnsmasq='%s'", dnsmasqNamespace), 1)
+		}
+
+		redefined, err := conn.NetworkDefineXML(xmlDesc)
+		if err != nil {
+			return fmt.Errorf("failed to redefine network %s: %v", networkName, err)
+		}
+		redefined.Free()
+	}
+
+	active, err := network.IsActive()
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %v", networkName, err)
+	}
+	if !active {
+		return nil
+	}
+	// The running dnsmasq may lag behind the definition, e.g. after an interrupted run
+	liveXML, err := network.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("failed to get network XML description for %s: %v", networkName, err)
+	}
+	if sameStrings(domainOptions(stale, liveXML), want) {
+		return nil
+	}
+	logging.Warn(fmt.Sprintf("Restarting libvirt network %s to apply dnsmasq options", networkName))
+	if err = network.Destroy(); err != nil {
+		return fmt.Errorf("failed to stop network %s: %v", networkName, err)
+	}
+	if err = network.Create(); err != nil {
+		return fmt.Errorf("failed to start network %s: %v", networkName, err)
+	}
+	return nil
+}
+
+// domainOptions returns the values of the dnsmasq options matched by pattern, in order.
+func domainOptions(pattern *regexp.Regexp, xmlDesc string) []string {
+	var values []string
+	for _, match := range pattern.FindAllStringSubmatch(xmlDesc, -1) {
+		values = append(values, match[1])
+	}
+	return values
+}
+
+// sameStrings reports whether two lists hold the same strings in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateNetworkSection applies a single change to both the running and the persistent network config
+func updateNetworkSection(conn *libvirt.Connect, networkName string, command libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, parentIndex int, xmlDesc string) error {
+	network, err := conn.LookupNetworkByName(networkName)
+	if err != nil {
+		return fmt.Errorf("failed to find network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	// Only touch the live config when the network is running
+	flags := libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	active, err := network.IsActive()
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %v", networkName, err)
+	}
+	if active {
+		flags |= libvirt.NETWORK_UPDATE_AFFECT_LIVE
+	}
+
+	return network.Update(command, section, parentIndex, xmlDesc, flags)
+}
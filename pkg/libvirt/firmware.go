@@ -0,0 +1,225 @@
+package libvirt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"libvirt.org/go/libvirt"
+)
+
+// Firmware types of a VM.
+const (
+	FirmwareBIOS       = "bios"
+	FirmwareUEFI       = "uefi"        // OVMF without Secure Boot
+	FirmwareUEFISecure = "uefi-secure" // OVMF with Secure Boot and Microsoft keys enrolled
+)
+
+// swtpmStateDir is where libvirt keeps the state of emulated TPMs, one directory per domain UUID.
+const swtpmStateDir = "/var/lib/libvirt/swtpm"
+
+// ValidateFirmware checks a firmware name.
+func ValidateFirmware(firmware string) error {
+	switch firmware {
+	case FirmwareBIOS, FirmwareUEFI, FirmwareUEFISecure:
+		return nil
+	}
+	return fmt.Errorf("unknown firmware %q (expected %s, %s or %s)", firmware, FirmwareBIOS, FirmwareUEFI, FirmwareUEFISecure)
+}
+
+// IsUEFI reports whether the firmware keeps its variables in an NVRAM file.
+func IsUEFI(firmware string) bool {
+	return firmware == FirmwareUEFI || firmware == FirmwareUEFISecure
+}
+
+// NVRAMPath returns where the UEFI variable store of a VM is kept.
+func NVRAMPath(vmDir, vmName string) string {
+	return filepath.Join(vmDir, vmName+"_VARS.fd")
+}
+
+// osXML renders the <os> element for the firmware of the VM. UEFI firmware is picked by
+// libvirt's firmware auto-selection; the variable store is created from its template on
+// first start.
+func osXML(params VMParams, typeXML string) string {
+	if !IsUEFI(params.Firmware) {
+		return fmt.Sprintf(`<os>
+    %s
+    <boot dev='hd'/>
+  </os>`, typeXML)
+	}
+
+	secure, loader, nvram := "no", "", ""
+	if params.Firmware == FirmwareUEFISecure {
+		secure, loader = "yes", "\n    <loader secure='yes'/>"
+	}
+	if params.NVRAM != "" {
+		nvram = fmt.Sprintf("\n    <nvram>%s</nvram>", params.NVRAM)
+	}
+	return fmt.Sprintf(`<os firmware='efi'>
+    %s
+    <firmware>
+      <feature enabled='%s' name='secure-boot'/>
+      <feature enabled='%s' name='enrolled-keys'/>
+    </firmware>%s%s
+    <boot dev='hd'/>
+  </os>`, typeXML, secure, secure, loader, nvram)
+}
+
+// firmwareFeaturesXML returns the extra <features> needed by the firmware. Secure Boot
+// requires SMM so the guest cannot write the variable store directly.
+func firmwareFeaturesXML(params VMParams) string {
+	if params.Firmware == FirmwareUEFISecure {
+		return "\n    <smm state='on'/>"
+	}
+	return ""
+}
+
+// tpmXML returns an emulated TPM 2.0 device backed by swtpm, if requested.
+func tpmXML(params VMParams) string {
+	if !params.TPM {
+		return ""
+	}
+	return `
+    <tpm model='tpm-crb'>
+      <backend type='emulator' version='2.0'/>
+    </tpm>`
+}
+
+// TPMStateDir returns the swtpm state directory of a VM.
+func TPMStateDir(conn *libvirt.Connect, vmName string) (string, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return "", fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	uuid, err := dom.GetUUIDString()
+	if err != nil {
+		return "", fmt.Errorf("failed to get UUID of VM %s: %v", vmName, err)
+	}
+	return filepath.Join(swtpmStateDir, uuid, "tpm2"), nil
+}
+
+// SaveFirmwareState copies the NVRAM file and TPM state of a stopped VM next to the
+// originals under the given tag. libvirt snapshots cover neither.
+func SaveFirmwareState(conn *libvirt.Connect, vmName, nvram string, tpm bool, tag string) error {
+	return copyFirmwareState(conn, vmName, nvram, tpm, func(path string) (string, string) {
+		return path, path + "." + tag
+	})
+}
+
+// RestoreFirmwareState puts back the NVRAM file and TPM state saved under the given tag.
+// The VM must be stopped.
+func RestoreFirmwareState(conn *libvirt.Connect, vmName, nvram string, tpm bool, tag string) error {
+	return copyFirmwareState(conn, vmName, nvram, tpm, func(path string) (string, string) {
+		return path + "." + tag, path
+	})
+}
+
+// DeleteFirmwareState removes the NVRAM file and TPM state saved under the given tag.
+func DeleteFirmwareState(conn *libvirt.Connect, vmName, nvram string, tpm bool, tag string) error {
+	if (nvram != "" || tpm) && ConnIsRemote(conn) {
+		return fmt.Errorf("the saved UEFI and TPM state of %s is on the remote libvirt host and cannot be removed from here", vmName)
+	}
+	if nvram != "" {
+		if err := os.Remove(nvram + "." + tag); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove saved NVRAM of %s: %v", vmName, err)
+		}
+	}
+	if tpm {
+		dir, err := TPMStateDir(conn, vmName)
+		if err != nil {
+			return err
+		}
+		if err = os.RemoveAll(dir + "." + tag); err != nil {
+			return fmt.Errorf("failed to remove saved TPM state of %s: %v", vmName, err)
+		}
+	}
+	return nil
+}
+
+// copyFirmwareState copies the NVRAM file and TPM state directory of a VM in the
+// direction given by paths, which maps an original path to source and destination.
+func copyFirmwareState(conn *libvirt.Connect, vmName, nvram string, tpm bool, paths func(string) (string, string)) error {
+	if (nvram != "" || tpm) && ConnIsRemote(conn) {
+		return fmt.Errorf("the UEFI and TPM state of %s is on the remote libvirt host and cannot be copied from here", vmName)
+	}
+	if nvram != "" {
+		src, dst := paths(nvram)
+		if err := CopyFile(src, dst); err != nil {
+			return fmt.Errorf("failed to copy NVRAM of %s: %v", vmName, err)
+		}
+	}
+	if tpm {
+		dir, err := TPMStateDir(conn, vmName)
+		if err != nil {
+			return err
+		}
+		src, dst := paths(dir)
+		if err = CopyDir(src, dst); err != nil {
+			return fmt.Errorf("failed to copy TPM state of %s: %v", vmName, err)
+		}
+	}
+	return nil
+}
+
+// CopyFile copies a file, keeping its permissions and owner. swtpm runs unprivileged and
+// must still be able to open restored state.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(dst, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
+// CopyDir replaces dst with a copy of the files in src. Subdirectories are not copied;
+// swtpm keeps its state in a flat directory.
+func CopyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0o700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(src); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err = os.Chown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err = CopyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// BakeImage writes a standalone, read-only copy of a disk image. The backing chain is
+// flattened and internal snapshots are dropped, so the result can serve as a base image.
+func BakeImage(src, dst string) error {
+	logging.Info(fmt.Sprintf("Baking %s into %s", src, dst))
+	out, err := exec.Command("qemu-img", "convert", "-p", "-O", "qcow2", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img convert failed: %v\nOutput: %s", err, string(out))
+	}
+	if err = os.Chmod(dst, 0o444); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %v", dst, err)
+	}
+	return nil
+}
+
+// CreateOverlay creates a qcow2 image that records its writes on top of a base image.
+func CreateOverlay(base, overlay string) error {
+	if _, err := os.Stat(overlay); err == nil {
+		return fmt.Errorf("disk image %s already exists", overlay)
+	}
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", base, overlay).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create failed: %v\nOutput: %s", err, string(out))
+	}
+	return nil
+}
+
+// GetVMXML returns the persistent domain XML of a VM.
+func GetVMXML(conn *libvirt.Connect, vmName string) (string, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return "", fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	xmlDesc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML description of VM %s: %v", vmName, err)
+	}
+	return xmlDesc, nil
+}
+
+// DefineVMXML defines a persistent VM from a complete domain XML.
+func DefineVMXML(conn *libvirt.Connect, domainXML string) error {
+	dom, err := conn.DomainDefineXML(domainXML)
+	if err != nil {
+		return fmt.Errorf("failed to define domain: %v", err)
+	}
+	return dom.Free()
+}
+
+// DomainDiskPath returns the file backing the first disk of a domain XML.
+func DomainDiskPath(domainXML string) (string, error) {
+	var def struct {
+		Disks []struct {
+			Device string `xml:"device,attr"`
+			Source struct {
+				File string `xml:"file,attr"`
+			} `xml:"source"`
+		} `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return "", fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+	for _, disk := range def.Disks {
+		if disk.Device == "disk" && disk.Source.File != "" {
+			return disk.Source.File, nil
+		}
+	}
+	return "", fmt.Errorf("domain has no file-backed disk")
+}
+
+var uuidElement = regexp.MustCompile(`\s*<uuid>[^<]*</uuid>`)
+
+// RebaseDomainXML adapts a saved domain XML for a copy of the VM: the disk and network
+// are swapped and the UUID is dropped so libvirt assigns a new one.
+func RebaseDomainXML(domainXML, oldDisk, newDisk, oldNetwork, newNetwork string) string {
+	domainXML = uuidElement.ReplaceAllString(domainXML, "")
+	domainXML = strings.ReplaceAll(domainXML, fmt.Sprintf("file='%s'", oldDisk), fmt.Sprintf("file='%s'", newDisk))
+	return strings.ReplaceAll(domainXML, fmt.Sprintf("network='%s'", oldNetwork), fmt.Sprintf("network='%s'", newNetwork))
+}
@@ -0,0 +1,138 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"libvirt.org/go/libvirt"
+)
+
+// DomainResources is what a domain uses on the host: disk images, volumes and networks.
+type DomainResources struct {
+	Name     string
+	State    libvirt.DomainState
+	Owner    *Ownership // nil for domains the tool did not create
+	Files    []string   // file-backed disks and the NVRAM store
+	Volumes  []string   // pool/volume disks
+	MACs     []string
+	Networks []string
+}
+
+// IsShutoff reports whether the domain is shut off, and so safe to remove.
+func (d DomainResources) IsShutoff() bool {
+	return d.State == libvirt.DOMAIN_SHUTOFF
+}
+
+// ListDomainResources returns the resources of every persistent domain, so that images,
+// reservations and networks still in use are never collected.
+func ListDomainResources(conn *libvirt.Connect) ([]DomainResources, error) {
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_PERSISTENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	var all []DomainResources
+	for _, dom := range domains {
+		res, err := domainResources(&dom)
+		dom.Free()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *res)
+	}
+	return all, nil
+}
+
+// domainResources reads the resources of a domain from its persistent XML.
+func domainResources(dom *libvirt.Domain) (*DomainResources, error) {
+	name, err := dom.GetName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain name: %v", err)
+	}
+	xmlDesc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML description of VM %s: %v", name, err)
+	}
+	state, _, err := dom.GetState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of VM %s: %v", name, err)
+	}
+
+	var def struct {
+		NVRAM string `xml:"os>nvram"`
+		Disks []struct {
+			Source struct {
+				File   string `xml:"file,attr"`
+				Pool   string `xml:"pool,attr"`
+				Volume string `xml:"volume,attr"`
+			} `xml:"source"`
+		} `xml:"devices>disk"`
+		Interfaces []struct {
+			MAC struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+	}
+	if err = xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse XML of VM %s: %v", name, err)
+	}
+
+	res := &DomainResources{Name: name, State: state}
+	if res.Owner, err = parseOwnership(xmlDesc); err != nil {
+		return nil, err
+	}
+	if def.NVRAM != "" {
+		res.Files = append(res.Files, def.NVRAM)
+	}
+	for _, disk := range def.Disks {
+		if disk.Source.File != "" {
+			res.Files = append(res.Files, disk.Source.File)
+		}
+		if disk.Source.Volume != "" {
+			res.Volumes = append(res.Volumes, disk.Source.Pool+"/"+disk.Source.Volume)
+		}
+	}
+	for _, iface := range def.Interfaces {
+		res.MACs = append(res.MACs, iface.MAC.Address)
+		if iface.Source.Network != "" {
+			res.Networks = append(res.Networks, iface.Source.Network)
+		}
+	}
+	return res, nil
+}
+
+// ListNetworkNames returns the names of all persistent networks.
+func ListNetworkNames(conn *libvirt.Connect) ([]string, error) {
+	networks, err := conn.ListAllNetworks(libvirt.CONNECT_LIST_NETWORKS_PERSISTENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	var names []string
+	for _, network := range networks {
+		name, err := network.GetName()
+		network.Free()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get network name: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// NetworkOwner returns the ownership of a network, or nil if the tool did not tag it.
+func NetworkOwner(conn *libvirt.Connect, networkName string) (*Ownership, error) {
+	network, err := conn.LookupNetworkByName(networkName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	xmlDesc, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML description of network %s: %v", networkName, err)
+	}
+	return parseOwnership(xmlDesc)
+}
@@ -0,0 +1,213 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+)
+
+// IPSource is a way of discovering the address of a VM.
+type IPSource string
+
+const (
+	IPSourceLease  IPSource = "lease"  // DHCP lease table of a libvirt network
+	IPSourceARP    IPSource = "arp"    // host ARP/neighbour table, works with external DHCP
+	IPSourceAgent  IPSource = "agent"  // qemu-guest-agent running in the guest
+	IPSourceStatic IPSource = "static" // address recorded in the cluster state
+)
+
+// DefaultIPSources is the order in which sources are tried. The static source is left out:
+// the planned address is recorded before the VM boots, so it cannot tell whether the guest
+// is up. It has to be asked for and is only used once the live sources time out.
+var DefaultIPSources = []IPSource{IPSourceLease, IPSourceARP, IPSourceAgent}
+
+// addressSources maps the queryable sources to libvirt interface address sources.
+var addressSources = map[IPSource]libvirt.DomainInterfaceAddressesSource{
+	IPSourceLease: libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+	IPSourceARP:   libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+	IPSourceAgent: libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+}
+
+// ParseIPSources validates a list of source names such as "lease,arp".
+func ParseIPSources(names []string) ([]IPSource, error) {
+	var sources []IPSource
+	for _, name := range names {
+		source := IPSource(strings.ToLower(strings.TrimSpace(name)))
+		if _, ok := addressSources[source]; !ok && source != IPSourceStatic {
+			return nil, fmt.Errorf("unknown IP source %q (expected lease, arp, agent or static)", name)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// IPLookup describes how to discover the address of a VM.
+type IPLookup struct {
+	Network  string     // only NICs attached to this network are considered; empty means any NIC
+	Sources  []IPSource // tried in order; empty means DefaultIPSources
+	StaticIP string     // used by the static source when no live source finds an address
+}
+
+// wantsStatic reports whether the lookup may fall back to the recorded address.
+func (l IPLookup) wantsStatic() bool {
+	for _, source := range l.Sources {
+		if source == IPSourceStatic {
+			return l.StaticIP != ""
+		}
+	}
+	return false
+}
+
+// GetVMIP retrieves the IPv4 address of a VM and the MAC address of the NIC holding it.
+func GetVMIP(conn *libvirt.Connect, vmName string, lookup IPLookup) (string, string, IPSource, error) {
+	return LookupVMIP(conn, vmName, lookup, libvirt.IP_ADDR_TYPE_IPV4)
+}
+
+// GetVMIPv6 retrieves the IPv6 address of a VM on a dual-stack network.
+func GetVMIPv6(conn *libvirt.Connect, vmName string, lookup IPLookup) (string, string, IPSource, error) {
+	return LookupVMIP(conn, vmName, lookup, libvirt.IP_ADDR_TYPE_IPV6)
+}
+
+// LookupVMIP tries each live source in turn and returns the first address of the given
+// family, the MAC address it belongs to and the source that found it. An empty address
+// without an error means no source knows the VM's address yet. The static source is
+// skipped: the recorded address is not a discovered one, see StaticVMIP.
+func LookupVMIP(conn *libvirt.Connect, vmName string, lookup IPLookup, family libvirt.IPAddrType) (string, string, IPSource, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	macs, err := networkMACs(dom, lookup.Network)
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(macs) == 0 {
+		return "", "", "", fmt.Errorf("VM %s has no interface on network %s", vmName, lookup.Network)
+	}
+
+	sources := lookup.Sources
+	if len(sources) == 0 {
+		sources = DefaultIPSources
+	}
+
+	var live []IPSource
+	for _, source := range sources {
+		if source != IPSourceStatic {
+			live = append(live, source)
+		}
+	}
+
+	var failures []string
+	for _, source := range live {
+		// Sources fail routinely, e.g. when no guest agent is running; move on to the next
+		ifaces, err := dom.ListAllInterfaceAddresses(addressSources[source])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		if ip, mac := pickAddress(ifaces, macs, family); ip != "" {
+			return ip, mac, source, nil
+		}
+	}
+
+	if len(live) > 0 && len(failures) == len(live) {
+		return "", "", "", fmt.Errorf("no IP source available for VM %s: %s", vmName, strings.Join(failures, "; "))
+	}
+	return "", "", "", nil
+}
+
+// StaticVMIP returns the address recorded for a VM and the MAC address of its first NIC on
+// the lookup's network, if the static source was asked for. It is meant as a last resort
+// once the live sources have not found the address in time.
+func StaticVMIP(conn *libvirt.Connect, vmName string, lookup IPLookup) (string, string, error) {
+	if !lookup.wantsStatic() {
+		return "", "", nil
+	}
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	macs, err := networkMACs(dom, lookup.Network)
+	if err != nil {
+		return "", "", err
+	}
+	if len(macs) == 0 {
+		return "", "", fmt.Errorf("VM %s has no interface on network %s", vmName, lookup.Network)
+	}
+	return lookup.StaticIP, macs[0], nil
+}
+
+// networkMACs returns the MAC addresses of the domain's NICs attached to the given
+// network, in the order they are defined.
+func networkMACs(dom *libvirt.Domain, network string) ([]string, error) {
+	xmlDesc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain XML description: %v", err)
+	}
+
+	var def struct {
+		Interfaces []struct {
+			MAC struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+			Source struct {
+				Network string `xml:"network,attr"`
+				Bridge  string `xml:"bridge,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+	}
+	if err = xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+
+	var macs []string
+	for _, iface := range def.Interfaces {
+		if network == "" || iface.Source.Network == network || iface.Source.Bridge == network {
+			macs = append(macs, strings.ToLower(iface.MAC.Address))
+		}
+	}
+	return macs, nil
+}
+
+// pickAddress returns the first usable address of the family on one of the given NICs.
+func pickAddress(ifaces []libvirt.DomainInterface, macs []string, family libvirt.IPAddrType) (string, string) {
+	for _, iface := range ifaces {
+		mac := strings.ToLower(iface.Hwaddr)
+		if !containsString(macs, mac) {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			ip := net.ParseIP(addr.Addr)
+			if libvirt.IPAddrType(addr.Type) != family || ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			return addr.Addr, mac
+		}
+	}
+	return "", ""
+}
+
+// ipFamily returns the libvirt address family of an IP address.
+func ipFamily(ip string) libvirt.IPAddrType {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return libvirt.IP_ADDR_TYPE_IPV6
+	}
+	return libvirt.IP_ADDR_TYPE_IPV4
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"libvirt.org/go/libvirt"
+)
+
+// MetadataNamespace is the XML namespace of the ownership metadata the tool puts on the
+// domains and networks it creates.
+const MetadataNamespace = "https://github.com/natemollica-nm/openshift-qemu/xmlns/cluster/1.0"
+
+// ToolVersion is recorded in the metadata of created objects. Release builds set it with
+// -ldflags "-X openshift-qemu/pkg/libvirt.ToolVersion=<version>".
+var ToolVersion = "dev"
+
+// RoleNetwork is the role recorded on networks created for a cluster.
+const RoleNetwork = "network"
+
+// Ownership ties a libvirt object to the cluster that created it. Volumes have no
+// metadata of their own, so the domain using them lists them.
+type Ownership struct {
+	Cluster string
+	Role    string
+	Version string
+	Created time.Time
+	Volumes []string // pool/volume of the extra disks of a domain
+}
+
+// NewOwnership returns the ownership of an object created now by this tool.
+func NewOwnership(clusterName, role string) Ownership {
+	return Ownership{Cluster: clusterName, Role: role, Version: ToolVersion, Created: time.Now().UTC()}
+}
+
+// ownershipElement is the metadata element, as written and as found in an object's XML.
+type ownershipElement struct {
+	XMLName xml.Name `xml:"https://github.com/natemollica-nm/openshift-qemu/xmlns/cluster/1.0 cluster"`
+	Name    string   `xml:"name"`
+	Role    string   `xml:"role"`
+	Version string   `xml:"version"`
+	Created string   `xml:"created"`
+	Volumes []string `xml:"volume"`
+}
+
+// metadataXML renders the ownership as a child of <metadata>, or nothing for unowned objects.
+func (o Ownership) metadataXML() string {
+	if o.Cluster == "" {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `
+    <oq:cluster xmlns:oq="%s">
+      <oq:name>%s</oq:name>
+      <oq:role>%s</oq:role>
+      <oq:version>%s</oq:version>
+      <oq:created>%s</oq:created>`, MetadataNamespace, o.Cluster, o.Role, o.Version, o.Created.Format(time.RFC3339))
+	for _, volume := range o.Volumes {
+		fmt.Fprintf(&b, "\n      <oq:volume>%s</oq:volume>", volume)
+	}
+	b.WriteString("\n    </oq:cluster>")
+	return b.String()
+}
+
+// parseOwnership reads the ownership from the XML of a domain or network. Objects the tool
+// did not create return nil.
+func parseOwnership(objectXML string) (*Ownership, error) {
+	var def struct {
+		Metadata struct {
+			Cluster *ownershipElement
+		} `xml:"metadata"`
+	}
+	if err := xml.Unmarshal([]byte(objectXML), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse XML: %v", err)
+	}
+	el := def.Metadata.Cluster
+	if el == nil {
+		return nil, nil
+	}
+	created, _ := time.Parse(time.RFC3339, el.Created)
+	return &Ownership{Cluster: el.Name, Role: el.Role, Version: el.Version, Created: created, Volumes: el.Volumes}, nil
+}
+
+// OwnedDomain is a domain created by the tool.
+type OwnedDomain struct {
+	Name  string
+	State libvirt.DomainState
+	Ownership
+}
+
+// OwnedNetwork is a network created by the tool.
+type OwnedNetwork struct {
+	Name   string
+	Active bool
+	Ownership
+}
+
+// ListClusterDomains returns the domains owned by a cluster, or by any cluster when
+// clusterName is empty.
+func ListClusterDomains(conn *libvirt.Connect, clusterName string) ([]OwnedDomain, error) {
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_PERSISTENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	var owned []OwnedDomain
+	for _, dom := range domains {
+		d, err := ownedDomain(&dom)
+		dom.Free()
+		if err != nil {
+			return nil, err
+		}
+		if d != nil && (clusterName == "" || d.Cluster == clusterName) {
+			owned = append(owned, *d)
+		}
+	}
+	return owned, nil
+}
+
+// ownedDomain returns a domain with its ownership, or nil if the tool did not create it.
+func ownedDomain(dom *libvirt.Domain) (*OwnedDomain, error) {
+	name, err := dom.GetName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain name: %v", err)
+	}
+	xmlDesc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML description of VM %s: %v", name, err)
+	}
+	owner, err := parseOwnership(xmlDesc)
+	if err != nil || owner == nil {
+		return nil, err
+	}
+	state, _, err := dom.GetState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of VM %s: %v", name, err)
+	}
+	return &OwnedDomain{Name: name, State: state, Ownership: *owner}, nil
+}
+
+// networkMetadataVersion is the first libvirt release that keeps the <metadata> of
+// networks; older ones drop it silently when the network is defined.
+const networkMetadataVersion = 9_007_000
+
+// NetworkMetadataSupported reports whether the libvirt host keeps network metadata.
+func NetworkMetadataSupported(conn *libvirt.Connect) bool {
+	version, err := conn.GetLibVersion()
+	return err == nil && version >= networkMetadataVersion
+}
+
+// ListClusterNetworks returns the networks created for a cluster, or for any cluster when
+// clusterName is empty. Networks defined by libvirt before 9.7 carry no metadata; there an
+// untagged network belongs to the cluster created maps it to (network name -> cluster),
+// which only lists networks the tool created.
+func ListClusterNetworks(conn *libvirt.Connect, clusterName string, created map[string]string) ([]OwnedNetwork, error) {
+	if NetworkMetadataSupported(conn) {
+		created = nil
+	}
+	networks, err := conn.ListAllNetworks(libvirt.CONNECT_LIST_NETWORKS_PERSISTENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	var owned []OwnedNetwork
+	for _, network := range networks {
+		n, err := ownedNetwork(&network, created)
+		network.Free()
+		if err != nil {
+			return nil, err
+		}
+		if n != nil && (clusterName == "" || n.Cluster == clusterName) {
+			owned = append(owned, *n)
+		}
+	}
+	return owned, nil
+}
+
+// ownedNetwork returns a network with its ownership, or nil if the tool did not create it.
+func ownedNetwork(network *libvirt.Network, created map[string]string) (*OwnedNetwork, error) {
+	name, err := network.GetName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network name: %v", err)
+	}
+	xmlDesc, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML description of network %s: %v", name, err)
+	}
+	owner, err := parseOwnership(xmlDesc)
+	if err != nil {
+		return nil, err
+	}
+	if owner == nil {
+		cluster := created[name]
+		if cluster == "" {
+			return nil, nil
+		}
+		owner = &Ownership{Cluster: cluster, Role: RoleNetwork}
+	}
+	active, err := network.IsActive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of network %s: %v", name, err)
+	}
+	return &OwnedNetwork{Name: name, Active: active, Ownership: *owner}, nil
+}
+
+// RemoveNetwork stops and undefines a network. A network that does not exist is not an error.
+func RemoveNetwork(conn *libvirt.Connect, networkName string) error {
+	network, err := conn.LookupNetworkByName(networkName)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_NETWORK {
+			return nil
+		}
+		return fmt.Errorf("failed to find network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	if active, err := network.IsActive(); err == nil && active {
+		if err = network.Destroy(); err != nil {
+			return fmt.Errorf("failed to stop network %s: %v", networkName, err)
+		}
+	}
+	if err = network.Undefine(); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %v", networkName, err)
+	}
+	return nil
+}
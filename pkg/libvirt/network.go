@@ -1,80 +1,231 @@
 package libvirt
 
 import (
+	"encoding/xml"
 	"fmt"
+	"net"
 	"strings"
 
 	"libvirt.org/go/libvirt"
 	"openshift-qemu/pkg/logging"
 )
 
+// NetworkParams selects an existing libvirt network or describes a new one for the cluster.
+type NetworkParams struct {
+	Name        string   // existing network to use (--libvirt-network)
+	Octet       string   // create ocp-<octet> on 192.168.<octet>.0/24 (--libvirt-oct)
+	CIDR        string   // create ocp-<cluster> on this subnet, or pick one from Pool when "auto"
+	Pool        []string // candidate ranges for automatic subnet selection
+	Prefix      int      // prefix length of automatically selected subnets
+	CIDR6       string   // optional IPv6 /64 for dual-stack, or a ULA derived from the cluster name when "auto"
+	ClusterName string
+}
+
+// NetworkInfo describes the libvirt network a cluster is attached to.
+type NetworkInfo struct {
+	Name             string
+	Bridge           string
+	GatewayIP        string
+	MachineNetwork   *net.IPNet
+	MachineNetworkV6 *net.IPNet // nil for IPv4-only networks
+	Created          bool       // created by this call rather than found
+}
+
+// NetworkName returns the name of the libvirt network selected by the parameters.
+func (p NetworkParams) NetworkName() string {
+	switch {
+	case p.Octet != "":
+		return fmt.Sprintf("ocp-%s", p.Octet)
+	case p.CIDR != "":
+		return fmt.Sprintf("ocp-%s", p.ClusterName)
+	default:
+		return p.Name
+	}
+}
+
 // EnsureLibvirtNetwork checks if the network exists or creates a new one based on the given parameters.
-func EnsureLibvirtNetwork(virNetOct, virNet string, libguestfsBackendDirect string) (string, string, error) {
-	conn, err := NewLibvirtConnection(libguestfsBackendDirect)
+func EnsureLibvirtNetwork(params NetworkParams, uri string) (*NetworkInfo, error) {
+	conn, err := NewLibvirtConnection(uri)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to connect to libvirt: %v", err)
+		return nil, fmt.Errorf("failed to connect to libvirt: %v", err)
 	}
 	defer conn.Close()
 
-	// Check if the network exists based on the virNetOct or virNet.
-	if virNetOct != "" {
-		networkName := fmt.Sprintf("ocp-%s", virNetOct)
-		network, err := conn.LookupNetworkByName(networkName)
-		if err == nil {
-			defer network.Free()
-			logging.Info(fmt.Sprintf("Libvirt network %s already exists, reusing it.\n", networkName))
-			virNet = networkName
-		} else {
-			logging.Info(fmt.Sprintf("Creating libvirt network %s...\n", networkName))
-			if err := createNewLibvirtNetwork(conn, networkName, virNetOct); err != nil {
-				return "", "", err
-			}
-			virNet = networkName
-		}
-	} else if virNet != "" {
-		network, err := conn.LookupNetworkByName(virNet)
-		if err != nil {
-			return "", "", fmt.Errorf("libvirt network %s doesn't exist: %v", virNet, err)
-		}
+	virNet := params.NetworkName()
+	if virNet == "" {
+		return nil, fmt.Errorf("unhandled situation: either a network name, octet or CIDR must be provided")
+	}
+
+	created := false
+	network, err := conn.LookupNetworkByName(virNet)
+	if err == nil {
 		defer network.Free()
 		logging.Info(fmt.Sprintf("Using existing libvirt network: %s\n", virNet))
+	} else if params.Octet == "" && params.CIDR == "" {
+		return nil, fmt.Errorf("libvirt network %s doesn't exist: %v", virNet, err)
 	} else {
-		return "", "", fmt.Errorf("unhandled situation: either virNetOct or virNet must be provided")
+		subnet, err := resolveSubnet(conn, params)
+		if err != nil {
+			return nil, err
+		}
+		subnet6, err := resolveSubnet6(params)
+		if err != nil {
+			return nil, err
+		}
+		logging.Info(fmt.Sprintf("Creating libvirt network %s on %s...\n", virNet, subnet))
+		if err = createNewLibvirtNetwork(conn, virNet, params.ClusterName, subnet, subnet6); err != nil {
+			return nil, err
+		}
+		created = true
 	}
 
-	// Get bridge and gateway IP information
-	bridgeName, err := getLibvirtBridge(conn, virNet)
-	if err != nil {
-		return "", "", err
+	// Get bridge, gateway IP and subnet information
+	info := &NetworkInfo{Name: virNet, Created: created}
+	if info.Bridge, err = GetLibvirtBridge(conn, virNet); err != nil {
+		return nil, err
+	}
+	if info.GatewayIP, err = getLibvirtNetworkGatewayIP(conn, virNet); err != nil {
+		return nil, err
+	}
+	if info.MachineNetwork, err = GetNetworkCIDR(conn, virNet); err != nil {
+		return nil, err
+	}
+	if info.MachineNetworkV6, err = GetNetworkCIDR6(conn, virNet); err != nil {
+		return nil, err
+	}
+	if params.CIDR6 != "" && info.MachineNetworkV6 == nil {
+		return nil, fmt.Errorf("libvirt network %s has no IPv6 subnet, dual-stack needs a network created with --libvirt-cidr6", virNet)
+	}
+	return info, nil
+}
+
+// resolveSubnet returns the subnet for a new network, picking a free one when requested.
+func resolveSubnet(conn *libvirt.Connect, params NetworkParams) (*net.IPNet, error) {
+	cidr := params.CIDR
+	if params.Octet != "" {
+		cidr = fmt.Sprintf("192.168.%s.0/24", params.Octet)
+	}
+	if cidr == "auto" {
+		pool, prefix := params.Pool, params.Prefix
+		if len(pool) == 0 {
+			pool = DefaultSubnetPool
+		}
+		if prefix == 0 {
+			prefix = 24
+		}
+		return FindFreeSubnet(conn, pool, prefix)
 	}
 
-	gatewayIP, err := getLibvirtNetworkGatewayIP(conn, virNet)
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 subnet %s", cidr)
+	}
+	used, err := usedSubnets(conn)
 	if err != nil {
-		return bridgeName, "", err
+		return nil, err
+	}
+	if overlapsAny(subnet, used) {
+		return nil, fmt.Errorf("subnet %s overlaps a host interface, route or libvirt network", subnet)
+	}
+	return subnet, nil
+}
+
+// resolveSubnet6 returns the optional IPv6 subnet for a new network.
+func resolveSubnet6(params NetworkParams) (*net.IPNet, error) {
+	switch params.CIDR6 {
+	case "":
+		return nil, nil
+	case "auto":
+		return GenerateULASubnet(params.ClusterName), nil
+	}
+
+	_, subnet, err := net.ParseCIDR(params.CIDR6)
+	if err != nil || subnet.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 subnet %s", params.CIDR6)
 	}
+	// DHCPv6 and router advertisements need a /64
+	if ones, _ := subnet.Mask.Size(); ones != 64 {
+		return nil, fmt.Errorf("IPv6 subnet %s must be a /64", params.CIDR6)
+	}
+	return subnet, nil
+}
 
-	return bridgeName, gatewayIP, nil
+// ipv6NetworkXML returns the <ip> element serving DHCPv6 on the given subnet.
+func ipv6NetworkXML(subnet6 *net.IPNet) (string, error) {
+	ones, _ := subnet6.Mask.Size()
+	gateway, err := HostIP(subnet6, 1)
+	if err != nil {
+		return "", err
+	}
+	rangeStart, err := HostIP(subnet6, ipv6RangeStart)
+	if err != nil {
+		return "", err
+	}
+	rangeEnd, err := HostIP(subnet6, ipv6RangeEnd)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`
+  <ip family="ipv6" address="%s" prefix="%d">
+    <dhcp>
+      <range start="%s" end="%s"/>
+    </dhcp>
+  </ip>`, gateway, ones, rangeStart, rangeEnd), nil
 }
 
-// createNewLibvirtNetwork defines, autostarts, and starts a new libvirt network
-func createNewLibvirtNetwork(conn *libvirt.Connect, networkName, virNetOct string) error {
+// createNewLibvirtNetwork defines, autostarts, and starts a new libvirt network.
+// subnet6 is optional and makes the network dual-stack.
+func createNewLibvirtNetwork(conn *libvirt.Connect, networkName, clusterName string, subnet, subnet6 *net.IPNet) error {
+	ones, _ := subnet.Mask.Size()
+	gateway, err := HostIP(subnet, 1)
+	if err != nil {
+		return err
+	}
+	rangeStart, err := HostIP(subnet, 2)
+	if err != nil {
+		return err
+	}
+	rangeEnd, err := HostIP(subnet, (1<<uint(32-ones))-2)
+	if err != nil {
+		return err
+	}
+
+	forwardXML, ipv6XML := "<forward/>", ""
+	if subnet6 != nil {
+		forwardXML = "<forward mode=\"nat\">\n    <nat ipv6=\"yes\"/>\n  </forward>"
+		if ipv6XML, err = ipv6NetworkXML(subnet6); err != nil {
+			return err
+		}
+	}
+
+	// Linux limits interface names to 15 characters
+	bridgeName := networkName
+	if len(bridgeName) > 15 {
+		bridgeName = bridgeName[:15]
+	}
+
 	networkXML := fmt.Sprintf(`
 <network>
   <name>%s</name>
+  <metadata>%s
+  </metadata>
   <bridge name="%s"/>
-  <forward/>
-  <ip address="192.168.%s.1" netmask="255.255.255.0">
+  %s
+  <ip address="%s" netmask="%s">
     <dhcp>
-      <range start="192.168.%s.2" end="192.168.%s.254"/>
+      <range start="%s" end="%s"/>
     </dhcp>
-  </ip>
-</network>`, networkName, networkName, virNetOct, virNetOct, virNetOct)
+  </ip>%s
+</network>`, networkName, NewOwnership(clusterName, RoleNetwork).metadataXML(), bridgeName, forwardXML, gateway, net.IP(subnet.Mask).String(), rangeStart, rangeEnd, ipv6XML)
 
 	network, err := conn.NetworkDefineXML(networkXML)
 	if err != nil {
 		return fmt.Errorf("failed to define network: %v", err)
 	}
 	defer network.Free()
+	if !NetworkMetadataSupported(conn) {
+		logging.Info(fmt.Sprintf("libvirt drops the metadata of networks before 9.7; %s is tracked through the cluster state", networkName))
+	}
 
 	if err := network.SetAutostart(true); err != nil {
 		return fmt.Errorf("failed to set autostart: %v", err)
@@ -87,8 +238,8 @@ func createNewLibvirtNetwork(conn *libvirt.Connect, networkName, virNetOct strin
 	return nil
 }
 
-// getLibvirtBridge fetches the bridge name for the given libvirt network
-func getLibvirtBridge(conn *libvirt.Connect, networkName string) (string, error) {
+// GetLibvirtBridge fetches the bridge name for the given libvirt network
+func GetLibvirtBridge(conn *libvirt.Connect, networkName string) (string, error) {
 	network, err := conn.LookupNetworkByName(networkName)
 	if err != nil {
 		return "", fmt.Errorf("failed to lookup network %s: %v", networkName, err)
@@ -130,3 +281,151 @@ func getLibvirtNetworkGatewayIP(conn *libvirt.Connect, networkName string) (stri
 
 	return xmlDesc[ipAddrStart : ipAddrStart+ipAddrEnd], nil
 }
+
+// networkDef is the subset of the libvirt network XML read by this package.
+type networkDef struct {
+	XMLName xml.Name    `xml:"network"`
+	Name    string      `xml:"name"`
+	DNS     *networkDNS `xml:"dns"`
+	IPs     []networkIP `xml:"ip"`
+}
+
+// networkDNS is the <dns> element of a libvirt network.
+type networkDNS struct {
+	Hosts []DNSHost `xml:"host"`
+}
+
+// networkIP is an <ip> element of a libvirt network.
+type networkIP struct {
+	Family  string       `xml:"family,attr"`
+	Address string       `xml:"address,attr"`
+	Netmask string       `xml:"netmask,attr"`
+	Prefix  string       `xml:"prefix,attr"`
+	DHCP    *networkDHCP `xml:"dhcp"`
+}
+
+// networkDHCP is the <dhcp> element of a network <ip>.
+type networkDHCP struct {
+	Hosts []DHCPReservation `xml:"host"`
+}
+
+// getNetworkDef fetches and parses the XML description of a libvirt network
+func getNetworkDef(conn *libvirt.Connect, networkName string) (*networkDef, error) {
+	network, err := conn.LookupNetworkByName(networkName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network XML description for %s: %v", networkName, err)
+	}
+
+	var def networkDef
+	if err = xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse network XML for %s: %v", networkName, err)
+	}
+	return &def, nil
+}
+
+// GetNetworkCIDR returns the IPv4 subnet served by the given libvirt network
+func GetNetworkCIDR(conn *libvirt.Connect, networkName string) (*net.IPNet, error) {
+	def, err := getNetworkDef(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range def.IPs {
+		if ip.Family != "" && ip.Family != "ipv4" {
+			continue
+		}
+		addr := net.ParseIP(ip.Address).To4()
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q in network %s", ip.Address, networkName)
+		}
+
+		mask := net.CIDRMask(24, 32)
+		if ip.Netmask != "" {
+			netmask := net.ParseIP(ip.Netmask).To4()
+			if netmask == nil {
+				return nil, fmt.Errorf("invalid netmask %q in network %s", ip.Netmask, networkName)
+			}
+			mask = net.IPMask(netmask)
+		} else if ip.Prefix != "" {
+			prefix, err := parsePrefix(ip.Prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q in network %s", ip.Prefix, networkName)
+			}
+			mask = net.CIDRMask(prefix, 32)
+		}
+		return &net.IPNet{IP: addr.Mask(mask), Mask: mask}, nil
+	}
+	return nil, fmt.Errorf("no IPv4 subnet defined in network %s", networkName)
+}
+
+// GetNetworkCIDR6 returns the IPv6 subnet served by the given libvirt network, or nil if it has none
+func GetNetworkCIDR6(conn *libvirt.Connect, networkName string) (*net.IPNet, error) {
+	def, err := getNetworkDef(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range def.IPs {
+		if ip.Family != "ipv6" {
+			continue
+		}
+		addr := net.ParseIP(ip.Address)
+		prefix, err := parsePrefix(ip.Prefix)
+		if addr == nil || err != nil {
+			return nil, fmt.Errorf("invalid IPv6 subnet %s/%s in network %s", ip.Address, ip.Prefix, networkName)
+		}
+		mask := net.CIDRMask(prefix, 128)
+		return &net.IPNet{IP: addr.Mask(mask), Mask: mask}, nil
+	}
+	return nil, nil
+}
+
+// GetNetworkGatewayIP6 returns the IPv6 address of the host on the given libvirt network, or
+// nothing if it has none
+func GetNetworkGatewayIP6(conn *libvirt.Connect, networkName string) (string, error) {
+	def, err := getNetworkDef(conn, networkName)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range def.IPs {
+		if ip.Family == "ipv6" {
+			return ip.Address, nil
+		}
+	}
+	return "", nil
+}
+
+// ipIndex returns the position of the <ip> element of a network that contains the address
+func ipIndex(def *networkDef, addr string) (int, error) {
+	ip := net.ParseIP(addr)
+	for i, netIP := range def.IPs {
+		prefix := 24
+		if netIP.Prefix != "" {
+			prefix, _ = parsePrefix(netIP.Prefix)
+		} else if netIP.Netmask != "" {
+			prefix, _ = net.IPMask(net.ParseIP(netIP.Netmask).To4()).Size()
+		}
+		bits := 32
+		if netIP.Family == "ipv6" {
+			bits = 128
+		}
+		subnet := &net.IPNet{IP: net.ParseIP(netIP.Address), Mask: net.CIDRMask(prefix, bits)}
+		if ip != nil && subnet.Contains(ip) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("address %s is not inside any subnet of network %s", addr, def.Name)
+}
+
+// parsePrefix parses a prefix length attribute
+func parsePrefix(prefix string) (int, error) {
+	var length int
+	_, err := fmt.Sscanf(prefix, "%d", &length)
+	return length, err
+}
@@ -0,0 +1,40 @@
+package libvirt
+
+import (
+	"fmt"
+	"net/url"
+
+	"libvirt.org/go/libvirt"
+)
+
+// DefaultURI is the libvirt connection used unless --connect names another.
+const DefaultURI = "qemu:///system"
+
+// IsRemote reports whether a connection URI points at another host, such as
+// qemu+ssh://host/system. Files written by the tool are then not visible to libvirt.
+func IsRemote(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "", "localhost", "127.0.0.1", "::1":
+		return false
+	}
+	return true
+}
+
+// ConnIsRemote reports whether an open connection is to another host.
+func ConnIsRemote(conn *libvirt.Connect) bool {
+	uri, err := conn.GetURI()
+	return err == nil && IsRemote(uri)
+}
+
+// RequireLocal fails with a clear message when a step that works on files of the libvirt
+// host runs over a remote connection.
+func RequireLocal(uri, step string) error {
+	if IsRemote(uri) {
+		return fmt.Errorf("%s works on files of the libvirt host and is not supported over the remote connection %s; run it on that host instead", step, uri)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// DHCPReservation is a <host> entry in the DHCP section of a libvirt network.
+// libvirt does not accept MAC addresses for IPv6 hosts, so DHCPv6 clients are
+// matched by host name instead.
+type DHCPReservation struct {
+	MAC  string `xml:"mac,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+	IP   string `xml:"ip,attr,omitempty"`
+}
+
+// String renders the reservation as libvirt network XML.
+func (r DHCPReservation) String() string {
+	out, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"host"`
+		DHCPReservation
+	}{DHCPReservation: r})
+	return string(out)
+}
+
+// Matches reports whether the reservation is identified by the given MAC, IP or host name.
+func (r DHCPReservation) Matches(key string) bool {
+	return key != "" && (strings.EqualFold(r.MAC, key) || r.IP == key || r.Name == key)
+}
+
+// equal reports whether two reservations describe exactly the same host entry.
+func (r DHCPReservation) equal(other DHCPReservation) bool {
+	return strings.EqualFold(r.MAC, other.MAC) && r.IP == other.IP && r.Name == other.Name
+}
+
+// IsIPv6 reports whether the reservation is for an IPv6 address.
+func (r DHCPReservation) IsIPv6() bool {
+	return strings.Contains(r.IP, ":")
+}
+
+// conflicts reports whether two reservations of the same address family share a MAC, IP or host name.
+func (r DHCPReservation) conflicts(other DHCPReservation) bool {
+	if r.IsIPv6() != other.IsIPv6() {
+		return false
+	}
+	return other.Matches(r.MAC) || other.Matches(r.IP) || other.Matches(r.Name)
+}
+
+// ListDHCPReservations returns the DHCP host entries of a libvirt network
+func ListDHCPReservations(conn *libvirt.Connect, networkName string) ([]DHCPReservation, error) {
+	def, err := getNetworkDef(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var reservations []DHCPReservation
+	for _, ip := range def.IPs {
+		if ip.DHCP != nil {
+			reservations = append(reservations, ip.DHCP.Hosts...)
+		}
+	}
+	return reservations, nil
+}
+
+// FindDHCPReservations returns the DHCP host entries matching a MAC, IP or host name
+func FindDHCPReservations(conn *libvirt.Connect, networkName, key string) ([]DHCPReservation, error) {
+	reservations, err := ListDHCPReservations(conn, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []DHCPReservation
+	for _, r := range reservations {
+		if r.Matches(key) {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+// AddDHCPReservation adds a DHCP reservation to a network. It is a no-op when the same entry
+// already exists, and replaces any entries sharing its MAC, IP or host name.
+func AddDHCPReservation(conn *libvirt.Connect, networkName string, res DHCPReservation) error {
+	reservations, err := ListDHCPReservations(conn, networkName)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range reservations {
+		if existing.equal(res) {
+			logging.Info(fmt.Sprintf("DHCP reservation already present: %s", res))
+			return nil
+		}
+	}
+
+	// Drop stale or conflicting entries left behind by earlier runs
+	for _, existing := range reservations {
+		if res.conflicts(existing) {
+			logging.Warn(fmt.Sprintf("Replacing conflicting DHCP reservation %s", existing))
+			if err = updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_DELETE, existing); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, res); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully added DHCP reservation: MAC=%s, IP=%s, Name=%s\n", res.MAC, res.IP, res.Name)
+	return nil
+}
+
+// ModifyDHCPReservation changes the reservation matching a MAC, IP or host name. The set
+// fields of changes replace those of the reservation; the others are kept. The key has to
+// match exactly one reservation.
+func ModifyDHCPReservation(conn *libvirt.Connect, networkName, key string, changes DHCPReservation) error {
+	reservations, err := ListDHCPReservations(conn, networkName)
+	if err != nil {
+		return err
+	}
+	var found []DHCPReservation
+	for _, r := range reservations {
+		if r.Matches(key) {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return fmt.Errorf("no DHCP reservation matches %s in network %s", key, networkName)
+	case 1:
+	default:
+		return fmt.Errorf("%s matches %d DHCP reservations in network %s; use a key that matches only one", key, len(found), networkName)
+	}
+
+	old, res := found[0], found[0]
+	if changes.MAC != "" {
+		res.MAC = changes.MAC
+	}
+	if changes.IP != "" {
+		res.IP = changes.IP
+	}
+	if changes.Name != "" {
+		res.Name = changes.Name
+	}
+	if res.equal(old) {
+		logging.Info(fmt.Sprintf("DHCP reservation already up to date: %s", res))
+		return nil
+	}
+	if res.IsIPv6() != old.IsIPv6() {
+		return fmt.Errorf("cannot change the address family of DHCP reservation %s", old)
+	}
+	for _, other := range reservations {
+		if !other.equal(old) && res.conflicts(other) {
+			return fmt.Errorf("DHCP reservation %s conflicts with %s", res, other)
+		}
+	}
+
+	// libvirt finds the entry to modify by its MAC or name, which may be what changes,
+	// so the entry is replaced instead
+	if err = updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_DELETE, old); err != nil {
+		return err
+	}
+	if err = updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, res); err != nil {
+		if restoreErr := updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, old); restoreErr != nil {
+			logging.Warn(fmt.Sprintf("Failed to restore DHCP reservation %s: %v", old, restoreErr))
+		}
+		return err
+	}
+
+	fmt.Printf("Successfully modified DHCP reservation: MAC=%s, IP=%s, Name=%s\n", res.MAC, res.IP, res.Name)
+	return nil
+}
+
+// RemoveDHCPReservations removes every reservation matching a MAC, IP or host name and returns them
+func RemoveDHCPReservations(conn *libvirt.Connect, networkName, key string) ([]DHCPReservation, error) {
+	found, err := FindDHCPReservations(conn, networkName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range found {
+		if err = updateDHCPHost(conn, networkName, libvirt.NETWORK_UPDATE_COMMAND_DELETE, res); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Successfully removed DHCP reservation: MAC=%s, IP=%s, Name=%s\n", res.MAC, res.IP, res.Name)
+	}
+	return found, nil
+}
+
+// updateDHCPHost applies a single <host> change to both the running and the persistent network config
+func updateDHCPHost(conn *libvirt.Connect, networkName string, command libvirt.NetworkUpdateCommand, res DHCPReservation) error {
+	// libvirt picks the first IPv4 <ip> by default; IPv6 hosts must name their parent
+	parentIndex := -1
+	if res.IsIPv6() {
+		def, err := getNetworkDef(conn, networkName)
+		if err != nil {
+			return err
+		}
+		if parentIndex, err = ipIndex(def, res.IP); err != nil {
+			return err
+		}
+	}
+
+	err := updateNetworkSection(conn, networkName, command, libvirt.NETWORK_SECTION_IP_DHCP_HOST, parentIndex, res.String())
+	if err != nil {
+		return fmt.Errorf("failed to update DHCP reservation %s in network %s: %v", res, networkName, err)
+	}
+	return nil
+}
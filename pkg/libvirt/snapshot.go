@@ -0,0 +1,200 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"libvirt.org/go/libvirt"
+)
+
+// CreateSnapshot takes an internal snapshot of a VM. Running VMs are snapshotted
+// together with their memory, stopped ones disk-only. The filesystems of running VMs
+// are frozen through the guest agent meanwhile, so their disks are consistent.
+func CreateSnapshot(conn *libvirt.Connect, vmName, name, description string) error {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	if err = checkSnapshotDisks(dom, vmName); err != nil {
+		return err
+	}
+	if state, _, err := dom.GetState(); err == nil && state == libvirt.DOMAIN_RUNNING {
+		thaw := freezeFilesystems(dom, vmName)
+		defer thaw()
+	}
+
+	snapshotXML := fmt.Sprintf(`
+<domainsnapshot>
+  <name>%s</name>
+  <description>%s</description>
+</domainsnapshot>`, escapeXML(name), escapeXML(description))
+
+	snap, err := dom.CreateSnapshotXML(snapshotXML, 0)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot VM %s: %v", vmName, err)
+	}
+	return snap.Free()
+}
+
+// CheckSnapshotDisks fails when a VM has a writable disk that cannot be snapshotted
+// internally. Only qcow2 images hold internal snapshots, so raw disks such as the shared
+// ones rule them out.
+func CheckSnapshotDisks(conn *libvirt.Connect, vmName string) error {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+	return checkSnapshotDisks(dom, vmName)
+}
+
+// checkSnapshotDisks is CheckSnapshotDisks for a domain already looked up.
+func checkSnapshotDisks(dom *libvirt.Domain, vmName string) error {
+	xmlDesc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return fmt.Errorf("failed to get XML description of VM %s: %v", vmName, err)
+	}
+	var def struct {
+		Disks []struct {
+			Device string `xml:"device,attr"`
+			Driver struct {
+				Type string `xml:"type,attr"`
+			} `xml:"driver"`
+			Target struct {
+				Dev string `xml:"dev,attr"`
+			} `xml:"target"`
+			ReadOnly *struct{} `xml:"readonly"`
+		} `xml:"devices>disk"`
+	}
+	if err = xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return fmt.Errorf("failed to parse XML of VM %s: %v", vmName, err)
+	}
+	var raw []string
+	for _, disk := range def.Disks {
+		if disk.Device == "disk" && disk.ReadOnly == nil && disk.Driver.Type != "qcow2" {
+			raw = append(raw, disk.Target.Dev)
+		}
+	}
+	if len(raw) > 0 {
+		return fmt.Errorf("VM %s cannot be snapshotted: disk %s is not qcow2, and internal snapshots need every writable disk to be qcow2 (shared disks are raw)", vmName, strings.Join(raw, ", "))
+	}
+	return nil
+}
+
+// escapeXML escapes text for use in an XML element.
+func escapeXML(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// RevertSnapshot reverts a VM to a snapshot. With start set the VM is running afterwards
+// even if the snapshot was taken while it was stopped.
+func RevertSnapshot(conn *libvirt.Connect, vmName, name string, start bool) error {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	snap, err := dom.SnapshotLookupByName(name, 0)
+	if err != nil {
+		return fmt.Errorf("failed to find snapshot %s of VM %s: %v", name, vmName, err)
+	}
+	defer snap.Free()
+
+	var flags libvirt.DomainSnapshotRevertFlags
+	if start {
+		flags = libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING
+	}
+	if err = snap.RevertToSnapshot(flags); err != nil {
+		return fmt.Errorf("failed to revert VM %s to snapshot %s: %v", vmName, name, err)
+	}
+	// The memory of a running snapshot was saved with the filesystems frozen
+	if state, _, err := dom.GetState(); err == nil && state == libvirt.DOMAIN_RUNNING {
+		thawIfFrozen(dom, vmName)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot of a VM. A missing snapshot is not an error.
+func DeleteSnapshot(conn *libvirt.Connect, vmName, name string) error {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	snap, err := dom.SnapshotLookupByName(name, 0)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_DOMAIN_SNAPSHOT {
+			return nil
+		}
+		return fmt.Errorf("failed to find snapshot %s of VM %s: %v", name, vmName, err)
+	}
+	defer snap.Free()
+
+	if err = snap.Delete(0); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s of VM %s: %v", name, vmName, err)
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshot names of a VM.
+func ListSnapshots(conn *libvirt.Connect, vmName string) ([]string, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	snaps, err := dom.ListAllSnapshots(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of VM %s: %v", vmName, err)
+	}
+
+	var names []string
+	for _, snap := range snaps {
+		name, err := snap.GetName()
+		snap.Free()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get snapshot name: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// IsVMRunning reports whether a VM is running
+func IsVMRunning(conn *libvirt.Connect, vmName string) (bool, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return false, fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	state, _, err := dom.GetState()
+	if err != nil {
+		return false, fmt.Errorf("failed to get state of VM %s: %v", vmName, err)
+	}
+	return state == libvirt.DOMAIN_RUNNING, nil
+}
+
+// ShutdownVM asks the guest OS to power off and waits until the VM has stopped.
+func ShutdownVM(ctx context.Context, conn *libvirt.Connect, vmName string, timeout time.Duration) error {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	if err = dom.Shutdown(); err != nil {
+		return fmt.Errorf("failed to shut down VM %s: %v", vmName, err)
+	}
+	return WaitForShutoff(ctx, conn, vmName, timeout)
+}
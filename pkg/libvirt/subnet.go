@@ -0,0 +1,134 @@
+package libvirt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// DefaultSubnetPool is searched for a free machine network when none is given.
+var DefaultSubnetPool = []string{"192.168.100.0/22", "10.100.0.0/16"}
+
+// FindFreeSubnet returns the first subnet with the given prefix length inside the pool that
+// does not overlap a host interface, a host route or another libvirt network.
+func FindFreeSubnet(conn *libvirt.Connect, pool []string, prefix int) (*net.IPNet, error) {
+	used, err := usedSubnets(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range pool {
+		_, supernet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet pool entry %s: %v", cidr, err)
+		}
+		ones, bits := supernet.Mask.Size()
+		if bits != 32 || prefix < ones || prefix > 30 {
+			return nil, fmt.Errorf("cannot carve /%d subnets out of %s", prefix, cidr)
+		}
+
+		mask := net.CIDRMask(prefix, 32)
+		step := uint32(1) << uint(32-prefix)
+		first := binary.BigEndian.Uint32(supernet.IP.To4())
+		count := uint32(1) << uint(prefix-ones)
+		for i := uint32(0); i < count; i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, first+i*step)
+			candidate := &net.IPNet{IP: ip, Mask: mask}
+			if !overlapsAny(candidate, used) {
+				logging.Info(fmt.Sprintf("Selected free subnet %s from pool %s", candidate, cidr))
+				return candidate, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free /%d subnet left in pool %s", prefix, strings.Join(pool, ","))
+}
+
+// usedSubnets collects the IPv4 subnets already in use on the host.
+func usedSubnets(conn *libvirt.Connect) ([]*net.IPNet, error) {
+	var used []*net.IPNet
+
+	// Addresses configured on host interfaces, including VPN tunnels
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host interface addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			used = append(used, ipNet)
+		}
+	}
+
+	// Routed destinations, e.g. VPN split-tunnel ranges without a local address
+	routes, err := hostRoutes()
+	if err != nil {
+		return nil, err
+	}
+	used = append(used, routes...)
+
+	// Other libvirt networks, active or not
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list libvirt networks: %v", err)
+	}
+	for _, network := range networks {
+		name, err := network.GetName()
+		network.Free()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get network name: %v", err)
+		}
+		if cidr, err := GetNetworkCIDR(conn, name); err == nil {
+			used = append(used, cidr)
+		}
+	}
+	return used, nil
+}
+
+// hostRoutes parses the IPv4 routing table from /proc/net/route, skipping default routes.
+func hostRoutes() ([]*net.IPNet, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host routes: %v", err)
+	}
+	defer f.Close()
+
+	var routes []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, errDst := hex.DecodeString(fields[1])
+		mask, errMask := hex.DecodeString(fields[7])
+		if errDst != nil || errMask != nil || len(dst) != 4 || len(mask) != 4 {
+			continue
+		}
+		// Values are stored in host (little-endian) byte order
+		ip := net.IPv4(dst[3], dst[2], dst[1], dst[0]).To4()
+		ipMask := net.IPv4Mask(mask[3], mask[2], mask[1], mask[0])
+		if ones, _ := ipMask.Size(); ones == 0 {
+			continue
+		}
+		routes = append(routes, &net.IPNet{IP: ip, Mask: ipMask})
+	}
+	return routes, scanner.Err()
+}
+
+// overlapsAny reports whether the subnet overlaps any of the used subnets.
+func overlapsAny(subnet *net.IPNet, used []*net.IPNet) bool {
+	for _, u := range used {
+		if subnet.Contains(u.IP.Mask(u.Mask)) || u.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
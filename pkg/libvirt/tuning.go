@@ -0,0 +1,295 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+)
+
+// Disk cache, I/O and discard modes libvirt accepts for a disk driver.
+var (
+	DiskCacheModes   = []string{"none", "writeback", "writethrough", "directsync", "unsafe"}
+	DiskIOModes      = []string{"native", "threads", "io_uring"}
+	DiskDiscardModes = []string{"unmap", "ignore"}
+)
+
+// Tuning places a VM on host CPUs and memory and sets how its disks are accessed. The
+// zero value leaves everything to the host scheduler and QEMU defaults.
+type Tuning struct {
+	VCPUPins     []int  // host CPU of each vCPU, in vCPU order
+	EmulatorPins []int  // host CPUs of the emulator threads
+	NUMANode     string // host NUMA node the memory is bound to; empty for any
+	HugePageKiB  uint   // huge page size backing the memory; 0 for normal pages
+	Cache        string // DiskCacheModes
+	IO           string // DiskIOModes
+	Discard      string // DiskDiscardModes
+}
+
+// IsZero reports whether the tuning changes nothing.
+func (t Tuning) IsZero() bool {
+	return len(t.VCPUPins) == 0 && len(t.EmulatorPins) == 0 && t.NUMANode == "" && t.HugePageKiB == 0 &&
+		t.Cache == "" && t.IO == "" && t.Discard == ""
+}
+
+// ValidateDiskTuning checks the disk modes. QEMU only does native AIO on files opened
+// with O_DIRECT, that is with cache=none or directsync.
+func ValidateDiskTuning(t Tuning) error {
+	for _, mode := range []struct {
+		name, value string
+		allowed     []string
+	}{{"cache", t.Cache, DiskCacheModes}, {"io", t.IO, DiskIOModes}, {"discard", t.Discard, DiskDiscardModes}} {
+		if mode.value != "" && !containsString(mode.allowed, mode.value) {
+			return fmt.Errorf("unknown disk %s mode %q (expected one of %s)", mode.name, mode.value, strings.Join(mode.allowed, ", "))
+		}
+	}
+	if t.IO == "native" && t.Cache != "none" && t.Cache != "directsync" {
+		return fmt.Errorf("io=native needs cache=none or cache=directsync")
+	}
+	return nil
+}
+
+// ParseCPUSet parses a host CPU list such as 0-3,8,10-11 into sorted CPU numbers.
+func ParseCPUSet(s string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid CPU %q in CPU set %q", first, s)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid CPU range %q in CPU set %q", part, s)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// FormatCPUSet renders CPU numbers the way libvirt writes CPU sets, e.g. 0-3,8.
+func FormatCPUSet(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// NUMACell is a host NUMA node: its CPUs, memory and configured huge pages.
+type NUMACell struct {
+	ID        string
+	CPUs      []int
+	MemoryKiB uint64
+	Pages     map[uint]uint64 // page size in KiB -> pages reserved
+}
+
+// HostTopology is the NUMA layout of the host.
+type HostTopology struct {
+	Cells []NUMACell
+}
+
+// GetHostTopology reads the NUMA cells of the host from its capabilities.
+func GetHostTopology(conn *libvirt.Connect) (*HostTopology, error) {
+	capsXML, err := conn.GetCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host capabilities: %v", err)
+	}
+
+	var def struct {
+		Cells []struct {
+			ID     string `xml:"id,attr"`
+			Memory uint64 `xml:"memory"`
+			Pages  []struct {
+				Size  uint   `xml:"size,attr"`
+				Count uint64 `xml:",chardata"`
+			} `xml:"pages"`
+			CPUs []struct {
+				ID int `xml:"id,attr"`
+			} `xml:"cpus>cpu"`
+		} `xml:"host>topology>cells>cell"`
+	}
+	if err = xml.Unmarshal([]byte(capsXML), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse host capabilities: %v", err)
+	}
+
+	topology := &HostTopology{}
+	for _, c := range def.Cells {
+		cell := NUMACell{ID: c.ID, MemoryKiB: c.Memory, Pages: map[uint]uint64{}}
+		for _, cpu := range c.CPUs {
+			cell.CPUs = append(cell.CPUs, cpu.ID)
+		}
+		for _, pages := range c.Pages {
+			cell.Pages[pages.Size] = pages.Count
+		}
+		topology.Cells = append(topology.Cells, cell)
+	}
+	if len(topology.Cells) == 0 {
+		return nil, fmt.Errorf("host capabilities report no NUMA topology")
+	}
+	return topology, nil
+}
+
+// cell returns the NUMA cell with the ID, or nil.
+func (t *HostTopology) cell(id string) *NUMACell {
+	for i := range t.Cells {
+		if t.Cells[i].ID == id {
+			return &t.Cells[i]
+		}
+	}
+	return nil
+}
+
+// cellOf returns the NUMA cell a host CPU belongs to, or nil.
+func (t *HostTopology) cellOf(cpu int) *NUMACell {
+	for i := range t.Cells {
+		for _, c := range t.Cells[i].CPUs {
+			if c == cpu {
+				return &t.Cells[i]
+			}
+		}
+	}
+	return nil
+}
+
+// TunedVM is a VM whose tuning is checked against the host, see HostTopology.Validate.
+type TunedVM struct {
+	Name      string
+	MemoryMiB uint
+	Tuning    Tuning
+}
+
+// Validate checks that the pinned CPUs and NUMA nodes exist, that pinned vCPUs stay on
+// the NUMA node holding the memory, that no two VMs share a pinned CPU, and that the
+// huge pages and memory reserved on each node cover every VM placed there.
+func (t *HostTopology) Validate(vms []TunedVM) error {
+	pinnedBy := map[int]string{}
+	need := map[string]uint64{} // "<cell>/<page size>" -> KiB
+	for _, vm := range vms {
+		tuning := vm.Tuning
+		var cell *NUMACell
+		if tuning.NUMANode != "" {
+			if cell = t.cell(tuning.NUMANode); cell == nil {
+				return fmt.Errorf("%s: host has no NUMA node %s", vm.Name, tuning.NUMANode)
+			}
+		}
+		for _, cpu := range append(append([]int{}, tuning.VCPUPins...), tuning.EmulatorPins...) {
+			if t.cellOf(cpu) == nil {
+				return fmt.Errorf("%s: host has no CPU %d", vm.Name, cpu)
+			}
+		}
+		for _, cpu := range tuning.VCPUPins {
+			if cell != nil && t.cellOf(cpu) != cell {
+				return fmt.Errorf("%s: CPU %d is not on NUMA node %s holding its memory", vm.Name, cpu, cell.ID)
+			}
+			if other, ok := pinnedBy[cpu]; ok {
+				return fmt.Errorf("%s: CPU %d is already pinned to %s", vm.Name, cpu, other)
+			}
+			pinnedBy[cpu] = vm.Name
+		}
+
+		cellID := tuning.NUMANode
+		if cellID == "" {
+			cellID = "*"
+		}
+		need[fmt.Sprintf("%s/%d", cellID, tuning.HugePageKiB)] += uint64(vm.MemoryMiB) * 1024
+	}
+
+	for key, kib := range need {
+		cellID, size, _ := strings.Cut(key, "/")
+		pageKiB, _ := strconv.ParseUint(size, 10, 32)
+		available := uint64(0)
+		for _, cell := range t.Cells {
+			if cellID != "*" && cell.ID != cellID {
+				continue
+			}
+			if pageKiB == 0 {
+				available += cell.MemoryKiB
+			} else {
+				available += cell.Pages[uint(pageKiB)] * pageKiB
+			}
+		}
+		where := "the host"
+		if cellID != "*" {
+			where = "NUMA node " + cellID
+		}
+		switch {
+		case pageKiB != 0 && available == 0:
+			return fmt.Errorf("no %d KiB huge pages are reserved on %s", pageKiB, where)
+		case available < kib:
+			kind := "memory"
+			if pageKiB != 0 {
+				kind = fmt.Sprintf("%d KiB huge pages", pageKiB)
+			}
+			return fmt.Errorf("%s has %d MiB of %s but the VMs placed there need %d MiB", where, available/1024, kind, kib/1024)
+		}
+	}
+	return nil
+}
+
+// tuningXML renders the <cputune>, <numatune> and <memoryBacking> elements.
+func tuningXML(t Tuning) string {
+	var b strings.Builder
+	if len(t.VCPUPins) > 0 || len(t.EmulatorPins) > 0 {
+		b.WriteString("\n  <cputune>")
+		for vcpu, cpu := range t.VCPUPins {
+			fmt.Fprintf(&b, "\n    <vcpupin vcpu='%d' cpuset='%d'/>", vcpu, cpu)
+		}
+		if len(t.EmulatorPins) > 0 {
+			fmt.Fprintf(&b, "\n    <emulatorpin cpuset='%s'/>", FormatCPUSet(t.EmulatorPins))
+		}
+		b.WriteString("\n  </cputune>")
+	}
+	if t.NUMANode != "" {
+		fmt.Fprintf(&b, `
+  <numatune>
+    <memory mode='strict' nodeset='%s'/>
+  </numatune>`, t.NUMANode)
+	}
+	if t.HugePageKiB != 0 {
+		fmt.Fprintf(&b, `
+  <memoryBacking>
+    <hugepages>
+      <page size='%d' unit='KiB'/>
+    </hugepages>
+  </memoryBacking>`, t.HugePageKiB)
+	}
+	return b.String()
+}
+
+// diskDriverAttrs renders the cache, io and discard attributes of a disk driver. cache
+// falls back to defaultCache when the tuning does not set it.
+func diskDriverAttrs(t Tuning, defaultCache string) string {
+	var b strings.Builder
+	cache := t.Cache
+	if cache == "" {
+		cache = defaultCache
+	}
+	for _, attr := range [][2]string{{"cache", cache}, {"io", t.IO}, {"discard", t.Discard}} {
+		if attr[1] != "" {
+			fmt.Fprintf(&b, " %s='%s'", attr[0], attr[1])
+		}
+	}
+	return b.String()
+}
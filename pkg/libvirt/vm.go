@@ -2,9 +2,9 @@ package libvirt
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
-	"time"
 
 	"libvirt.org/go/libvirt"
 	"openshift-qemu/pkg/logging"
@@ -12,12 +12,14 @@ import (
 
 type VM struct {
 	Name   string
+	Role   string
 	Status string
 }
 type VirtConnection *libvirt.Connect
 
 // NewLibvirtConnection initializes a new libvirt connection
 func NewLibvirtConnection(uri string) (*libvirt.Connect, error) {
+	startEventLoop()
 	conn, err := libvirt.NewConnect(uri)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to libvirt: %v", err)
@@ -25,52 +27,86 @@ func NewLibvirtConnection(uri string) (*libvirt.Connect, error) {
 	return conn, nil
 }
 
-// GetVMsByName lists all VMs (domains) that match a given name
-func GetVMsByName(conn *libvirt.Connect, clusterName string) ([]VM, error) {
-	var vms []VM
-
-	// List all VMs (domains)
-	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_PERSISTENT)
+// GetClusterVMs lists the VMs owned by a cluster, found by their ownership metadata.
+func GetClusterVMs(conn *libvirt.Connect, clusterName string) ([]VM, error) {
+	owned, err := ListClusterDomains(conn, clusterName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list domains: %v", err)
+		return nil, err
 	}
 
-	// Filter VMs by the cluster name
-	for _, domain := range domains {
-		var name string
-		name, err = domain.GetName()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get domain name: %v", err)
-		}
-		if err = domain.Free(); err != nil {
-			return nil, fmt.Errorf("failed to free domain: %v", err)
-		}
-
-		if nameContainsCluster(name, clusterName) {
-			vms = append(vms, VM{Name: name})
-		}
+	var vms []VM
+	for _, dom := range owned {
+		vms = append(vms, VM{Name: dom.Name, Role: dom.Role, Status: DomainStateName(dom.State)})
 	}
 	return vms, nil
 }
 
-// Helper function to check if a VM name contains the cluster name
-func nameContainsCluster(name, clusterName string) bool {
-	return name == clusterName || name == fmt.Sprintf("%s-bootstrap", clusterName) || name == fmt.Sprintf("%s-master", clusterName)
+// DomainStateName returns the name virsh uses for a domain state.
+func DomainStateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "idle"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "in shutdown"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shut off"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "pmsuspended"
+	}
+	return "no state"
 }
 
 type VMParams struct {
-	Name      string
-	Memory    uint
-	CPUs      uint
-	DiskPath  string
-	OSVariant string
-	Location  string
-	ExtraArgs string
-	Network   string
+	Name       string
+	Memory     uint
+	CPUs       uint
+	DiskPath   string
+	OSVariant  string
+	Location   string
+	ExtraArgs  string
+	Network    string
+	MAC        string
+	Arch       string      // ArchX86_64 (default) or ArchAArch64
+	Firmware   string      // FirmwareBIOS (default), FirmwareUEFI or FirmwareUEFISecure
+	NVRAM      string      // UEFI variable store, see NVRAMPath
+	TPM        bool        // add an emulated TPM 2.0
+	Machine    string      // machine type, see HostCaps; defaults to the q35 or virt alias
+	CPUMode    string      // CPUHostPassthrough (default) or CPUHostModel
+	ConsoleLog string      // serial console log file, see ConsoleLogPath
+	Disks      []ExtraDisk // data disks; their volumes must exist
+	Tuning     Tuning      // CPU pinning, NUMA placement, huge pages and disk modes
+	Owner      Ownership   // cluster and role recorded in the domain metadata
 }
 
-// CreateVM creates a new VM based on the provided parameters
+// CreateVM defines a new VM based on the provided parameters. The domain is
+// not started; use StartVM once its DHCP reservation is in place.
 func CreateVM(conn *libvirt.Connect, params VMParams) error {
+	if params.Arch == "" {
+		params.Arch = ArchX86_64
+	}
+	if params.Machine == "" {
+		params.Machine = machineType(params.Arch)
+	}
+	for _, disk := range params.Disks {
+		params.Owner.Volumes = append(params.Owner.Volumes, disk.Pool+"/"+disk.Volume)
+	}
+	// There is no BIOS for ARM guests; libvirt picks AAVMF for UEFI
+	if params.Arch == ArchAArch64 && !IsUEFI(params.Firmware) {
+		params.Firmware = FirmwareUEFI
+	}
+
+	// Pin the NIC to a known MAC so the DHCP reservation matches on first boot
+	macXML := ""
+	if params.MAC != "" {
+		macXML = fmt.Sprintf("\n      <mac address='%s'/>", params.MAC)
+	}
+
 	// Updated domain XML with additional features and metadata
 	domainXML := fmt.Sprintf(`
 <domain type='kvm'>
@@ -78,43 +114,40 @@ func CreateVM(conn *libvirt.Connect, params VMParams) error {
   <metadata>
     <libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0">
       <libosinfo:os id="http://redhat.com/rhel/9.0"/>
-    </libosinfo:libosinfo>
+    </libosinfo:libosinfo>%s
   </metadata>
   <memory unit='MiB'>%d</memory>
-  <vcpu placement='static'>%d</vcpu>
-  <cpu mode='host-passthrough'>
-    <model fallback='allow'/>
-  </cpu>
-  <os>
-    <type arch='x86_64' machine='pc-q35-rhel9.4.0'>hvm</type>
-    <boot dev='hd'/>
-  </os>
+  <vcpu placement='static'>%d</vcpu>%s
+  %s
+  %s
   <features>
-    <acpi/>
-    <apic/>
+    <acpi/>%s%s
   </features>
   <devices>
     <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
+      <driver name='qemu' type='qcow2'%s/>
       <source file='%s'/>
       <target dev='vda' bus='virtio'/>
-    </disk>
-    <interface type='network'>
+    </disk>%s
+    <interface type='network'>%s
       <source network='%s'/>
       <model type='virtio'/>
-    </interface>
+    </interface>%s%s%s%s
     <graphics type='vnc' autoport='yes'/>
   </devices>
-</domain>`, params.Name, params.Memory, params.CPUs, params.DiskPath, params.Network)
+</domain>`, params.Name, params.Owner.metadataXML(), params.Memory, params.CPUs, tuningXML(params.Tuning), cpuXML(params.CPUMode),
+		osXML(params, fmt.Sprintf("<type arch='%s' machine='%s'>hvm</type>", params.Arch, params.Machine)),
+		archFeaturesXML(params.Arch), firmwareFeaturesXML(params),
+		diskDriverAttrs(params.Tuning, ""), params.DiskPath, extraDisksXML(params.Disks, params.Tuning), macXML, params.Network, serialXML(params.ConsoleLog), agentChannelXML, tpmXML(params), archDevicesXML(params.Arch))
 
-	// Create and define the domain with the updated XML
-	domain, err := conn.DomainCreateXML(domainXML, 0)
+	// Define the persistent domain with the updated XML
+	domain, err := conn.DomainDefineXML(domainXML)
 	if err != nil {
-		return fmt.Errorf("failed to create domain: %v", err)
+		return fmt.Errorf("failed to define domain: %v", err)
 	}
 	defer domain.Free()
 
-	fmt.Printf("VM %s created successfully.\n", params.Name)
+	fmt.Printf("VM %s defined successfully.\n", params.Name)
 	return nil
 }
 
@@ -156,97 +189,69 @@ func DestroyVM(conn *libvirt.Connect, vmName string) error {
 	}
 	defer dom.Free()
 
-	err = dom.Undefine()
+	// UEFI domains cannot be undefined without deciding what happens to their NVRAM, and
+	// domains with snapshots without dropping their metadata
+	err = dom.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
 	if err != nil {
 		return fmt.Errorf("failed to destroy VM %s: %v", vmName, err)
 	}
 	return nil
 }
 
-// GetVMIP retrieves the IP address and MAC address of a VM by querying its network interfaces.
-func GetVMIP(conn *libvirt.Connect, vmName string) (string, string, error) {
-	// Lookup the domain (VM) by its name
+// RemoveVM stops and undefines a VM and deletes its root disk image. A VM that does not
+// exist is not an error.
+func RemoveVM(conn *libvirt.Connect, vmName string) error {
 	dom, err := conn.LookupDomainByName(vmName)
 	if err != nil {
-		fmt.Printf("Failed to find VM %s: %v\n", vmName, err)
-		return "", "", err
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_DOMAIN {
+			return nil
+		}
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
 	}
 	defer dom.Free()
 
-	// Get domain interfaces (network information)
-	ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	xmlDesc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
 	if err != nil {
-		fmt.Printf("Failed to list network interfaces for VM %s: %v\n", vmName, err)
-		return "", "", err
-	}
-
-	// Loop through interfaces to find the IP and MAC addresses
-	for _, iface := range ifaces {
-		if iface.Hwaddr != "" {
-			for _, addr := range iface.Addrs {
-				if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 && strings.Contains(addr.Addr, ".") {
-					return addr.Addr, iface.Hwaddr, nil
-				}
-			}
-		}
+		return fmt.Errorf("failed to get XML description of VM %s: %v", vmName, err)
 	}
-	return "", "", nil
-}
+	disk, _ := DomainDiskPath(xmlDesc)
 
-// AddDHCPReservation adds a DHCP reservation for a VM by specifying its MAC address and IP address
-func AddDHCPReservation(conn *libvirt.Connect, networkName string, macAddress string, ipAddress string) error {
-	// Find the network by its name
-	network, err := conn.LookupNetworkByName(networkName)
+	state, _, err := dom.GetState()
 	if err != nil {
-		return fmt.Errorf("failed to find network %s: %v", networkName, err)
+		return fmt.Errorf("failed to get state of VM %s: %v", vmName, err)
 	}
-	defer network.Free()
-
-	// DHCP host XML to be added
-	dhcpHostXML := fmt.Sprintf("<host mac='%s' ip='%s'/>", macAddress, ipAddress)
-
-	// Add the DHCP reservation to the network
-	err = network.Update(
-		libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST,
-		libvirt.NETWORK_SECTION_IP_DHCP_HOST,
-		-1,
-		dhcpHostXML,
-		libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to add DHCP reservation for MAC %s and IP %s: %v", macAddress, ipAddress, err)
+	if state != libvirt.DOMAIN_SHUTOFF {
+		if err = dom.Destroy(); err != nil {
+			return fmt.Errorf("failed to stop VM %s: %v", vmName, err)
+		}
 	}
-
-	fmt.Printf("Successfully added DHCP reservation: MAC=%s, IP=%s\n", macAddress, ipAddress)
+	if err = dom.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA); err != nil {
+		return fmt.Errorf("failed to undefine VM %s: %v", vmName, err)
+	}
+	if disk != "" {
+		if err = RemoveDiskImage(conn, disk); err != nil {
+			return fmt.Errorf("failed to remove disk %s of VM %s: %v", disk, vmName, err)
+		}
+	}
+	logging.Info(fmt.Sprintf("Removed VM %s", vmName))
 	return nil
 }
 
-// WaitForSSHAccess continuously checks if SSH access to the specified VM is available
-func WaitForSSHAccess(vmIP, host, sshKeyPath, sshUser string) error {
-	// Use ssh-keygen to remove any previous host key for the VM
-	err := removeOldHostKey(vmIP)
-	if err != nil {
-		return err
+// RemoveDiskImage deletes a disk image through its storage pool, which also works on a
+// remote host. Images outside any pool can only be removed locally.
+func RemoveDiskImage(conn *libvirt.Connect, path string) error {
+	if vol, err := conn.LookupStorageVolByPath(path); err == nil {
+		defer vol.Free()
+		return vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
 	}
-	err = removeOldHostKey(host)
-	if err != nil {
-		return err
+	if ConnIsRemote(conn) {
+		logging.Warn(fmt.Sprintf("%s is not in a storage pool of the remote host; remove it there", path))
+		return nil
 	}
-
-	// Loop to wait for SSH access to become available
-	for {
-		time.Sleep(5 * time.Second)
-		logging.Info(fmt.Sprintf("Trying to establish SSH connection to %s (%s)", host, vmIP))
-
-		cmd := exec.Command("ssh", "-i", sshKeyPath, "-o", "StrictHostKeyChecking=no", fmt.Sprintf("%s@%s", sshUser, vmIP), "true")
-		err := cmd.Run()
-		if err == nil {
-			logging.Info(fmt.Sprintf("SSH access to %s established", vmIP))
-			return nil
-		}
-
-		logging.Info("SSH access not available yet, retrying...")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return nil
 }
 
 // removeOldHostKey removes an old SSH host key for the given host/IP from known_hosts
@@ -0,0 +1,251 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"libvirt.org/go/libvirt"
+	"openshift-qemu/pkg/logging"
+)
+
+// pollInterval is how often state is re-checked when no event arrives. libvirt has no
+// DHCP lease or ARP events, so address lookups always rely on it.
+const pollInterval = 5 * time.Second
+
+// WaitTimeouts holds the deadline of each phase of bringing up a VM.
+type WaitTimeouts struct {
+	Start time.Duration // domain reported as running
+	IP    time.Duration // IP address discovered
+	SSH   time.Duration // SSH login succeeds
+}
+
+// DefaultWaitTimeouts are used for phases without an explicit timeout.
+var DefaultWaitTimeouts = WaitTimeouts{
+	Start: 2 * time.Minute,
+	IP:    10 * time.Minute,
+	SSH:   30 * time.Minute,
+}
+
+// WithDefaults fills unset phases from DefaultWaitTimeouts.
+func (t WaitTimeouts) WithDefaults() WaitTimeouts {
+	if t.Start <= 0 {
+		t.Start = DefaultWaitTimeouts.Start
+	}
+	if t.IP <= 0 {
+		t.IP = DefaultWaitTimeouts.IP
+	}
+	if t.SSH <= 0 {
+		t.SSH = DefaultWaitTimeouts.SSH
+	}
+	return t
+}
+
+// TimeoutError is returned when a VM does not reach the awaited state in time.
+type TimeoutError struct {
+	VM      string
+	What    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for %s of VM %s", e.Timeout, e.What, e.VM)
+}
+
+var eventLoopOnce sync.Once
+
+// startEventLoop registers the default libvirt event implementation and runs it in the
+// background. Only connections opened afterwards deliver events.
+func startEventLoop() {
+	eventLoopOnce.Do(func() {
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			logging.Warn(fmt.Sprintf("libvirt events unavailable, falling back to polling: %v", err))
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					logging.Warn(fmt.Sprintf("libvirt event loop failed: %v", err))
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	})
+}
+
+// watchLifecycle subscribes to the lifecycle events of a domain. The returned function
+// deregisters the callback. Without a working event loop the channel stays silent and
+// callers fall back to polling.
+func watchLifecycle(conn *libvirt.Connect, dom *libvirt.Domain) (<-chan libvirt.DomainEventType, func()) {
+	events := make(chan libvirt.DomainEventType, 8)
+	callbackID, err := conn.DomainEventLifecycleRegister(dom, func(_ *libvirt.Connect, _ *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		select {
+		case events <- event.Event:
+		default:
+		}
+	})
+	if err != nil {
+		logging.Warn(fmt.Sprintf("Failed to subscribe to domain events, polling instead: %v", err))
+		return events, func() {}
+	}
+	return events, func() { conn.DomainEventDeregister(callbackID) }
+}
+
+// waitError turns an expired context into a TimeoutError naming the VM and the phase.
+func waitError(ctx context.Context, vmName, what string, timeout time.Duration) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{VM: vmName, What: what, Timeout: timeout}
+	}
+	return ctx.Err()
+}
+
+// WaitForRunning waits until libvirt reports the domain as running.
+func WaitForRunning(ctx context.Context, conn *libvirt.Connect, vmName string, timeout time.Duration) error {
+	return waitForState(ctx, conn, vmName, libvirt.DOMAIN_RUNNING, "start", timeout)
+}
+
+// WaitForShutoff waits until libvirt reports the domain as shut off.
+func WaitForShutoff(ctx context.Context, conn *libvirt.Connect, vmName string, timeout time.Duration) error {
+	return waitForState(ctx, conn, vmName, libvirt.DOMAIN_SHUTOFF, "shutdown", timeout)
+}
+
+// waitForState waits until the domain reaches the wanted state. A crash always ends the wait.
+func waitForState(ctx context.Context, conn *libvirt.Connect, vmName string, want libvirt.DomainState, what string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	// Subscribe before the first state check so a change in between is not missed
+	events, stop := watchLifecycle(conn, dom)
+	defer stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, _, err := dom.GetState()
+		if err != nil {
+			return fmt.Errorf("failed to get state of VM %s: %v", vmName, err)
+		}
+		if state == want {
+			return nil
+		}
+		if state == libvirt.DOMAIN_CRASHED {
+			return fmt.Errorf("VM %s crashed while waiting for %s", vmName, what)
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitError(ctx, vmName, what, timeout)
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForIP waits until one of the lookup's sources knows the VM's IPv4 address and returns
+// it with the MAC address of the NIC. The recorded address of the static source is only
+// returned once the timeout expires. It fails early if the domain stops or crashes, or if
+// the console log shows a boot failure.
+func WaitForIP(ctx context.Context, conn *libvirt.Connect, vmName string, lookup IPLookup, consoleLog string, timeout time.Duration) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find VM %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	events, stop := watchLifecycle(conn, dom)
+	defer stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	console := newConsoleWatcher(vmName, consoleLog)
+
+	for {
+		ip, mac, source, err := GetVMIP(conn, vmName, lookup)
+		if err == nil && ip != "" && mac != "" {
+			logging.Info(fmt.Sprintf("Obtained IP: %s for VM: %s (%s)", ip, vmName, source))
+			return ip, mac, nil
+		}
+		if err = console.check(); err != nil {
+			return "", "", err
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				if ip, mac, err := StaticVMIP(conn, vmName, lookup); err == nil && ip != "" {
+					logging.Warn(fmt.Sprintf("No live source found the IP of VM %s within %s; using the recorded %s", vmName, timeout, ip))
+					return ip, mac, nil
+				}
+			}
+			return "", "", waitError(ctx, vmName, "an IP address", timeout)
+		case event := <-events:
+			if event == libvirt.DOMAIN_EVENT_STOPPED || event == libvirt.DOMAIN_EVENT_CRASHED {
+				return "", "", fmt.Errorf("VM %s stopped while waiting for an IP address", vmName)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForSSHAccess waits until an SSH login to the VM succeeds, failing early if the
+// console log shows a boot failure. While SSH is refused, the guest agent is asked
+// whether sshd runs, so a timeout tells a dead sshd from an unreachable guest.
+func WaitForSSHAccess(ctx context.Context, conn *libvirt.Connect, vmName, vmIP, host, sshKeyPath, sshUser, consoleLog string, timeout time.Duration) error {
+	// Use ssh-keygen to remove any previous host key for the VM
+	err := removeOldHostKey(vmIP)
+	if err != nil {
+		return err
+	}
+	err = removeOldHostKey(host)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	console := newConsoleWatcher(host, consoleLog)
+
+	sshd := ""
+	for {
+		logging.Info(fmt.Sprintf("Trying to establish SSH connection to %s (%s)", host, vmIP))
+
+		cmd := exec.CommandContext(ctx, "ssh", "-i", sshKeyPath, "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10", fmt.Sprintf("%s@%s", sshUser, vmIP), "true")
+		if err := cmd.Run(); err == nil {
+			logging.Info(fmt.Sprintf("SSH access to %s established", vmIP))
+			return nil
+		}
+		if err := console.check(); err != nil {
+			return err
+		}
+		if state := sshdState(ctx, conn, vmName); state != "" {
+			sshd = state
+		}
+
+		select {
+		case <-ctx.Done():
+			if sshd != "" {
+				return fmt.Errorf("%w (guest agent reports sshd %s)", waitError(ctx, host, "SSH access", timeout), sshd)
+			}
+			return waitError(ctx, host, "SSH access", timeout)
+		case <-ticker.C:
+			if sshd != "" {
+				logging.Info(fmt.Sprintf("SSH access not available yet (sshd %s), retrying...", sshd))
+			} else {
+				logging.Info("SSH access not available yet, retrying...")
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Chains in which libvirt rejects new connections into NAT networks: the iptables
+// backend and the nftables backend of libvirt 10.4 and later.
+var libvirtForwardChains = [][2]string{
+	{"ip filter", "LIBVIRT_FWI"},
+	{"ip libvirt_network", "guest_input"},
+}
+
+// Forward exposes ports of a guest on an address of the host.
+type Forward struct {
+	Cluster string
+	HostIP  string
+	GuestIP string
+	Ports   []int
+}
+
+// tableName is the nftables table holding the forwarding rules of a cluster.
+func tableName(cluster string) string {
+	return "openshift-qemu-" + cluster
+}
+
+// comment tags every rule added for a cluster, so it can be found and removed again.
+func comment(cluster string) string {
+	return "openshift-qemu:" + cluster
+}
+
+// ruleset renders the table of a forward. Connections to the host address are translated
+// to the guest, and masqueraded so replies return through the host whatever the guest's
+// default route.
+func (f Forward) ruleset() string {
+	ports := make([]string, 0, len(f.Ports))
+	for _, port := range f.Ports {
+		ports = append(ports, fmt.Sprint(port))
+	}
+	set := strings.Join(ports, ", ")
+	table, tag := tableName(f.Cluster), comment(f.Cluster)
+	return fmt.Sprintf(`table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		ip daddr %[2]s tcp dport { %[4]s } dnat to %[3]s comment "%[5]s"
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ip daddr %[2]s tcp dport { %[4]s } dnat to %[3]s comment "%[5]s"
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip daddr %[3]s tcp dport { %[4]s } ct status dnat masquerade comment "%[5]s"
+	}
+}
+`, table, f.HostIP, f.GuestIP, set, tag)
+}
+
+// Apply replaces the forwarding table of the cluster in one transaction and lets the
+// translated connections through libvirt's forward rules.
+func Apply(f Forward) error {
+	if len(f.Ports) == 0 {
+		return fmt.Errorf("no ports to forward")
+	}
+	if err := run(f.ruleset(), "-f", "-"); err != nil {
+		return err
+	}
+	if err := removeLibvirtAccepts(f.Cluster); err != nil {
+		return err
+	}
+	ports := make([]string, 0, len(f.Ports))
+	for _, port := range f.Ports {
+		ports = append(ports, fmt.Sprint(port))
+	}
+	for _, chain := range existingLibvirtChains() {
+		rule := fmt.Sprintf("ip daddr %s tcp dport { %s } ct status dnat accept comment \"%s\"", f.GuestIP, strings.Join(ports, ", "), comment(f.Cluster))
+		if err := run("", append([]string{"insert", "rule"}, append(strings.Fields(chain[0]), chain[1], rule)...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the forwarding table of the cluster and its rules in libvirt's chains.
+// A cluster without forwarding is not an error.
+func Remove(cluster string) error {
+	if err := removeLibvirtAccepts(cluster); err != nil {
+		return err
+	}
+	if Exists(cluster) {
+		return run("", "delete", "table", "ip", tableName(cluster))
+	}
+	return nil
+}
+
+// Exists reports whether the cluster has a forwarding table.
+func Exists(cluster string) bool {
+	return exec.Command("nft", "list", "table", "ip", tableName(cluster)).Run() == nil
+}
+
+var ruleHandle = regexp.MustCompile(`# handle (\d+)\s*$`)
+
+// removeLibvirtAccepts deletes the rules tagged for the cluster from libvirt's chains.
+func removeLibvirtAccepts(cluster string) error {
+	tag := fmt.Sprintf("comment \"%s\"", comment(cluster))
+	for _, chain := range existingLibvirtChains() {
+		out, err := exec.Command("nft", append([]string{"-a", "list", "chain"}, append(strings.Fields(chain[0]), chain[1])...)...).Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			m := ruleHandle.FindStringSubmatch(line)
+			if m == nil || !strings.Contains(line, tag) {
+				continue
+			}
+			if err = run("", append([]string{"delete", "rule"}, append(strings.Fields(chain[0]), chain[1], "handle", m[1])...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// existingLibvirtChains returns the libvirt forward chains present on the host.
+func existingLibvirtChains() [][2]string {
+	var chains [][2]string
+	for _, chain := range libvirtForwardChains {
+		args := append([]string{"list", "chain"}, append(strings.Fields(chain[0]), chain[1])...)
+		if exec.Command("nft", args...).Run() == nil {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// run runs nft with the arguments, feeding it stdin when given.
+func run(stdin string, args ...string) error {
+	cmd := exec.Command("nft", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft %s failed: %v\nOutput: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
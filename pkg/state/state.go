@@ -0,0 +1,192 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dir is the directory holding one state file per cluster.
+var Dir = "/var/lib/openshift-qemu"
+
+// Node is the recorded network identity of a cluster VM.
+type Node struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Role string `json:"role"`
+	MAC  string `json:"mac"`
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6,omitempty"`
+
+	// Firmware choices are kept so NVRAM and TPM state survive stop, snapshot and revert
+	Firmware string `json:"firmware,omitempty"`
+	NVRAM    string `json:"nvram,omitempty"`
+	TPM      bool   `json:"tpm,omitempty"`
+
+	// Extra data disks as pool/volume, removed with the cluster
+	Disks []string `json:"disks,omitempty"`
+}
+
+// Snapshot is a set of VM snapshots taken together across the cluster.
+type Snapshot struct {
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"createdAt"`
+	OCPVersion string    `json:"ocpVersion,omitempty"`
+	Nodes      []string  `json:"nodes"`             // domains included in the snapshot
+	Running    []string  `json:"running,omitempty"` // domains that were running when it was taken
+	Shutdown   bool      `json:"shutdown"`          // taken after a graceful shutdown
+}
+
+// ClusterState is what the tool remembers about a cluster between runs.
+type ClusterState struct {
+	Name       string `json:"name"`
+	Network    string `json:"network"`
+	OCPVersion string `json:"ocpVersion,omitempty"`
+
+	// Set when the tool created Network for this cluster instead of using an existing one.
+	// libvirt before 9.7 drops network metadata, so destroy relies on it there.
+	NetworkCreated bool `json:"networkCreated,omitempty"`
+
+	// Machine chosen from the host capabilities, so every VM of the cluster matches
+	Arch        string `json:"arch,omitempty"`
+	MachineType string `json:"machineType,omitempty"`
+	CPUMode     string `json:"cpuMode,omitempty"`
+
+	Nodes      []Node     `json:"nodes"`
+	InfraNodes []string   `json:"infraNodes,omitempty"` // workers running the ingress routers
+	LBDisabled []string   `json:"lbDisabled,omitempty"` // hosts kept out of the load balancer
+	Snapshots  []Snapshot `json:"snapshots,omitempty"`
+	Forward    *Forward   `json:"forward,omitempty"`
+	HostLB     *HostLB    `json:"hostLB,omitempty"` // set when the load balancer runs on the host
+}
+
+// HostLB is a load balancer running on the libvirt host instead of in a VM of its own.
+type HostLB struct {
+	Mode string `json:"mode"`
+	IP   string `json:"ip"` // libvirt gateway address it listens on
+	IPv6 string `json:"ipv6,omitempty"`
+	Unit string `json:"unit"` // systemd unit running it
+}
+
+// Forward is host-side access to the load balancer, kept so it can be shown and removed.
+type Forward struct {
+	HostIP string `json:"hostIP"`
+	LBIP   string `json:"lbIP"`
+	Ports  []int  `json:"ports"`
+}
+
+// Path returns the location of the state file of a cluster.
+func Path(clusterName string) string {
+	return filepath.Join(Dir, clusterName+".json")
+}
+
+// List returns the names of all clusters with a state file.
+func List() ([]string, error) {
+	entries, err := os.ReadDir(Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Load reads the state of a cluster. A cluster without a state file gets an empty state.
+func Load(clusterName string) (*ClusterState, error) {
+	s := &ClusterState{Name: clusterName}
+	data, err := os.ReadFile(Path(clusterName))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster state: %v", err)
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster state %s: %v", Path(clusterName), err)
+	}
+	return s, nil
+}
+
+// Save writes the state atomically so an interrupted run never leaves a truncated file.
+func (s *ClusterState) Save() error {
+	if err := os.MkdirAll(Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster state: %v", err)
+	}
+
+	tmp := Path(s.Name) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+	if err = os.Rename(tmp, Path(s.Name)); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+	return nil
+}
+
+// Node returns the recorded node with the given domain name, or nil.
+func (s *ClusterState) Node(name string) *Node {
+	for i := range s.Nodes {
+		if s.Nodes[i].Name == name {
+			return &s.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// SetNode records a node, replacing an earlier record with the same name.
+func (s *ClusterState) SetNode(node Node) {
+	if existing := s.Node(node.Name); existing != nil {
+		*existing = node
+		return
+	}
+	s.Nodes = append(s.Nodes, node)
+}
+
+// RemoveNode forgets a recorded node.
+func (s *ClusterState) RemoveNode(name string) {
+	for i := range s.Nodes {
+		if s.Nodes[i].Name == name {
+			s.Nodes = append(s.Nodes[:i], s.Nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Snapshot returns the recorded snapshot with the given name, or nil.
+func (s *ClusterState) Snapshot(name string) *Snapshot {
+	for i := range s.Snapshots {
+		if s.Snapshots[i].Name == name {
+			return &s.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// RemoveSnapshot forgets a recorded snapshot.
+func (s *ClusterState) RemoveSnapshot(name string) {
+	for i := range s.Snapshots {
+		if s.Snapshots[i].Name == name {
+			s.Snapshots = append(s.Snapshots[:i], s.Snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+// HasFirmwareState reports whether the node keeps state outside its disk.
+func (n Node) HasFirmwareState() bool {
+	return n.NVRAM != "" || n.TPM
+}
@@ -131,6 +131,12 @@ func (s *Systemd) Disable() error {
 	return nil
 }
 
+// DaemonReload makes systemd pick up added, changed and removed unit files
+func DaemonReload() error {
+	_, err := runCommand("systemctl", "daemon-reload")
+	return err
+}
+
 // runCommand executes a command and returns its output
 func runCommand(cmd string, args ...string) (string, error) {
 	out, err := exec.Command(cmd, args...).Output()
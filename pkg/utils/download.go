@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"text/template"
 
+	"openshift-qemu/pkg/libvirt"
 	"openshift-qemu/pkg/logging"
 )
 
@@ -88,13 +89,14 @@ func HandleSSHKey(sshPubKeyFile string) error {
 
 type RHCOSTemplateData struct {
 	OCPVersion string
+	Arch       string
 }
 
 //go:embed templates/treeinfo.tmpl
 var treeinfoTemplate embed.FS
 
 // PrepareRHCOSInstall prepares the RHCOS install files using embedded templating
-func PrepareRHCOSInstall(kernel, initramfs, ocpVer string) error {
+func PrepareRHCOSInstall(kernel, initramfs, ocpVer, arch string) error {
 	logging.Info("Preparing RHCOS installation files")
 
 	// Create directory if not exists
@@ -133,7 +135,7 @@ func PrepareRHCOSInstall(kernel, initramfs, ocpVer string) error {
 	defer treeinfoFile.Close()
 
 	// Execute the template with data
-	data := RHCOSTemplateData{OCPVersion: ocpVer}
+	data := RHCOSTemplateData{OCPVersion: ocpVer, Arch: arch}
 	err = tmpl.Execute(treeinfoFile, data)
 	if err != nil {
 		logging.Error("Failed to execute template for .treeinfo", err)
@@ -149,15 +151,27 @@ var installConfigTemplate embed.FS
 
 // InstallConfig holds the data to be passed into the template for generating install-config.yaml.
 type InstallConfig struct {
-	ClusterName        string
-	ClusterNetworkCIDR string
-	NMaster            int
-	PullSecret         string
-	SSHPublicKey       string
+	ClusterName          string
+	ClusterNetworkCIDR   string
+	MachineNetworkCIDR   string
+	MachineNetworkV6CIDR string // set for dual-stack clusters
+	Architecture         string // amd64 or arm64
+	NMaster              int
+	PullSecret           string
+	SSHPublicKey         string
+}
+
+// installArchitecture maps a libvirt architecture to the name used by install-config.yaml.
+func installArchitecture(arch string) string {
+	if arch == libvirt.ArchAArch64 {
+		return "arm64"
+	}
+	return "amd64"
 }
 
 // CreateInstallConfig generates the install-config.yaml using an embedded template.
-func CreateInstallConfig(setupDir, clusterName string, nMast int, pullSec, sshPubKeyFile string) {
+// A non-empty machineNetworkV6 makes the cluster dual-stack.
+func CreateInstallConfig(setupDir, clusterName string, nMast int, pullSec, sshPubKeyFile, machineNetwork, machineNetworkV6, arch string) {
 	logging.Info("Creating install-config.yaml: ")
 
 	// Parse the embedded template
@@ -168,10 +182,13 @@ func CreateInstallConfig(setupDir, clusterName string, nMast int, pullSec, sshPu
 
 	// Prepare the data for the template
 	data := InstallConfig{
-		ClusterName:  clusterName,
-		NMaster:      nMast,
-		PullSecret:   pullSec,
-		SSHPublicKey: readFileContent(sshPubKeyFile),
+		ClusterName:          clusterName,
+		MachineNetworkCIDR:   machineNetwork,
+		MachineNetworkV6CIDR: machineNetworkV6,
+		Architecture:         installArchitecture(arch),
+		NMaster:              nMast,
+		PullSecret:           pullSec,
+		SSHPublicKey:         readFileContent(sshPubKeyFile),
 	}
 
 	// Create install_dir if it doesn't exist
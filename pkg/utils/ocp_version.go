@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"openshift-qemu/pkg/config"
+	"openshift-qemu/pkg/libvirt"
 	"openshift-qemu/pkg/logging"
 )
 
@@ -17,8 +18,30 @@ const (
 	RHCOS_MIRROR string = "https://mirror.openshift.com/pub/openshift-v4/dependencies/rhcos"
 )
 
+// ocpMirror returns the client mirror for the architecture. x86_64 keeps the historical location.
+func ocpMirror(arch string) string {
+	if arch == libvirt.ArchX86_64 {
+		return OCP_MIRROR
+	}
+	return fmt.Sprintf("https://mirror.openshift.com/pub/openshift-v4/%s/clients/ocp", arch)
+}
+
+// rhcosMirror returns the RHCOS mirror for the architecture.
+func rhcosMirror(arch string) string {
+	if arch == libvirt.ArchX86_64 {
+		return RHCOS_MIRROR
+	}
+	return fmt.Sprintf("https://mirror.openshift.com/pub/openshift-v4/%s/dependencies/rhcos", arch)
+}
+
+// artifactPattern matches a whole file name containing one of the kinds and the architecture,
+// e.g. rhcos-live-kernel-aarch64 or rhcos-4.17.0-x86_64-live-rootfs.x86_64.img.
+func artifactPattern(kinds, arch string) string {
+	return fmt.Sprintf(`[\w.-]*(?:%s)[\w.-]*%s[\w.-]*`, kinds, arch)
+}
+
 // Check runs the OpenShift and RHCOS version checks and downloads
-func Check(ocpVersion, rhcosVersion, lbImgURL string, yes bool) config.OpenShiftConfig {
+func Check(ocpVersion, rhcosVersion, lbImgURL, arch string, yes bool) config.OpenShiftConfig {
 	logging.Title("OPENSHIFT/RHCOS VERSION/URL CHECK")
 
 	cfg := config.OpenShiftConfig{
@@ -28,24 +51,25 @@ func Check(ocpVersion, rhcosVersion, lbImgURL string, yes bool) config.OpenShift
 	}
 
 	// Step 1: OpenShift Version CheckDependencies
-	cfg.InstallerURL, cfg.ClientURL, cfg.Installer, cfg.Client, cfg.OCPVersion = checkOpenShift(ocpVersion)
+	cfg.InstallerURL, cfg.ClientURL, cfg.Installer, cfg.Client, cfg.OCPVersion = checkOpenShift(ocpVersion, arch)
 
 	// Step 2: RHCOS Version CheckDependencies
-	cfg.Image, cfg.Kernel, cfg.RHCOSKernelURL, cfg.Initramfs, cfg.RHCOSInitramfs = checkRHCOS(rhcosVersion, cfg.OCPVersion)
+	cfg.Image, cfg.Kernel, cfg.RHCOSKernelURL, cfg.Initramfs, cfg.RHCOSInitramfs, cfg.ImageURL = checkRHCOS(rhcosVersion, cfg.OCPVersion, arch)
+	cfg.KernelURL, cfg.InitramfsURL = cfg.RHCOSKernelURL, cfg.RHCOSInitramfs
 
 	// Step 3: Validate CentOS Cloud Image (for Load Balancer)
 	validateCentOSImage(cfg.LBImageURL)
 
 	// Ask user if they want to continue, passing the version info
-	versionInfo := fmt.Sprintf("\n\nRed Hat OpenShift Version = %s\nRed Hat CoreOS Version = %s\nCentOS Image:%s\n\n", ocpVersion, rhcosVersion, cfg.LBImageURL)
+	versionInfo := fmt.Sprintf("\n\nRed Hat OpenShift Version = %s\nRed Hat CoreOS Version = %s\nArchitecture = %s\nCentOS Image:%s\n\n", ocpVersion, rhcosVersion, arch, cfg.LBImageURL)
 	VerifyContinue(yes, versionInfo)
 
 	return cfg
 }
 
 // checkOpenShift checks and returns the OpenShift client and installer URLs
-func checkOpenShift(ocpVersion string) (string, string, string, string, string) {
-	ocpVer, client, clientURL, installer, installerURL, err := checkOpenShiftVersion(ocpVersion)
+func checkOpenShift(ocpVersion, arch string) (string, string, string, string, string) {
+	ocpVer, client, clientURL, installer, installerURL, err := checkOpenShiftVersion(ocpVersion, arch)
 	if err != nil {
 		logging.Fatal("Failed to obtain OCP URL information", err)
 	}
@@ -62,8 +86,8 @@ func checkOpenShift(ocpVersion string) (string, string, string, string, string)
 }
 
 // checkRHCOS checks and returns the RHCOS kernel, initramfs, and image URLs
-func checkRHCOS(rhcosVersion, ocpVer string) (string, string, string, string, string) {
-	image, kernel, rhcosKernelURL, initramfs, rhcosInitramfsURL, rhcosImageURL := checkRHCOSVersion(ocpVer, rhcosVersion)
+func checkRHCOS(rhcosVersion, ocpVer, arch string) (string, string, string, string, string, string) {
+	image, kernel, rhcosKernelURL, initramfs, rhcosInitramfsURL, rhcosImageURL := checkRHCOSVersion(ocpVer, rhcosVersion, arch)
 	err := ValidateURL(rhcosKernelURL)
 	if err != nil {
 		logging.Fatal("URL Validation failed for RHCOS kernel", err)
@@ -77,7 +101,7 @@ func checkRHCOS(rhcosVersion, ocpVer string) (string, string, string, string, st
 		logging.Fatal("URL Validation failed for RHCOS image", err)
 	}
 
-	return image, kernel, rhcosKernelURL, initramfs, rhcosInitramfsURL
+	return image, kernel, rhcosKernelURL, initramfs, rhcosInitramfsURL, rhcosImageURL
 }
 
 // validateCentOSImage checks the validity of the CentOS cloud image URL
@@ -89,8 +113,9 @@ func validateCentOSImage(lbImgURL string) {
 }
 
 // checkOpenShiftVersion checks and normalizes the OpenShift version, returning the client and installer URLs
-func checkOpenShiftVersion(ocpVersion string) (string, string, string, string, string, error) {
+func checkOpenShiftVersion(ocpVersion, arch string) (string, string, string, string, string, error) {
 	var urldir, installer, client, clientURL, installerURL string
+	mirror := ocpMirror(arch)
 
 	// Normalize version
 	if ocpVersion == "latest" || ocpVersion == "stable" {
@@ -110,27 +135,28 @@ func checkOpenShiftVersion(ocpVersion string) (string, string, string, string, s
 	}
 
 	logging.Info(fmt.Sprintf("Looking up OCP4 client for release %s: ", urldir))
-	client = findInURL(OCP_MIRROR+"/"+urldir, "client-linux")
+	client = findInURL(mirror+"/"+urldir, "client-linux")
 	if client == "" {
-		return installer, client, clientURL, installer, installerURL, fmt.Errorf("no client found in %s/%s", OCP_MIRROR, urldir)
+		return installer, client, clientURL, installer, installerURL, fmt.Errorf("no client found in %s/%s", mirror, urldir)
 	}
-	clientURL = fmt.Sprintf("%s/%s/%s", OCP_MIRROR, urldir, client)
+	clientURL = fmt.Sprintf("%s/%s/%s", mirror, urldir, client)
 	logging.Info(client)
 
 	logging.Info(fmt.Sprintf("Looking up OCP4 installer for release %s: ", urldir))
-	installer = findInURL(OCP_MIRROR+"/"+urldir, "install-linux")
+	installer = findInURL(mirror+"/"+urldir, "install-linux")
 	if installer == "" {
-		return installer, client, clientURL, installer, installerURL, fmt.Errorf("no installer found in %s/%s", OCP_MIRROR, urldir)
+		return installer, client, clientURL, installer, installerURL, fmt.Errorf("no installer found in %s/%s", mirror, urldir)
 	}
-	installerURL = fmt.Sprintf("%s/%s/%s", OCP_MIRROR, urldir, installer)
+	installerURL = fmt.Sprintf("%s/%s/%s", mirror, urldir, installer)
 	logging.Info(installer)
 
 	return installer, client, clientURL, installer, installerURL, nil
 }
 
 // checkRHCOSVersion checks and normalizes the RHCOS version, returning the kernel, initramfs, and image URLs
-func checkRHCOSVersion(ocpVer, rhcosVersion string) (string, string, string, string, string, string) {
+func checkRHCOSVersion(ocpVer, rhcosVersion, arch string) (string, string, string, string, string, string) {
 	var path string
+	mirror := rhcosMirror(arch)
 
 	// Normalize version
 	if rhcosVersion == "" {
@@ -147,31 +173,34 @@ func checkRHCOSVersion(ocpVer, rhcosVersion string) (string, string, string, str
 		}
 	}
 
+	// Artefacts are listed in, and downloaded from, the release directory
+	dir := fmt.Sprintf("%s/%s/%s", mirror, rhcosVersion, path)
+
 	// Kernel
 	logging.Info(fmt.Sprintf("Looking up RHCOS kernel for release %s/%s: ", rhcosVersion, path))
-	kernel := findInURL(RHCOS_MIRROR+"/"+rhcosVersion+"/"+path, "installer-kernel|live-kernel")
+	kernel := findInURL(dir, artifactPattern("installer-kernel|live-kernel", arch))
 	if kernel == "" {
-		logging.Error(fmt.Sprintf("No kernel found in %s/%s", RHCOS_MIRROR, path), nil)
+		logging.Error(fmt.Sprintf("No %s kernel found in %s", arch, dir), nil)
 	}
-	kernelURL := fmt.Sprintf("%s/%s/%s", RHCOS_MIRROR, rhcosVersion, kernel)
+	kernelURL := fmt.Sprintf("%s/%s", dir, kernel)
 	logging.Info(kernel)
 
 	// Initramfs
 	logging.Info(fmt.Sprintf("Looking up RHCOS initramfs for release %s/%s: ", rhcosVersion, path))
-	initramfs := findInURL(RHCOS_MIRROR+"/"+rhcosVersion+"/"+path, "installer-initramfs|live-initramfs")
+	initramfs := findInURL(dir, artifactPattern("installer-initramfs|live-initramfs", arch))
 	if initramfs == "" {
-		logging.Error(fmt.Sprintf("No initramfs found in %s/%s", RHCOS_MIRROR, path), nil)
+		logging.Error(fmt.Sprintf("No %s initramfs found in %s", arch, dir), nil)
 	}
-	initramfsURL := fmt.Sprintf("%s/%s/%s", RHCOS_MIRROR, rhcosVersion, initramfs)
+	initramfsURL := fmt.Sprintf("%s/%s", dir, initramfs)
 	logging.Info(initramfs)
 
 	// Image
 	logging.Info(fmt.Sprintf("Looking up RHCOS image for release %s/%s: ", rhcosVersion, path))
-	image := findInURL(RHCOS_MIRROR+"/"+rhcosVersion+"/"+path, "metal|live-rootfs")
+	image := findInURL(dir, artifactPattern("metal|live-rootfs", arch))
 	if image == "" {
-		logging.Error(fmt.Sprintf("No image found in %s/%s", RHCOS_MIRROR, path), nil)
+		logging.Error(fmt.Sprintf("No %s image found in %s", arch, dir), nil)
 	}
-	imageURL := fmt.Sprintf("%s/%s/%s", RHCOS_MIRROR, rhcosVersion, image)
+	imageURL := fmt.Sprintf("%s/%s", dir, image)
 	logging.Info(image)
 
 	return image, kernel, kernelURL, initramfs, initramfsURL, imageURL
@@ -61,7 +61,7 @@ func runCommand(cmd string, args ...string) (string, error) {
 }
 
 // CheckDependencies performs all dependency and environment checks
-func CheckDependencies(setupDir, pullSecFile, dnsDir, clusterName, baseDom, libguestfsBackendDirect string) {
+func CheckDependencies(setupDir, pullSecFile, dnsDir, clusterName, baseDom, uri string) {
 	logging.Title("DEPENDENCIES & SANITY CHECKS")
 	commandRunDeps := Dependencies{
 		Executables: []string{virsh, virtInstall, virtCustomize, systemctl, dig, wget},
@@ -74,7 +74,7 @@ func CheckDependencies(setupDir, pullSecFile, dnsDir, clusterName, baseDom, libg
 	commandRunDeps.checkSetupDirectory()
 	commandRunDeps.checkFile()
 	checkVirtDaemons()
-	checkExistingVMs(clusterName, libguestfsBackendDirect)
+	checkExistingVMs(clusterName, uri)
 	checkDNSService(dnsDir)
 	checkConflictingDNSRecords(clusterName, baseDom)
 }
@@ -153,25 +153,29 @@ func checkVirtDaemons() {
 	}
 }
 
-// checkExistingVMs checks if there are existing VMs with the given cluster name
-func checkExistingVMs(clusterName, libguestfsBackendDirect string) {
+// checkExistingVMs checks if there are existing VMs owned by the given cluster
+func checkExistingVMs(clusterName, uri string) {
 	logging.Info("Checking if we have any existing leftover VMs:")
 
 	// Use libvirt.NewLibvirtConnection from the libvirt package
-	conn, err := libvirt.NewLibvirtConnection(libguestfsBackendDirect)
+	conn, err := libvirt.NewLibvirtConnection(uri)
 	if err != nil {
 		logging.Fatal("Failed to connect to libvirt", err)
 	}
 	defer conn.Close()
 
-	// Get VMs by cluster name
-	vms, err := libvirt.GetVMsByName(conn, clusterName)
+	// Get VMs tagged with the cluster name
+	vms, err := libvirt.GetClusterVMs(conn, clusterName)
 	if err != nil {
 		logging.Fatal("Failed to list VMs", err)
 	}
 
 	if len(vms) > 0 {
-		logging.Fatal(fmt.Sprintf("Found existing VM(s): %v", vms), nil)
+		names := make([]string, 0, len(vms))
+		for _, vm := range vms {
+			names = append(names, fmt.Sprintf("%s (%s, %s)", vm.Name, vm.Role, vm.Status))
+		}
+		logging.Fatal(fmt.Sprintf("Found existing VM(s): %s", strings.Join(names, ", ")), nil)
 	}
 	logging.Ok("No leftover VMs found")
 }